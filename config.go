@@ -0,0 +1,577 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/efarrer/evilproxy/parser"
+	"gopkg.in/yaml.v3"
+)
+
+/*
+ * The settings of the proxy, from the flags or a config file
+ */
+type settings struct {
+	connections   int
+	maxConcurrent int
+	drainTimeout  time.Duration
+	debug         bool
+	profiles      string
+	control       string
+	fault         resetFault
+	transport     transport
+}
+
+/*
+ * A config is a JSON or YAML config file describing the proxy's settings and
+ * routes. Settings that are left out keep their defaults.
+ *
+ *     {
+ *         "connections": 100,
+ *         "maxConcurrent": 10,
+ *         "drainTimeout": "5s",
+ *         "transport": "reno,flow",
+ *         "rto": "200ms",
+ *         "window": 65536,
+ *         "profiles": "profiles.txt",
+ *         "control": "localhost:9000",
+ *         "reset": {"afterBytes": 65536, "after": "30s", "socket": "accepted", "midWrite": true},
+ *         "routes": [
+ *             {"listen": ":8080", "upstream": "localhost:80", "rule": "profile(3g)"},
+ *             {"listen": ":8443", "upstream": "localhost:443",
+ *                 "up": "latency(20ms)", "down": "latency(300ms) | loss(1%)"}
+ *         ]
+ *     }
+ *
+ * or the same in YAML
+ *
+ *     connections: 100
+ *     transport: reno,flow
+ *     reset: {afterBytes: 65536, socket: accepted}
+ *     routes:
+ *       - listen: ":8080"
+ *         upstream: localhost:80
+ *         rule: profile(3g)
+ *
+ * A route's network is described by a rule, or by separate pipe chains for
+ * the upstream and downstream directions. A direction without a chain
+ * simulates a perfect network.
+ */
+type config struct {
+	Connections   *int          `json:"connections" yaml:"connections"`
+	MaxConcurrent *int          `json:"maxConcurrent" yaml:"maxConcurrent"`
+	DrainTimeout  *string       `json:"drainTimeout" yaml:"drainTimeout"`
+	Debug         *bool         `json:"debug" yaml:"debug"`
+	Transport     *string       `json:"transport" yaml:"transport"`
+	Rto           *string       `json:"rto" yaml:"rto"`
+	Window        *int64        `json:"window" yaml:"window"`
+	Profiles      *string       `json:"profiles" yaml:"profiles"`
+	Control       *string       `json:"control" yaml:"control"`
+	Reset         *resetConfig  `json:"reset" yaml:"reset"`
+	Routes        []routeConfig `json:"routes" yaml:"routes"`
+
+	source string
+	// The line of each value by its path, e.g. routes[1].listen
+	lines map[string]int
+}
+
+type resetConfig struct {
+	AfterBytes *int64  `json:"afterBytes" yaml:"afterBytes"`
+	After      *string `json:"after" yaml:"after"`
+	Socket     *string `json:"socket" yaml:"socket"`
+	MidWrite   *bool   `json:"midWrite" yaml:"midWrite"`
+}
+
+type routeConfig struct {
+	Listen   string `json:"listen" yaml:"listen"`
+	Upstream string `json:"upstream" yaml:"upstream"`
+	Rule     string `json:"rule" yaml:"rule"`
+	Up       string `json:"up" yaml:"up"`
+	Down     string `json:"down" yaml:"down"`
+}
+
+/*
+ * Returns an error at the line of the value at path, or for the whole config
+ * if the value isn't in it
+ */
+func (c *config) errorAt(path string, format string, args ...interface{}) error {
+	line, ok := c.lines[path]
+	if !ok {
+		return errors.New(fmt.Sprintf("%v: %v", c.source, fmt.Sprintf(format, args...)))
+	}
+	return errors.New(fmt.Sprintf("%v:%v: %v", c.source, line, fmt.Sprintf(format, args...)))
+}
+
+/*
+ * Parses the duration at path
+ */
+func (c *config) duration(path string, text string) (time.Duration, error) {
+	duration, err := time.ParseDuration(text)
+	if err != nil {
+		return 0, c.errorAt(path, "%v should be a duration like \"200ms\", got \"%v\".", path, text)
+	}
+	return duration, nil
+}
+
+/*
+ * Sets the settings that are in the config, and validates them
+ */
+func (c *config) apply(s *settings) error {
+	var err error
+	if c.Connections != nil {
+		if *c.Connections < 0 {
+			return c.errorAt("connections", "connections can't be negative.")
+		}
+		s.connections = *c.Connections
+	}
+	if c.MaxConcurrent != nil {
+		if *c.MaxConcurrent < 0 {
+			return c.errorAt("maxConcurrent", "maxConcurrent can't be negative.")
+		}
+		s.maxConcurrent = *c.MaxConcurrent
+	}
+	if c.DrainTimeout != nil {
+		if s.drainTimeout, err = c.duration("drainTimeout", *c.DrainTimeout); err != nil {
+			return err
+		}
+		if s.drainTimeout < 0 {
+			return c.errorAt("drainTimeout", "drainTimeout can't be negative.")
+		}
+	}
+	if c.Debug != nil {
+		s.debug = *c.Debug
+	}
+	if c.Profiles != nil {
+		s.profiles = *c.Profiles
+	}
+	if c.Control != nil {
+		s.control = *c.Control
+	}
+
+	if c.Transport != nil {
+		s.transport.name = *c.Transport
+	}
+	if c.Rto != nil {
+		if s.transport.rto, err = c.duration("rto", *c.Rto); err != nil {
+			return err
+		}
+	}
+	if c.Window != nil {
+		if *c.Window <= 0 {
+			return c.errorAt("window", "window must be greater than zero.")
+		}
+		s.transport.window = *c.Window
+	}
+	if err := s.transport.validate(); err != nil {
+		if c.Transport == nil {
+			return c.errorAt("rto", "%v", err)
+		}
+		return c.errorAt("transport", "%v", err)
+	}
+
+	if r := c.Reset; r != nil {
+		if r.AfterBytes != nil {
+			s.fault.afterBytes = *r.AfterBytes
+		}
+		if r.After != nil {
+			if s.fault.afterTime, err = c.duration("reset.after", *r.After); err != nil {
+				return err
+			}
+		}
+		if r.Socket != nil {
+			s.fault.sockets = *r.Socket
+		}
+		if r.MidWrite != nil {
+			s.fault.midWrite = *r.MidWrite
+		}
+		if err := s.fault.validate(); err != nil {
+			return c.errorAt("reset", "%v", err)
+		}
+	}
+
+	if len(c.Routes) == 0 {
+		return c.errorAt("routes", "Expected at least one route.")
+	}
+	listening := map[string]int{}
+	for i, rc := range c.Routes {
+		path := fmt.Sprintf("routes[%v]", i)
+		if rc.Listen == "" || rc.Upstream == "" {
+			return c.errorAt(path, "%v needs a listen and an upstream address.", path)
+		}
+		if previous, ok := listening[rc.Listen]; ok {
+			return c.errorAt(path+".listen", "\"%v\" is already routed on line %v.", rc.Listen, previous)
+		}
+		listening[rc.Listen] = c.lines[path+".listen"]
+		if rc.Rule != "" && (rc.Up != "" || rc.Down != "") {
+			return c.errorAt(path, "%v can have a rule or up and down chains, not both.", path)
+		}
+	}
+	return nil
+}
+
+/*
+ * Returns the routes of the config. The rules are parsed so the profiles they
+ * use must have been registered.
+ */
+func (c *config) routes() ([]route, error) {
+	routes := []route{}
+	for i, rc := range c.Routes {
+		path := fmt.Sprintf("routes[%v]", i)
+		text := rc.Rule
+		if rc.Rule == "" {
+			// Check each direction on its own so errors point at its chain
+			sections := []string{}
+			for _, direction := range []struct{ name, chain string }{{"up", rc.Up}, {"down", rc.Down}} {
+				if direction.chain == "" {
+					continue
+				}
+				if _, err := parser.Parse(direction.chain); err != nil {
+					return nil, c.errorAt(path+"."+direction.name, "%v.%v. %v", path, direction.name, err)
+				}
+				sections = append(sections, direction.name+": "+direction.chain)
+			}
+			text = strings.Join(sections, ";\n")
+		}
+		rule, err := parser.Parse(text)
+		if err != nil {
+			key := path + ".rule"
+			if rc.Rule == "" {
+				key = path
+			}
+			return nil, c.errorAt(key, "%v. %v", key, err)
+		}
+		routes = append(routes, route{rc.Listen, rc.Upstream, rule})
+	}
+	return routes, nil
+}
+
+/*
+ * A schemaChecker checks that a JSON document only has the fields of a type,
+ * with values of the right kinds, and records the line of each value
+ */
+type schemaChecker struct {
+	text    []byte
+	source  string
+	decoder *json.Decoder
+	lines   map[string]int
+}
+
+/*
+ * Returns the line of the first token at or after the offset
+ */
+func (sc *schemaChecker) line(offset int64) int {
+	for offset < int64(len(sc.text)) && strings.IndexByte(" \t\r\n,:", sc.text[offset]) != -1 {
+		offset++
+	}
+	return bytes.Count(sc.text[:offset], []byte("\n")) + 1
+}
+
+func (sc *schemaChecker) errorAt(line int, format string, args ...interface{}) error {
+	return errors.New(fmt.Sprintf("%v:%v: %v", sc.source, line, fmt.Sprintf(format, args...)))
+}
+
+/*
+ * Reads the next token, describing syntax errors with their line
+ */
+func (sc *schemaChecker) token() (json.Token, int, error) {
+	line := sc.line(sc.decoder.InputOffset())
+	token, err := sc.decoder.Token()
+	if err == io.EOF {
+		return nil, line, sc.errorAt(line, "Unexpected end of the config.")
+	}
+	if serr, ok := err.(*json.SyntaxError); ok {
+		return nil, sc.line(serr.Offset), sc.errorAt(sc.line(serr.Offset), "Invalid JSON. %v.", err)
+	}
+	if err != nil {
+		return nil, line, sc.errorAt(line, "Invalid JSON. %v.", err)
+	}
+	return token, line, nil
+}
+
+/*
+ * Returns the JSON names of the type's fields, and the fields by name
+ */
+func jsonFields(t reflect.Type) ([]string, map[string]reflect.Type) {
+	names := []string{}
+	fields := map[string]reflect.Type{}
+	for i := 0; i != t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		names = append(names, name)
+		fields[name] = t.Field(i).Type
+	}
+	sort.Strings(names)
+	return names, fields
+}
+
+/*
+ * Checks the next value against the type
+ */
+func (sc *schemaChecker) check(path string, t reflect.Type) error {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	token, line, err := sc.token()
+	if err != nil {
+		return err
+	}
+	sc.lines[path] = line
+	name := path
+	if name == "" {
+		name = "The config"
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		if token != json.Delim('{') {
+			return sc.errorAt(line, "%v should be an object.", name)
+		}
+		names, fields := jsonFields(t)
+		for sc.decoder.More() {
+			token, line, err := sc.token()
+			if err != nil {
+				return err
+			}
+			key := token.(string)
+			field, ok := fields[key]
+			if !ok {
+				where := path
+				if where == "" {
+					where = "the config file"
+				}
+				return sc.errorAt(line, "Unknown field \"%v\" in %v, expected one of %v.",
+					key, where, strings.Join(names, ", "))
+			}
+			fieldPath := key
+			if path != "" {
+				fieldPath = path + "." + key
+			}
+			if err := sc.check(fieldPath, field); err != nil {
+				return err
+			}
+		}
+		_, _, err := sc.token()
+		return err
+
+	case reflect.Slice:
+		if token != json.Delim('[') {
+			return sc.errorAt(line, "%v should be a list.", name)
+		}
+		for i := 0; sc.decoder.More(); i++ {
+			if err := sc.check(fmt.Sprintf("%v[%v]", path, i), t.Elem()); err != nil {
+				return err
+			}
+		}
+		_, _, err := sc.token()
+		return err
+
+	case reflect.String:
+		if _, ok := token.(string); !ok {
+			return sc.errorAt(line, "%v should be a string.", name)
+		}
+
+	case reflect.Bool:
+		if _, ok := token.(bool); !ok {
+			return sc.errorAt(line, "%v should be true or false.", name)
+		}
+
+	case reflect.Int, reflect.Int64:
+		number, ok := token.(float64)
+		if !ok || number != float64(int64(number)) {
+			return sc.errorAt(line, "%v should be a whole number.", name)
+		}
+	}
+	return nil
+}
+
+/*
+ * Reads and validates a config. The source is used to describe the location
+ * of errors.
+ */
+func readConfig(reader io.Reader, source string) (*config, error) {
+	text, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	sc := &schemaChecker{text, source, json.NewDecoder(bytes.NewReader(text)), map[string]int{}}
+	if err := sc.check("", reflect.TypeOf(config{})); err != nil {
+		return nil, err
+	}
+	if sc.decoder.More() {
+		line := sc.line(sc.decoder.InputOffset())
+		return nil, sc.errorAt(line, "Unexpected data after the config.")
+	}
+
+	c := &config{source: source, lines: sc.lines}
+	if err := json.Unmarshal(text, c); err != nil {
+		return nil, errors.New(fmt.Sprintf("%v: %v", source, err))
+	}
+	return c, nil
+}
+
+/*
+ * A yamlSchemaChecker checks that a YAML document only has the fields of a
+ * type, with values of the right kinds, and records the line of each value
+ */
+type yamlSchemaChecker struct {
+	source string
+	lines  map[string]int
+}
+
+func (yc *yamlSchemaChecker) errorAt(line int, format string, args ...interface{}) error {
+	return errors.New(fmt.Sprintf("%v:%v: %v", yc.source, line, fmt.Sprintf(format, args...)))
+}
+
+/*
+ * Checks the node against the type. The line is that of the node's key, or of
+ * the node itself if it isn't the value of a field.
+ */
+func (yc *yamlSchemaChecker) check(path string, t reflect.Type, node *yaml.Node, line int) error {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	for node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	yc.lines[path] = line
+	name := path
+	if name == "" {
+		name = "The config"
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		if node.Kind != yaml.MappingNode {
+			return yc.errorAt(line, "%v should be an object.", name)
+		}
+		names, fields := jsonFields(t)
+		seen := map[string]int{}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			if previous, ok := seen[key.Value]; ok {
+				return yc.errorAt(key.Line, "\"%v\" is already set on line %v.", key.Value, previous)
+			}
+			seen[key.Value] = key.Line
+			field, ok := fields[key.Value]
+			if !ok || key.Kind != yaml.ScalarNode {
+				where := path
+				if where == "" {
+					where = "the config file"
+				}
+				return yc.errorAt(key.Line, "Unknown field \"%v\" in %v, expected one of %v.",
+					key.Value, where, strings.Join(names, ", "))
+			}
+			fieldPath := key.Value
+			if path != "" {
+				fieldPath = path + "." + key.Value
+			}
+			if err := yc.check(fieldPath, field, value, key.Line); err != nil {
+				return err
+			}
+		}
+
+	case reflect.Slice:
+		if node.Kind != yaml.SequenceNode {
+			return yc.errorAt(line, "%v should be a list.", name)
+		}
+		for i, item := range node.Content {
+			if err := yc.check(fmt.Sprintf("%v[%v]", path, i), t.Elem(), item, item.Line); err != nil {
+				return err
+			}
+		}
+
+	case reflect.String:
+		if node.Kind != yaml.ScalarNode || node.ShortTag() != "!!str" {
+			return yc.errorAt(line, "%v should be a string.", name)
+		}
+
+	case reflect.Bool:
+		if node.Kind != yaml.ScalarNode || node.ShortTag() != "!!bool" {
+			return yc.errorAt(line, "%v should be true or false.", name)
+		}
+
+	case reflect.Int, reflect.Int64:
+		var number int64
+		if node.Kind != yaml.ScalarNode || node.ShortTag() != "!!int" || node.Decode(&number) != nil {
+			return yc.errorAt(line, "%v should be a whole number.", name)
+		}
+	}
+	return nil
+}
+
+// Matches the line of a YAML syntax error, e.g. "yaml: line 3: did not find expected key"
+var yamlErrorLine = regexp.MustCompile(`^yaml: line (\d+): (.*)$`)
+
+/*
+ * Describes a YAML syntax error with its line
+ */
+func yamlError(source string, err error) error {
+	if match := yamlErrorLine.FindStringSubmatch(err.Error()); match != nil {
+		line, _ := strconv.Atoi(match[1])
+		return errors.New(fmt.Sprintf("%v:%v: Invalid YAML. %v.", source, line, match[2]))
+	}
+	return errors.New(fmt.Sprintf("%v: Invalid YAML. %v.", source, err))
+}
+
+/*
+ * Reads and validates a YAML config. The source is used to describe the
+ * location of errors.
+ */
+func readYAMLConfig(reader io.Reader, source string) (*config, error) {
+	decoder := yaml.NewDecoder(reader)
+	document := &yaml.Node{}
+	if err := decoder.Decode(document); err == io.EOF {
+		return nil, errors.New(fmt.Sprintf("%v: Unexpected end of the config.", source))
+	} else if err != nil {
+		return nil, yamlError(source, err)
+	}
+	root := document.Content[0]
+
+	yc := &yamlSchemaChecker{source, map[string]int{}}
+	if err := yc.check("", reflect.TypeOf(config{}), root, root.Line); err != nil {
+		return nil, err
+	}
+	next := &yaml.Node{}
+	if err := decoder.Decode(next); err == nil {
+		return nil, yc.errorAt(next.Content[0].Line, "Unexpected data after the config.")
+	} else if err != io.EOF {
+		return nil, yamlError(source, err)
+	}
+
+	c := &config{source: source, lines: yc.lines}
+	if err := root.Decode(c); err != nil {
+		return nil, errors.New(fmt.Sprintf("%v: %v", source, err))
+	}
+	return c, nil
+}
+
+/*
+ * Reads and validates the config file, which is YAML if its name ends in
+ * .yaml or .yml and JSON otherwise. See config for the format.
+ */
+func loadConfig(path string) (*config, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return readYAMLConfig(file, path)
+	}
+	return readConfig(file, path)
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/efarrer/evilproxy/testing_utils"
+)
+
+/*
+ * Returns the default settings, as the flags set them
+ */
+func defaultSettings() settings {
+	return settings{
+		connections:  -1,
+		drainTimeout: 10 * time.Second,
+		fault:        resetFault{sockets: "both"},
+		transport:    transport{name: "none", rto: 200 * time.Millisecond, window: 65536},
+	}
+}
+
+func TestConfigAppliesItsSettings(t *testing.T) {
+	text := `{
+		"connections": 100,
+		"maxConcurrent": 10,
+		"drainTimeout": "5s",
+		"transport": "reno,flow",
+		"rto": "50ms",
+		"window": 1024,
+		"control": "localhost:9000",
+		"reset": {"afterBytes": 65536, "after": "30s", "socket": "accepted", "midWrite": true},
+		"routes": [
+			{"listen": ":8080", "upstream": "localhost:80", "rule": "latency(5ms)"},
+			{"listen": ":8443", "upstream": "localhost:443",
+				"up": "latency(20ms)", "down": "latency(300ms) | loss(1%)"},
+			{"listen": ":5432", "upstream": "db:5432"}
+		]
+	}`
+	c, err := readConfig(strings.NewReader(text), "config")
+	testing_utils.UnexpectedError(err, "reading the config", t)
+	s := defaultSettings()
+	testing_utils.UnexpectedError(c.apply(&s), "applying the config", t)
+
+	expected := settings{
+		connections:   100,
+		maxConcurrent: 10,
+		drainTimeout:  5 * time.Second,
+		control:       "localhost:9000",
+		fault:         resetFault{65536, 30 * time.Second, "accepted", true},
+		transport:     transport{"reno,flow", 50 * time.Millisecond, 1024},
+	}
+	if s != expected {
+		t.Fatalf("Expected %+v got %+v", expected, s)
+	}
+
+	routes, err := c.routes()
+	testing_utils.UnexpectedError(err, "constructing the routes", t)
+	if len(routes) != 3 || routes[1].listen != ":8443" || routes[1].upstream != "localhost:443" {
+		t.Fatalf("Expected the routes of the config got %+v", routes)
+	}
+	network := routes[1].rule.Network()
+	if len(network.Upstream) != 1 || len(network.Downstream) != 2 {
+		t.Fatalf("Expected 1 upstream and 2 downstream pipes got %v and %v",
+			len(network.Upstream), len(network.Downstream))
+	}
+}
+
+func TestConfigKeepsTheDefaultsOfMissingSettings(t *testing.T) {
+	c, err := readConfig(strings.NewReader(`{"routes": [{"listen": ":1", "upstream": ":2"}]}`), "config")
+	testing_utils.UnexpectedError(err, "reading the config", t)
+	s := defaultSettings()
+	testing_utils.UnexpectedError(c.apply(&s), "applying the config", t)
+	if s != defaultSettings() {
+		t.Fatalf("Expected the default settings got %+v", s)
+	}
+}
+
+func TestConfigErrorsHaveLineNumbers(t *testing.T) {
+	for text, expected := range map[string]string{
+		"{\n\"routes\": [\n}": "config:3: Invalid JSON.",
+		"{\n\n":               "config:3: Invalid JSON. unexpected end of JSON input.",
+		"\n":                  "config:2: Unexpected end of the config.",
+		"{\n\"route\": []\n}": "config:2: Unknown field \"route\" in the config file, expected one of",
+		"{\"reset\": {\n\"socket\": \"both\",\n\"midwrite\": true}}": "config:3: Unknown field \"midwrite\" in reset, expected one of",
+		"{\n\"connections\": \"10\"\n}":                              "config:2: connections should be a whole number.",
+		"{\n\"connections\": 1.5\n}":                                 "config:2: connections should be a whole number.",
+		"{\n\"reset\": {\n\"midWrite\": 1}\n}":                       "config:3: reset.midWrite should be true or false.",
+		"{\n\"routes\": {}\n}":                                       "config:2: routes should be a list.",
+		"{\"routes\": [\n{\"listen\": \":1\", \"up\": 1}]}":          "config:2: routes[0].up should be a string.",
+		"{}\n{}": "config:2: Unexpected data after the config.",
+	} {
+		_, err := readConfig(strings.NewReader(text), "config")
+		if err == nil {
+			t.Fatalf("Expected an error reading %q", text)
+		}
+		if !strings.HasPrefix(err.Error(), expected) {
+			t.Fatalf("Expected an error starting with %q got %q", expected, err)
+		}
+	}
+}
+
+func TestConfigValidationErrorsHaveLineNumbers(t *testing.T) {
+	route := `"routes": [{"listen": ":1", "upstream": ":2"}]`
+	for text, expected := range map[string]string{
+		"{\n\"drainTimeout\": \"soon\",\n" + route + "}":              "config:2: drainTimeout should be a duration",
+		"{\n\"connections\": -1,\n" + route + "}":                     "config:2: connections can't be negative.",
+		"{\n\n\"drainTimeout\": \"-5s\",\n" + route + "}":             "config:3: drainTimeout can't be negative.",
+		"{\n\n\"transport\": \"tcp\",\n" + route + "}":                "config:3: Unknown transport layer \"tcp\"",
+		"{\"transport\": \"flow\",\n\"window\": 0,\n" + route + "}":   "config:2: window must be greater than zero.",
+		"{\"transport\": \"reno\",\n\"rto\": \"0s\",\n" + route + "}": "config:1: The retransmission timeout",
+		"{\n\"reset\": {\"socket\": \"none\"},\n" + route + "}":       "config:2: Unknown reset socket",
+		"{\n\"routes\": []\n}":                                        "config:2: Expected at least one route.",
+		"{}":                                                          "config: Expected at least one route.",
+		"{\"routes\": [\n{\"listen\": \":1\"}\n]}":                    "config:2: routes[0] needs a listen and an upstream address.",
+		"{\"routes\": [\n{\"listen\": \":1\", \"upstream\": \":2\"},\n{\"listen\": \":1\", \"upstream\": \":3\"}\n]}":     "config:3: \":1\" is already routed on line 2.",
+		"{\"routes\": [\n{\"listen\": \":1\", \"upstream\": \":2\",\n\"rule\": \"latency(1ms)\", \"up\": \"loss(1%)\"}]}": "config:2: routes[0] can have a rule or up and down chains, not both.",
+	} {
+		c, err := readConfig(strings.NewReader(text), "config")
+		testing_utils.UnexpectedError(err, "reading the config", t)
+		s := defaultSettings()
+		err = c.apply(&s)
+		if err == nil {
+			t.Fatalf("Expected an error applying %q", text)
+		}
+		if !strings.HasPrefix(err.Error(), expected) {
+			t.Fatalf("Expected an error starting with %q got %q", expected, err)
+		}
+	}
+}
+
+func TestConfigRuleErrorsHaveLineNumbers(t *testing.T) {
+	for text, expected := range map[string]string{
+		"{\"routes\": [{\"listen\": \":1\", \"upstream\": \":2\",\n\"rule\": \"latency(abc)\"}]}":                      "config:2: routes[0].rule. Unable to parse rule",
+		"{\"routes\": [{\"listen\": \":1\", \"upstream\": \":2\",\n\"up\": \"latency(1ms)\",\n\"down\": \"nope()\"}]}": "config:3: routes[0].down. Unable to parse rule",
+	} {
+		c, err := readConfig(strings.NewReader(text), "config")
+		testing_utils.UnexpectedError(err, "reading the config", t)
+		s := defaultSettings()
+		testing_utils.UnexpectedError(c.apply(&s), "applying the config", t)
+		_, err = c.routes()
+		if err == nil {
+			t.Fatalf("Expected an error constructing the routes of %q", text)
+		}
+		if !strings.HasPrefix(err.Error(), expected) {
+			t.Fatalf("Expected an error starting with %q got %q", expected, err)
+		}
+	}
+}
+
+func TestYAMLConfigAppliesItsSettings(t *testing.T) {
+	text := `# The same settings as the JSON config
+connections: 100
+maxConcurrent: 10
+drainTimeout: 5s
+transport: reno,flow
+rto: 50ms
+window: 1024
+control: localhost:9000
+reset:
+  afterBytes: 65536
+  after: 30s
+  socket: accepted
+  midWrite: true
+routes:
+  - listen: ":8080"
+    upstream: localhost:80
+    rule: latency(5ms)
+  - listen: ":8443"
+    upstream: localhost:443
+    up: latency(20ms)
+    down: latency(300ms) | loss(1%)
+  - {listen: ":5432", upstream: "db:5432"}
+`
+	c, err := readYAMLConfig(strings.NewReader(text), "config.yaml")
+	testing_utils.UnexpectedError(err, "reading the config", t)
+	s := defaultSettings()
+	testing_utils.UnexpectedError(c.apply(&s), "applying the config", t)
+
+	expected := settings{
+		connections:   100,
+		maxConcurrent: 10,
+		drainTimeout:  5 * time.Second,
+		control:       "localhost:9000",
+		fault:         resetFault{65536, 30 * time.Second, "accepted", true},
+		transport:     transport{"reno,flow", 50 * time.Millisecond, 1024},
+	}
+	if s != expected {
+		t.Fatalf("Expected %+v got %+v", expected, s)
+	}
+
+	routes, err := c.routes()
+	testing_utils.UnexpectedError(err, "constructing the routes", t)
+	if len(routes) != 3 || routes[2].listen != ":5432" || routes[2].upstream != "db:5432" {
+		t.Fatalf("Expected the routes of the config got %+v", routes)
+	}
+	network := routes[1].rule.Network()
+	if len(network.Upstream) != 1 || len(network.Downstream) != 2 {
+		t.Fatalf("Expected 1 upstream and 2 downstream pipes got %v and %v",
+			len(network.Upstream), len(network.Downstream))
+	}
+}
+
+func TestYAMLConfigErrorsHaveLineNumbers(t *testing.T) {
+	for text, expected := range map[string]string{
+		"routes:\n  - listen: [\n": "config.yaml:2: Invalid YAML.",
+		"\n":                       "config.yaml: Unexpected end of the config.",
+		"- 1\n":                    "config.yaml:1: The config should be an object.",
+		"\nroute: []\n":            "config.yaml:2: Unknown field \"route\" in the config file, expected one of",
+		"reset:\n  socket: both\n  midwrite: true\n": "config.yaml:3: Unknown field \"midwrite\" in reset, expected one of",
+		"\nconnections: \"10\"\n":                    "config.yaml:2: connections should be a whole number.",
+		"\nconnections: 1.5\n":                       "config.yaml:2: connections should be a whole number.",
+		"reset:\n\n  midWrite: yes\n":                "config.yaml:3: reset.midWrite should be true or false.",
+		"\nroutes: {}\n":                             "config.yaml:2: routes should be a list.",
+		"routes:\n  - listen: \":1\"\n    up: 1\n":   "config.yaml:3: routes[0].up should be a string.",
+		"\nreset:\n":                                 "config.yaml:2: reset should be an object.",
+		"connections: 1\n\nconnections: 2\n":         "config.yaml:3: \"connections\" is already set on line 1.",
+		"connections: 1\n---\nconnections: 2\n":      "config.yaml:3: Unexpected data after the config.",
+		"connections: 1\n---\nconnections: [\n":      "config.yaml:3: Invalid YAML.",
+	} {
+		_, err := readYAMLConfig(strings.NewReader(text), "config.yaml")
+		if err == nil {
+			t.Fatalf("Expected an error reading %q", text)
+		}
+		if !strings.HasPrefix(err.Error(), expected) {
+			t.Fatalf("Expected an error starting with %q got %q", expected, err)
+		}
+	}
+}
+
+func TestYAMLConfigValidationErrorsHaveLineNumbers(t *testing.T) {
+	route := "routes:\n  - {listen: \":1\", upstream: \":2\"}\n"
+	for text, expected := range map[string]string{
+		"\ndrainTimeout: soon\n" + route:                   "config.yaml:2: drainTimeout should be a duration",
+		"\n\ntransport: tcp\n" + route:                     "config.yaml:3: Unknown transport layer \"tcp\"",
+		"reset:\n  socket: none\n" + route:                 "config.yaml:1: Unknown reset socket",
+		"\nroutes: []\n":                                   "config.yaml:2: Expected at least one route.",
+		"routes:\n  - listen: \":1\"\n":                    "config.yaml:2: routes[0] needs a listen and an upstream address.",
+		route + "  - {listen: \":1\", upstream: \":3\"}\n": "config.yaml:3: \":1\" is already routed on line 2.",
+	} {
+		c, err := readYAMLConfig(strings.NewReader(text), "config.yaml")
+		testing_utils.UnexpectedError(err, "reading the config", t)
+		s := defaultSettings()
+		err = c.apply(&s)
+		if err == nil {
+			t.Fatalf("Expected an error applying %q", text)
+		}
+		if !strings.HasPrefix(err.Error(), expected) {
+			t.Fatalf("Expected an error starting with %q got %q", expected, err)
+		}
+	}
+}
@@ -1,7 +1,9 @@
 package connection
 
 import (
+	"errors"
 	"io"
+	"sync"
 
 	"github.com/efarrer/evilproxy/packet"
 	"github.com/efarrer/evilproxy/pipe"
@@ -11,17 +13,54 @@ type basicConnection struct {
 	send  pipe.Sender
 	recv  pipe.Receiver
 	close io.Closer
+
+	// Held while writing, and while closing so a packet is never sent after
+	// the pipe is closed
+	mutex       sync.Mutex
+	writeClosed bool
+	closed      bool
 }
 
 func (c *basicConnection) Write(p *packet.Packet) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.writeClosed {
+		return errors.New("Writing on a closed basic connection.\n")
+	}
 	return c.send.Send(p)
 }
 
+func (c *basicConnection) CloseWrite() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.writeClosed {
+		return errors.New("Closing a closed basic connection for writing.\n")
+	}
+	c.writeClosed = true
+	return c.close.Close()
+}
+
 func (c *basicConnection) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.closed {
+		return errors.New("Closing a closed basic connection.\n")
+	}
+	c.closed = true
+	if c.writeClosed {
+		return nil
+	}
+	c.writeClosed = true
 	return c.close.Close()
 }
 
 func (c *basicConnection) Read() (*packet.Packet, error) {
+	c.mutex.Lock()
+	closed := c.closed
+	c.mutex.Unlock()
+	if closed {
+		return nil, errors.New("Reading from a closed basic connection.\n")
+	}
 	return c.recv.Recv()
 }
 
@@ -31,5 +70,6 @@ func (c *basicConnection) Read() (*packet.Packet, error) {
  * read using the second Pipe's 'Recv' method.
  */
 func NewBasicConnections(p0, p1 pipe.Pipe) (Connection, Connection) {
-	return &basicConnection{p0, p1, p0}, &basicConnection{p1, p0, p1}
+	return &basicConnection{send: p0, recv: p1, close: p0},
+		&basicConnection{send: p1, recv: p0, close: p1}
 }
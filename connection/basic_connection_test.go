@@ -2,6 +2,7 @@ package connection
 
 import (
 	"testing"
+	"time"
 
 	"github.com/efarrer/evilproxy/pipe"
 )
@@ -11,3 +12,12 @@ func TestConnectionBehaviorForBasicConnection(t *testing.T) {
 		return NewBasicConnections(pipe.NewBasicPipe(), pipe.NewBasicPipe())
 	}, t)
 }
+
+func TestClosingABasicConnectionWhileWritingOverALatentPipe(t *testing.T) {
+	for i := 0; i != 20; i++ {
+		testClosingWhileWritingFailsTheWrites(func() (Connection, Connection) {
+			return NewBasicConnections(pipe.NewLatentPipe(pipe.NewBasicPipe(), time.Millisecond),
+				pipe.NewBasicPipe())
+		}, t)
+	}
+}
@@ -0,0 +1,166 @@
+package connection
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	// The congestion window of a new connection in packets
+	initialWindow = 10
+	// The smallest congestion window after a loss in packets
+	minimumWindow = 2
+	// The CUBIC scaling constant
+	cubicC = 0.4
+	// The CUBIC multiplicative decrease factor
+	cubicBeta = 0.7
+)
+
+/*
+ * A 'CongestionControl' is an algorithm that decides how many packets a
+ * connection may have in flight. The window is measured in packets.
+ */
+type CongestionControl interface {
+	/*
+	 * Returns the congestion window
+	 */
+	Window() float64
+
+	/*
+	 * Called when an ack acknowledges new packets
+	 */
+	Acknowledged(packets int, now time.Time)
+
+	/*
+	 * Called when duplicate acks show a packet was lost. The lost packet is
+	 * retransmitted immediately.
+	 */
+	Lost(now time.Time)
+
+	/*
+	 * Called when the retransmission timer expires
+	 */
+	Timeout(now time.Time)
+}
+
+/*
+ * Reno grows the window by one packet per ack during slow start and by one
+ * packet per window of acks during congestion avoidance. A loss halves the
+ * window and a timeout restarts slow start from a single packet.
+ */
+type reno struct {
+	window    float64
+	threshold float64
+}
+
+func (r *reno) Window() float64 {
+	return r.window
+}
+
+func (r *reno) Acknowledged(packets int, now time.Time) {
+	for i := 0; i != packets; i++ {
+		if r.window < r.threshold {
+			r.window++
+		} else {
+			r.window += 1 / r.window
+		}
+	}
+}
+
+func (r *reno) Lost(now time.Time) {
+	r.threshold = math.Max(r.window/2, minimumWindow)
+	r.window = r.threshold
+}
+
+func (r *reno) Timeout(now time.Time) {
+	r.threshold = math.Max(r.window/2, minimumWindow)
+	r.window = 1
+}
+
+/*
+ * Constructs the Reno congestion control algorithm
+ */
+func NewReno() CongestionControl {
+	return &reno{initialWindow, math.Inf(1)}
+}
+
+/*
+ * CUBIC grows the window as a cubic function of the time since the last loss,
+ * quickly returning to the window where the loss happened, probing carefully
+ * around it and then growing quickly again. A loss reduces the window by
+ * 30%. The window never grows slower than Reno's would. See RFC 8312.
+ */
+type cubic struct {
+	window    float64
+	threshold float64
+	// The window when the last loss happened
+	maxWindow float64
+	// When the current congestion avoidance epoch started
+	epoch time.Time
+	// The time in seconds to grow back to maxWindow
+	k float64
+	// The window Reno would have
+	renoWindow float64
+}
+
+func (c *cubic) Window() float64 {
+	return c.window
+}
+
+func (c *cubic) Acknowledged(packets int, now time.Time) {
+	if c.window < c.threshold {
+		c.window += float64(packets)
+		return
+	}
+	if c.epoch.IsZero() {
+		c.epoch = now
+		c.renoWindow = c.window
+		if c.window < c.maxWindow {
+			c.k = math.Cbrt((c.maxWindow - c.window) / cubicC)
+		} else {
+			c.k = 0
+			c.maxWindow = c.window
+		}
+	}
+
+	t := now.Sub(c.epoch).Seconds()
+	target := cubicC*math.Pow(t-c.k, 3) + c.maxWindow
+	c.renoWindow += 3 * (1 - cubicBeta) / (1 + cubicBeta) * float64(packets) / c.window
+	if target < c.renoWindow {
+		target = c.renoWindow
+	}
+	if target > c.window {
+		c.window += (target - c.window) / c.window * float64(packets)
+	}
+}
+
+/*
+ * Records a loss. The caller sets the new window.
+ */
+func (c *cubic) reduce() {
+	// Release bandwidth faster if the window is shrinking
+	if c.window < c.maxWindow {
+		c.maxWindow = c.window * (1 + cubicBeta) / 2
+	} else {
+		c.maxWindow = c.window
+	}
+	c.threshold = math.Max(c.window*cubicBeta, minimumWindow)
+	c.epoch = time.Time{}
+}
+
+func (c *cubic) Lost(now time.Time) {
+	c.reduce()
+	c.window = c.threshold
+}
+
+func (c *cubic) Timeout(now time.Time) {
+	c.reduce()
+	c.window = 1
+}
+
+/*
+ * Constructs the CUBIC congestion control algorithm
+ */
+func NewCubic() CongestionControl {
+	return &cubic{window: initialWindow, threshold: math.Inf(1)}
+}
@@ -0,0 +1,159 @@
+package connection
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/efarrer/evilproxy/packet"
+	"github.com/efarrer/evilproxy/pipe"
+	"github.com/efarrer/evilproxy/testing_utils"
+)
+
+func expectWindow(cc CongestionControl, expected float64, t *testing.T) {
+	if math.Abs(cc.Window()-expected) > 0.01 {
+		t.Fatalf("Expected a window of %v got %v", expected, cc.Window())
+	}
+}
+
+func TestRenoSlowStartsThenAvoidsCongestion(t *testing.T) {
+	now := time.Now()
+	reno := NewReno()
+	expectWindow(reno, initialWindow, t)
+
+	// Slow start doubles the window every round trip
+	reno.Acknowledged(10, now)
+	expectWindow(reno, 20, t)
+
+	reno.Lost(now)
+	expectWindow(reno, 10, t)
+
+	// Congestion avoidance grows the window by a packet every round trip
+	reno.Acknowledged(10, now)
+	if reno.Window() < 10.9 || reno.Window() > 11 {
+		t.Fatalf("Expected a window of about 11 got %v", reno.Window())
+	}
+
+	reno.Timeout(now)
+	expectWindow(reno, 1, t)
+	reno.Acknowledged(6, now)
+	if reno.Window() < 6.1 || reno.Window() > 6.2 {
+		t.Fatalf("Expected slow start up to the threshold got %v", reno.Window())
+	}
+}
+
+func TestCubicGrowsBackToTheWindowOfTheLastLoss(t *testing.T) {
+	now := time.Now()
+	cubic := NewCubic()
+	cubic.Acknowledged(90, now)
+	expectWindow(cubic, 100, t)
+
+	cubic.Lost(now)
+	expectWindow(cubic, 100*cubicBeta, t)
+
+	// Growth is concave up to the old window, reaching it after K seconds
+	k := math.Cbrt(100 * (1 - cubicBeta) / cubicC)
+	cubic.Acknowledged(1, now)
+	at := func(seconds float64) time.Time {
+		return now.Add(time.Duration(seconds * float64(time.Second)))
+	}
+	for i := 0; i != 1000; i++ {
+		cubic.Acknowledged(1, at(k/2))
+	}
+	halfway := cubic.Window()
+	if halfway < 95 || halfway > 100 {
+		t.Fatalf("Expected most of the window to be recovered halfway got %v", halfway)
+	}
+	for i := 0; i != 1000; i++ {
+		cubic.Acknowledged(1, at(k))
+	}
+	if cubic.Window() < 99 || cubic.Window() > 101 {
+		t.Fatalf("Expected a window of about 100 after %v seconds got %v", k, cubic.Window())
+	}
+
+	// Then it's convex, probing for more bandwidth
+	for i := 0; i != 1000; i++ {
+		cubic.Acknowledged(1, at(2*k))
+	}
+	if cubic.Window() < 110 {
+		t.Fatalf("Expected the window to grow past 100 got %v", cubic.Window())
+	}
+
+	cubic.Timeout(now)
+	expectWindow(cubic, 1, t)
+}
+
+func TestConnectionBehaviorForCongestionControlledConnection(t *testing.T) {
+	PerformConnectionTests(func() (Connection, Connection) {
+		c0, c1 := NewBasicConnections(pipe.NewBasicPipe(), pipe.NewBasicPipe())
+		return NewCongestionControlledConnection(c0, time.Second, NewReno()),
+			NewCongestionControlledConnection(c1, time.Second, NewCubic())
+	}, t)
+}
+
+func TestCongestionControlledConnectionRecoversFromLoss(t *testing.T) {
+	for _, newCC := range []func() CongestionControl{NewReno, NewCubic} {
+		c0, c1 := NewBasicConnections(
+			pipe.NewLossyPipe(pipe.NewBasicPipe(), 0.1, 1),
+			pipe.NewLossyPipe(pipe.NewBasicPipe(), 0.1, 2))
+		cc0 := NewCongestionControlledConnection(c0, 5*time.Millisecond, newCC())
+		cc1 := NewCongestionControlledConnection(c1, 5*time.Millisecond, newCC())
+		expectReliableDelivery(cc0, cc1, 200, t)
+		cc0.Close()
+		cc1.Close()
+	}
+}
+
+func TestCongestionControlledConnectionLimitsPacketsInFlight(t *testing.T) {
+	lower0, lower1 := NewBasicConnections(pipe.NewBasicPipe(), pipe.NewBasicPipe())
+	c := NewCongestionControlledConnection(lower0, time.Hour, NewReno())
+	defer c.Close()
+	defer lower1.Close()
+
+	for i := 0; i != initialWindow; i++ {
+		err := c.Write(&packet.Packet{})
+		testing_utils.UnexpectedError(err, "writing", t)
+	}
+	written := writeInBackground(c, &packet.Packet{})
+	expectBlocked(written, 50*time.Millisecond, t)
+
+	err := lower1.Write(&packet.Packet{Reliable: packet.Header{Flags: packet.Ack, Ack: 2}})
+	testing_utils.UnexpectedError(err, "writing", t)
+	testing_utils.UnexpectedError(<-written, "writing", t)
+}
+
+func TestCongestionControlledConnectionFastRetransmits(t *testing.T) {
+	lower0, lower1 := NewBasicConnections(pipe.NewBasicPipe(), pipe.NewBasicPipe())
+	reno := NewReno()
+	c := NewCongestionControlledConnection(lower0, time.Hour, reno)
+	defer c.Close()
+	defer lower1.Close()
+
+	for i := 0; i != 5; i++ {
+		err := c.Write(&packet.Packet{})
+		testing_utils.UnexpectedError(err, "writing", t)
+		_, err = lower1.Read()
+		testing_utils.UnexpectedError(err, "reading", t)
+	}
+
+	// Packet 1 was lost, so packets 2 to 4 are acknowledged with duplicate acks
+	for i := 0; i != 3; i++ {
+		err := lower1.Write(&packet.Packet{Reliable: packet.Header{Flags: packet.Ack, Ack: 1}})
+		testing_utils.UnexpectedError(err, "writing", t)
+	}
+	retransmitted, err := lower1.Read()
+	testing_utils.UnexpectedError(err, "reading", t)
+	if retransmitted.Reliable.Seq != 1 {
+		t.Fatalf("Expected packet 1 to be retransmitted got %v", retransmitted)
+	}
+	expectWindow(reno, initialWindow/2, t)
+
+	// A partial ack retransmits the next lost packet
+	err = lower1.Write(&packet.Packet{Reliable: packet.Header{Flags: packet.Ack, Ack: 3}})
+	testing_utils.UnexpectedError(err, "writing", t)
+	retransmitted, err = lower1.Read()
+	testing_utils.UnexpectedError(err, "reading", t)
+	if retransmitted.Reliable.Seq != 3 {
+		t.Fatalf("Expected packet 3 to be retransmitted got %v", retransmitted)
+	}
+}
@@ -26,10 +26,18 @@ type Connection interface {
 	PacketWriter
 
 	/*
-	 * Closes the connection.
+	 * Closes the connection. Writes fail and reads fail once the packets that
+	 * have already been read are gone. Closing a connection also closes it
+	 * for writing if it hasn't been already.
 	 */
 	io.Closer
 
+	/*
+	 * Closes the connection for writing. The peer's reads fail once it has
+	 * read the packets written before. The connection can still be read.
+	 */
+	CloseWrite() error
+
 	/*
 	 * Reads a 'Packet'.
 	 * Blocks if a 'Packet' is not immediately available.
@@ -15,9 +15,19 @@ import (
  * from their unit tests to ensure their implementation is compliant.
  */
 
+/*
+ * Fails the test unless the packet read carries the payload of the packet
+ * written. Connections may deliver a copy of the packet written.
+ */
+func expectPacket(read, written *packet.Packet, t *testing.T) {
+	if read == nil || string(read.Payload) != string(written.Payload) {
+		t.Fatalf("Didn't get expected packet from connection. Got %v expected %v", read, written)
+	}
+}
+
 func testClosingAfterWritingStillDeliversPacket(
 	connectionGenerator func() (Connection, Connection), t *testing.T) {
-	pkt := packet.Packet{}
+	pkt := packet.Packet{Payload: []byte("packet")}
 	c0, c1 := connectionGenerator()
 	err := c0.Write(&pkt)
 	testing_utils.UnexpectedError(err, "writing", t)
@@ -25,15 +35,13 @@ func testClosingAfterWritingStillDeliversPacket(
 	testing_utils.UnexpectedError(err, "closing", t)
 	read, err := c1.Read()
 	testing_utils.UnexpectedError(err, "reading", t)
-	if &pkt != read {
-		t.Fatalf("Didn't get expected packet from connection. Got %v expected %v", read, pkt)
-	}
+	expectPacket(read, &pkt, t)
 }
 
 func testConnectionDeliversPacketsInOrder(
 	connectionGenerator func() (Connection, Connection), t *testing.T) {
-	pkt0 := &packet.Packet{}
-	pkt1 := &packet.Packet{}
+	pkt0 := &packet.Packet{Payload: []byte("first")}
+	pkt1 := &packet.Packet{Payload: []byte("second")}
 	c0, c1 := connectionGenerator()
 	defer c0.Close()
 	defer c1.Close()
@@ -43,16 +51,10 @@ func testConnectionDeliversPacketsInOrder(
 	testing_utils.UnexpectedError(err, "writing", t)
 	rcvd0, err := c1.Read()
 	testing_utils.UnexpectedError(err, "reading", t)
-	if pkt0 != rcvd0 {
-		t.Fatalf("Didn't get first packet from connection. Got %v expected %v",
-			&rcvd0, &pkt0)
-	}
+	expectPacket(rcvd0, pkt0, t)
 	rcvd1, err := c1.Read()
 	testing_utils.UnexpectedError(err, "reading", t)
-	if pkt1 != rcvd1 {
-		t.Fatalf("Didn't get second packet from connection. Got %v expected %v",
-			&rcvd1, &pkt1)
-	}
+	expectPacket(rcvd1, pkt1, t)
 }
 
 func testWriteingAfterCloseResultsInError(
@@ -70,7 +72,7 @@ func testWriteingAfterCloseResultsInError(
 func testReadHangsIfNoPacket(
 	connectionGenerator func() (Connection, Connection), t *testing.T) {
 	const delay = 100
-	pkt := packet.Packet{}
+	pkt := packet.Packet{Payload: []byte("packet")}
 	c0, c1 := connectionGenerator()
 	go func() {
 		<-time.After(time.Millisecond * delay)
@@ -83,9 +85,7 @@ func testReadHangsIfNoPacket(
 		t.Fatalf("Read didn't block %v milliseconds expected %v milliseconds",
 			timer.ElapsedMilliseconds(), delay)
 	}
-	if read != &pkt {
-		t.Fatalf("Didn't get expected packet from connection. Got %v expected %v", read, pkt)
-	}
+	expectPacket(read, &pkt, t)
 }
 
 func testReadFromClosedPeerConnectionResultsInNilPacketAndError(
@@ -112,6 +112,78 @@ func testClosingAClosedConnectionFails(
 	}
 }
 
+func testHalfClosedConnectionCanStillBeRead(
+	connectionGenerator func() (Connection, Connection), t *testing.T) {
+	pkt := &packet.Packet{Payload: []byte("packet")}
+	c0, c1 := connectionGenerator()
+	defer c0.Close()
+	defer c1.Close()
+	err := c0.CloseWrite()
+	testing_utils.UnexpectedError(err, "closing for writing", t)
+	if err := c0.Write(&packet.Packet{}); err == nil {
+		t.Fatalf("Expecting error for writing over a connection closed for writing\n")
+	}
+	if _, err := c1.Read(); err == nil {
+		t.Fatalf("Didn't get expected error when Read'ing from a peer closed for writing")
+	}
+	err = c1.Write(pkt)
+	testing_utils.UnexpectedError(err, "writing", t)
+	read, err := c0.Read()
+	testing_utils.UnexpectedError(err, "reading", t)
+	expectPacket(read, pkt, t)
+}
+
+func testReadingAfterCloseResultsInError(
+	connectionGenerator func() (Connection, Connection), t *testing.T) {
+	c0, c1 := connectionGenerator()
+	defer c1.Close()
+	err := c0.Close()
+	testing_utils.UnexpectedError(err, "closing", t)
+	if _, err := c0.Read(); err == nil {
+		t.Fatalf("Expecting error for reading from a closed connection\n")
+	}
+}
+
+func testClosingForWritingTwiceFails(
+	connectionGenerator func() (Connection, Connection), t *testing.T) {
+	c0, c1 := connectionGenerator()
+	defer c0.Close()
+	defer c1.Close()
+	err := c0.CloseWrite()
+	testing_utils.UnexpectedError(err, "closing for writing", t)
+	err = c0.CloseWrite()
+	if err == nil {
+		t.Fatalf("Expected error on double close for writing")
+	}
+}
+
+func testClosingWhileWritingFailsTheWrites(
+	connectionGenerator func() (Connection, Connection), t *testing.T) {
+	c0, c1 := connectionGenerator()
+	defer c1.Close()
+	go func() {
+		for {
+			if _, err := c1.Read(); err != nil {
+				return
+			}
+		}
+	}()
+	stopped := make(chan bool)
+	go func() {
+		defer close(stopped)
+		for c0.Write(&packet.Packet{Payload: []byte{1}}) == nil {
+		}
+	}()
+	time.Sleep(10 * time.Millisecond)
+	err := c0.Close()
+	testing_utils.UnexpectedError(err, "closing", t)
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected writes to fail once the connection is closed")
+	}
+}
+
 func PerformConnectionTests(
 	connectionGenerator func() (Connection, Connection), t *testing.T) {
 
@@ -121,6 +193,10 @@ func PerformConnectionTests(
 	testReadHangsIfNoPacket(connectionGenerator, t)
 	testReadFromClosedPeerConnectionResultsInNilPacketAndError(connectionGenerator, t)
 	testClosingAClosedConnectionFails(connectionGenerator, t)
+	testHalfClosedConnectionCanStillBeRead(connectionGenerator, t)
+	testReadingAfterCloseResultsInError(connectionGenerator, t)
+	testClosingForWritingTwiceFails(connectionGenerator, t)
+	testClosingWhileWritingFailsTheWrites(connectionGenerator, t)
 }
 
 type packetReader struct {
@@ -0,0 +1,255 @@
+package connection
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/efarrer/evilproxy/packet"
+)
+
+/*
+ * A flowControlConnection limits the bytes in flight to the receive window
+ * advertised by its peer, so a slow reader slows down the writer.
+ *
+ * Each side buffers the packets it receives until they are read. Whenever a
+ * read frees space in the buffer it sends a window update, a packet whose flow
+ * control header has the Window and Ack flags, an Ack of the number of bytes
+ * received and a WindowSize of the free space in the buffer. The writer may send up to
+ * Ack+WindowSize bytes and blocks once it reaches that limit. A side that
+ * never reads stalls its peer with a zero window.
+ *
+ * A packet that is larger than the peer's whole window is sent once the
+ * peer's buffer is empty so it can't stall forever.
+ *
+ * Window updates are never retransmitted, so the lower connection must
+ * deliver every packet in order, a lost update could stall the peer forever.
+ *
+ * Closing the connection for writing sends a window update that also has the
+ * Fin flag, once the peer has read everything before it its reads fail. Window
+ * updates are still sent while the connection is read, so the peer's writes
+ * stay limited to the window. The lower connection is only closed when the
+ * connection is closed.
+ */
+type flowControlConnection struct {
+	lower  Connection
+	window int64
+
+	mutex   sync.Mutex
+	changed *sync.Cond
+
+	// Writer state
+	sent      int64
+	peerAck   int64
+	peerSpace int64
+	peerMax   int64
+	// Set once the lower connection fails, after which no window update can
+	// be sent or received
+	err error
+
+	// Reader state
+	queue    []*packet.Packet
+	received int64
+	consumed int64
+	readErr  error
+
+	// Held while writing to or closing the lower connection so a packet is
+	// never written after it is closed
+	writeMutex  sync.Mutex
+	writeClosed bool
+	closed      bool
+}
+
+/*
+ * Returns true if a packet of the given size fits in the peer's window. Must
+ * be called with the mutex held.
+ */
+func (fc *flowControlConnection) fits(size int64) bool {
+	if fc.sent+size <= fc.peerAck+fc.peerSpace {
+		return true
+	}
+	return fc.peerAck == fc.sent && fc.peerSpace == fc.peerMax && fc.peerMax > 0
+}
+
+/*
+ * Returns a window update advertising the free space of the receive buffer
+ */
+func (fc *flowControlConnection) windowUpdate() *packet.Packet {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+	free := fc.window - (fc.received - fc.consumed)
+	if free < 0 {
+		free = 0
+	}
+	return &packet.Packet{FlowControl: packet.Header{
+		Flags: packet.Window | packet.Ack, Ack: fc.received, WindowSize: free}}
+}
+
+/*
+ * Advertises the free space of the receive buffer to the peer
+ */
+func (fc *flowControlConnection) advertise() error {
+	update := fc.windowUpdate()
+	fc.writeMutex.Lock()
+	defer fc.writeMutex.Unlock()
+	if fc.closed {
+		return errors.New("Writing on a closed flow control connection.\n")
+	}
+	return fc.lower.Write(update)
+}
+
+/*
+ * Records that the lower connection failed, which fails reads once the
+ * received packets have been read and stops writes waiting for window updates
+ */
+func (fc *flowControlConnection) fail(err error) {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+	if fc.err == nil {
+		fc.err = err
+	}
+	if fc.readErr == nil {
+		fc.readErr = err
+	}
+	fc.changed.Broadcast()
+}
+
+/*
+ * Reads packets from the lower connection until it fails, queueing data
+ * packets and applying window updates
+ */
+func (fc *flowControlConnection) receive() {
+	for {
+		pkt, err := fc.lower.Read()
+		if err != nil {
+			fc.fail(err)
+			return
+		}
+
+		fc.mutex.Lock()
+		switch {
+		case pkt.FlowControl.Flags&packet.Window != 0:
+			update := pkt.FlowControl
+			if update.Flags&packet.Fin != 0 && fc.readErr == nil {
+				fc.readErr = errors.New("Peer closed the flow control connection.\n")
+			}
+			if update.Ack >= fc.peerAck {
+				fc.peerAck = update.Ack
+				fc.peerSpace = update.WindowSize
+				if update.WindowSize > fc.peerMax {
+					fc.peerMax = update.WindowSize
+				}
+			}
+		default:
+			fc.queue = append(fc.queue, pkt)
+			fc.received += int64(len(pkt.Payload))
+		}
+		fc.changed.Broadcast()
+		fc.mutex.Unlock()
+	}
+}
+
+func (fc *flowControlConnection) Write(p *packet.Packet) error {
+	size := int64(len(p.Payload))
+	fc.mutex.Lock()
+	for !fc.writeClosed && fc.err == nil && !fc.fits(size) {
+		fc.changed.Wait()
+	}
+	if fc.writeClosed {
+		fc.mutex.Unlock()
+		return errors.New("Writing on a closed flow control connection.\n")
+	}
+	if !fc.fits(size) {
+		err := fc.err
+		fc.mutex.Unlock()
+		return err
+	}
+	fc.sent += size
+	fc.mutex.Unlock()
+
+	fc.writeMutex.Lock()
+	defer fc.writeMutex.Unlock()
+	if fc.writeClosed {
+		return errors.New("Writing on a closed flow control connection.\n")
+	}
+	return fc.lower.Write(p)
+}
+
+func (fc *flowControlConnection) Read() (*packet.Packet, error) {
+	fc.mutex.Lock()
+	for len(fc.queue) == 0 && fc.readErr == nil && !fc.closed {
+		fc.changed.Wait()
+	}
+	if fc.closed {
+		fc.mutex.Unlock()
+		return nil, errors.New("Reading from a closed flow control connection.\n")
+	}
+	if len(fc.queue) == 0 {
+		fc.mutex.Unlock()
+		return nil, fc.readErr
+	}
+	pkt := fc.queue[0]
+	fc.queue = fc.queue[1:]
+	fc.consumed += int64(len(pkt.Payload))
+	fc.mutex.Unlock()
+
+	if len(pkt.Payload) != 0 {
+		if err := fc.advertise(); err != nil {
+			// The peer can't be told about the free space so it may never send
+			// more
+			fc.fail(errors.New(fmt.Sprintf("Unable to advertise the flow control window. %v", err)))
+		}
+	}
+	return pkt, nil
+}
+
+func (fc *flowControlConnection) CloseWrite() error {
+	update := fc.windowUpdate()
+	update.FlowControl.Flags |= packet.Fin
+
+	fc.writeMutex.Lock()
+	defer fc.writeMutex.Unlock()
+	fc.mutex.Lock()
+	if fc.writeClosed {
+		fc.mutex.Unlock()
+		return errors.New("Closing a closed flow control connection for writing.\n")
+	}
+	fc.writeClosed = true
+	fc.changed.Broadcast()
+	fc.mutex.Unlock()
+	return fc.lower.Write(update)
+}
+
+func (fc *flowControlConnection) Close() error {
+	fc.writeMutex.Lock()
+	defer fc.writeMutex.Unlock()
+	fc.mutex.Lock()
+	if fc.closed {
+		fc.mutex.Unlock()
+		return errors.New("Closing a closed flow control connection.\n")
+	}
+	fc.writeClosed = true
+	fc.closed = true
+	fc.changed.Broadcast()
+	fc.mutex.Unlock()
+	return fc.lower.Close()
+}
+
+/*
+ * Constructs a connection that buffers up to window bytes of received payload
+ * and limits its writes to the window advertised by its peer. Both sides of a
+ * connection must be flow control connections and the lower connection must
+ * be reliable. Writes block until the peer has advertised its window.
+ */
+func NewFlowControlConnection(lower Connection, window int64) Connection {
+	fc := &flowControlConnection{lower: lower, window: window}
+	fc.changed = sync.NewCond(&fc.mutex)
+	go func() {
+		// Advertising may wait for the lower connection to be established
+		if err := fc.advertise(); err != nil {
+			fc.fail(errors.New(fmt.Sprintf("Unable to advertise the flow control window. %v", err)))
+		}
+		fc.receive()
+	}()
+	return fc
+}
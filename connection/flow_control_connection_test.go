@@ -0,0 +1,214 @@
+package connection
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/efarrer/evilproxy/packet"
+	"github.com/efarrer/evilproxy/pipe"
+	"github.com/efarrer/evilproxy/testing_utils"
+)
+
+func newFlowControlConnections(window0, window1 int64) (Connection, Connection) {
+	c0, c1 := NewBasicConnections(pipe.NewBasicPipe(), pipe.NewBasicPipe())
+	return NewFlowControlConnection(c0, window0), NewFlowControlConnection(c1, window1)
+}
+
+/*
+ * Writes the packet in the background and returns a channel that receives the
+ * result of the write
+ */
+func writeInBackground(c Connection, pkt *packet.Packet) chan error {
+	written := make(chan error, 1)
+	go func() { written <- c.Write(pkt) }()
+	return written
+}
+
+/*
+ * Fails the test if the write completes within the timeout
+ */
+func expectBlocked(written chan error, timeout time.Duration, t *testing.T) {
+	select {
+	case err := <-written:
+		t.Fatalf("Expected the write to block got %v", err)
+	case <-time.After(timeout):
+	}
+}
+
+func TestConnectionBehaviorForFlowControlConnection(t *testing.T) {
+	PerformConnectionTests(func() (Connection, Connection) {
+		return newFlowControlConnections(1024, 1024)
+	}, t)
+}
+
+func TestFlowControlConnectionAdvertisesItsWindow(t *testing.T) {
+	lower0, lower1 := NewBasicConnections(pipe.NewBasicPipe(), pipe.NewBasicPipe())
+	c := NewFlowControlConnection(lower0, 100)
+	defer c.Close()
+	defer lower1.Close()
+
+	update, err := lower1.Read()
+	testing_utils.UnexpectedError(err, "reading", t)
+	if update.FlowControl != (packet.Header{Flags: packet.Window | packet.Ack, WindowSize: 100}) {
+		t.Fatalf("Expected an initial window of 100 got %v", update)
+	}
+
+	// The window's right edge is the bytes read plus the buffer size, however
+	// many of the unread packets have arrived
+	consumed := 0
+	for _, size := range []int{30, 50, 20} {
+		err = lower1.Write(&packet.Packet{Payload: make([]byte, size)})
+		testing_utils.UnexpectedError(err, "writing", t)
+	}
+	for i := 0; i != 3; i++ {
+		rcvd, err := c.Read()
+		testing_utils.UnexpectedError(err, "reading", t)
+		consumed += len(rcvd.Payload)
+		update, err = lower1.Read()
+		testing_utils.UnexpectedError(err, "reading", t)
+		window := update.FlowControl
+		if window.Ack+window.WindowSize != int64(consumed+100) || window.Ack < int64(consumed) {
+			t.Fatalf("Expected the window to end at %v got %v", consumed+100, update)
+		}
+	}
+}
+
+func TestFlowControlConnectionBlocksWritesWhenTheWindowIsFull(t *testing.T) {
+	c0, c1 := newFlowControlConnections(10, 10)
+	defer c0.Close()
+	defer c1.Close()
+
+	err := c0.Write(&packet.Packet{Payload: make([]byte, 4)})
+	testing_utils.UnexpectedError(err, "writing", t)
+	err = c0.Write(&packet.Packet{Payload: make([]byte, 6)})
+	testing_utils.UnexpectedError(err, "writing", t)
+	written := writeInBackground(c0, &packet.Packet{Payload: make([]byte, 5)})
+	expectBlocked(written, 50*time.Millisecond, t)
+
+	// Reading 4 bytes isn't enough to fit 5 more
+	_, err = c1.Read()
+	testing_utils.UnexpectedError(err, "reading", t)
+	expectBlocked(written, 50*time.Millisecond, t)
+
+	_, err = c1.Read()
+	testing_utils.UnexpectedError(err, "reading", t)
+	testing_utils.UnexpectedError(<-written, "writing", t)
+}
+
+func TestFlowControlConnectionSendsOversizedPacketsToAnEmptyBuffer(t *testing.T) {
+	c0, c1 := newFlowControlConnections(10, 10)
+	defer c0.Close()
+	defer c1.Close()
+
+	err := c0.Write(&packet.Packet{Payload: make([]byte, 25)})
+	testing_utils.UnexpectedError(err, "writing", t)
+	written := writeInBackground(c0, &packet.Packet{Payload: make([]byte, 25)})
+	expectBlocked(written, 50*time.Millisecond, t)
+
+	rcvd, err := c1.Read()
+	testing_utils.UnexpectedError(err, "reading", t)
+	if len(rcvd.Payload) != 25 {
+		t.Fatalf("Expected a 25 byte packet got %v", len(rcvd.Payload))
+	}
+	testing_utils.UnexpectedError(<-written, "writing", t)
+}
+
+func TestFlowControlConnectionStallsWithAZeroWindow(t *testing.T) {
+	c0, c1 := newFlowControlConnections(10, 0)
+	defer c0.Close()
+	defer c1.Close()
+
+	written := writeInBackground(c0, &packet.Packet{Payload: make([]byte, 1)})
+	expectBlocked(written, 50*time.Millisecond, t)
+
+	// Closing the connection stops the write waiting
+	c0.Close()
+	if err := <-written; err == nil {
+		t.Fatalf("Expected an error writing to a closed connection")
+	}
+}
+
+func TestFlowControlConnectionKeepsLimitingWritesOnceClosedForWriting(t *testing.T) {
+	lower0, lower1 := NewBasicConnections(pipe.NewBasicPipe(), pipe.NewBasicPipe())
+	recorder := &recordingConnection{Connection: lower0}
+	c0 := NewFlowControlConnection(recorder, 10)
+	c1 := NewFlowControlConnection(lower1, 10)
+	defer c1.Close()
+
+	err := c0.CloseWrite()
+	testing_utils.UnexpectedError(err, "closing for writing", t)
+	if _, err = c1.Read(); err == nil {
+		t.Fatalf("Expected an error reading from a connection closed by the peer")
+	}
+	if recorder.isWriteClosed() {
+		t.Fatalf("Expected the lower connection to stay open for window updates")
+	}
+
+	// The peer's writes are still limited to the window
+	err = c1.Write(&packet.Packet{Payload: make([]byte, 10)})
+	testing_utils.UnexpectedError(err, "writing", t)
+	written := writeInBackground(c1, &packet.Packet{Payload: make([]byte, 1)})
+	expectBlocked(written, 50*time.Millisecond, t)
+	_, err = c0.Read()
+	testing_utils.UnexpectedError(err, "reading", t)
+	testing_utils.UnexpectedError(<-written, "writing", t)
+
+	err = c0.Close()
+	testing_utils.UnexpectedError(err, "closing", t)
+	if !recorder.isClosed() {
+		t.Fatalf("Expected the lower connection to be closed")
+	}
+}
+
+/*
+ * A connection whose writes fail
+ */
+type unwritableConnection struct {
+	Connection
+}
+
+func (uc *unwritableConnection) Write(p *packet.Packet) error {
+	return errors.New("Writing on an unwritable connection.")
+}
+
+func TestFlowControlConnectionFailsReadsWhenItCantAdvertiseItsWindow(t *testing.T) {
+	lower0, lower1 := NewBasicConnections(pipe.NewBasicPipe(), pipe.NewBasicPipe())
+	c := NewFlowControlConnection(&unwritableConnection{lower0}, 10)
+	defer c.Close()
+	defer lower1.Close()
+
+	// The peer never learns the window so nothing would ever be read
+	read := make(chan error, 1)
+	go func() {
+		_, err := c.Read()
+		read <- err
+	}()
+	select {
+	case err := <-read:
+		if err == nil {
+			t.Fatalf("Expected an error reading once the window can't be advertised")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the read to fail once the window can't be advertised")
+	}
+}
+
+func TestFlowControlConnectionStopsStallingWhenThePeerGoesAway(t *testing.T) {
+	c0, c1 := newFlowControlConnections(10, 0)
+	defer c0.Close()
+
+	written := writeInBackground(c0, &packet.Packet{Payload: make([]byte, 1)})
+	expectBlocked(written, 50*time.Millisecond, t)
+
+	// The peer goes away without a final window update
+	c1.Close()
+	select {
+	case err := <-written:
+		if err == nil {
+			t.Fatalf("Expected an error writing once the peer has gone away")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the write to stop waiting once the peer has gone away")
+	}
+}
@@ -0,0 +1,271 @@
+package connection
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/efarrer/evilproxy/packet"
+)
+
+/*
+ * A handshakeConnection establishes a connection over a lower connection with
+ * a TCP style three way handshake. The active side sends a Syn, the passive
+ * side replies with a Syn-Ack and the active side completes the handshake with
+ * an Ack. Each side picks an initial sequence number and the peer acknowledges
+ * it plus one.
+ *
+ * Once established payload packets are passed through with the Seq of their
+ * handshake header set to the sequence number of their first byte and its Ack
+ * set to the next sequence number expected from the peer. The handshake
+ * header is separate from the packet's own Flags, Seq and Ack, so other
+ * connections can be stacked on a handshake connection. A copy of the packet
+ * written is passed on so the caller's packet is never changed. Writes block
+ * until the connection is established.
+ *
+ * Closing the connection for writing before it's established closes the
+ * lower connection for writing once the handshake has completed.
+ */
+type handshakeConnection struct {
+	lower Connection
+
+	// Closed once the handshake has completed or failed
+	established chan bool
+	// Closed when the connection is closed for writing
+	done chan bool
+
+	mutex      sync.Mutex
+	err        error
+	sndNext    int64
+	rcvNext    int64
+	readClosed bool
+
+	// Held while writing to or closing the lower connection so a packet is
+	// never written after it is closed
+	writeMutex       sync.Mutex
+	writeClosed      bool
+	lowerWriteClosed bool
+	closed           bool
+}
+
+/*
+ * Records the result of the handshake. Must only be called once.
+ */
+func (hc *handshakeConnection) finish(err error) {
+	hc.mutex.Lock()
+	hc.err = err
+	hc.mutex.Unlock()
+	close(hc.established)
+}
+
+/*
+ * Writes a packet to the lower connection unless the connection is closed
+ */
+func (hc *handshakeConnection) writeLower(p *packet.Packet) error {
+	hc.writeMutex.Lock()
+	defer hc.writeMutex.Unlock()
+	if hc.lowerWriteClosed {
+		return errors.New("Writing on a closed handshake connection.\n")
+	}
+	return hc.lower.Write(p)
+}
+
+/*
+ * Reads a handshake packet with the expected flags that acknowledges ack. A
+ * Syn acknowledges nothing so its ack is zero.
+ */
+func (hc *handshakeConnection) expect(flags packet.Flags, ack int64) (*packet.Packet, error) {
+	pkt, err := hc.lower.Read()
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Handshake failed. %v", err))
+	}
+	if pkt.Handshake.Flags != flags || pkt.Handshake.Ack != ack {
+		return nil, errors.New(fmt.Sprintf(
+			"Handshake failed. Expected flags %v ack %v got flags %v ack %v.",
+			flags, ack, pkt.Handshake.Flags, pkt.Handshake.Ack))
+	}
+	return pkt, nil
+}
+
+/*
+ * Performs the active side of the handshake
+ */
+func (hc *handshakeConnection) connect(isn int64) error {
+	err := hc.writeLower(&packet.Packet{Handshake: packet.Header{Flags: packet.Syn, Seq: isn}})
+	if err != nil {
+		return errors.New(fmt.Sprintf("Handshake failed. %v", err))
+	}
+	synAck, err := hc.expect(packet.Syn|packet.Ack, isn+1)
+	if err != nil {
+		return err
+	}
+	hc.mutex.Lock()
+	hc.sndNext = isn + 1
+	hc.rcvNext = synAck.Handshake.Seq + 1
+	hc.mutex.Unlock()
+	err = hc.writeLower(&packet.Packet{
+		Handshake: packet.Header{Flags: packet.Ack, Seq: isn + 1, Ack: synAck.Handshake.Seq + 1}})
+	if err != nil {
+		return errors.New(fmt.Sprintf("Handshake failed. %v", err))
+	}
+	return nil
+}
+
+/*
+ * Performs the passive side of the handshake
+ */
+func (hc *handshakeConnection) accept(isn int64) error {
+	syn, err := hc.expect(packet.Syn, 0)
+	if err != nil {
+		return err
+	}
+	err = hc.writeLower(&packet.Packet{
+		Handshake: packet.Header{Flags: packet.Syn | packet.Ack, Seq: isn, Ack: syn.Handshake.Seq + 1}})
+	if err != nil {
+		return errors.New(fmt.Sprintf("Handshake failed. %v", err))
+	}
+	if _, err := hc.expect(packet.Ack, isn+1); err != nil {
+		return err
+	}
+	hc.mutex.Lock()
+	hc.sndNext = isn + 1
+	hc.rcvNext = syn.Handshake.Seq + 1
+	hc.mutex.Unlock()
+	return nil
+}
+
+/*
+ * Waits for the handshake to complete. Writers also stop waiting when the
+ * connection is closed for writing.
+ */
+func (hc *handshakeConnection) wait(writing bool) error {
+	if writing {
+		select {
+		case <-hc.established:
+		case <-hc.done:
+			return errors.New("Writing on a closed handshake connection.\n")
+		}
+	} else {
+		<-hc.established
+	}
+	hc.mutex.Lock()
+	defer hc.mutex.Unlock()
+	return hc.err
+}
+
+func (hc *handshakeConnection) Write(p *packet.Packet) error {
+	if err := hc.wait(true); err != nil {
+		return err
+	}
+
+	hc.writeMutex.Lock()
+	defer hc.writeMutex.Unlock()
+	if hc.writeClosed {
+		return errors.New("Writing on a closed handshake connection.\n")
+	}
+	// The caller's packet is left alone
+	p = p.Clone()
+	hc.mutex.Lock()
+	p.Handshake = packet.Header{Flags: packet.Ack, Seq: hc.sndNext, Ack: hc.rcvNext}
+	hc.sndNext += int64(len(p.Payload))
+	hc.mutex.Unlock()
+	return hc.lower.Write(p)
+}
+
+func (hc *handshakeConnection) Read() (*packet.Packet, error) {
+	hc.mutex.Lock()
+	readClosed := hc.readClosed
+	hc.mutex.Unlock()
+	if readClosed {
+		return nil, errors.New("Reading from a closed handshake connection.\n")
+	}
+	if err := hc.wait(false); err != nil {
+		return nil, err
+	}
+	pkt, err := hc.lower.Read()
+	if err != nil {
+		return nil, err
+	}
+
+	hc.mutex.Lock()
+	if next := pkt.Handshake.Seq + int64(len(pkt.Payload)); next > hc.rcvNext {
+		hc.rcvNext = next
+	}
+	hc.mutex.Unlock()
+	return pkt, nil
+}
+
+/*
+ * Closes the lower connection for writing unless it's already closed
+ */
+func (hc *handshakeConnection) closeLowerWrite() error {
+	hc.writeMutex.Lock()
+	defer hc.writeMutex.Unlock()
+	if hc.lowerWriteClosed {
+		return nil
+	}
+	hc.lowerWriteClosed = true
+	return hc.lower.CloseWrite()
+}
+
+func (hc *handshakeConnection) CloseWrite() error {
+	hc.writeMutex.Lock()
+	if hc.writeClosed {
+		hc.writeMutex.Unlock()
+		return errors.New("Closing a closed handshake connection for writing.\n")
+	}
+	hc.writeClosed = true
+	close(hc.done)
+	hc.writeMutex.Unlock()
+
+	select {
+	case <-hc.established:
+		return hc.closeLowerWrite()
+	default:
+		go func() {
+			<-hc.established
+			hc.closeLowerWrite()
+		}()
+		return nil
+	}
+}
+
+func (hc *handshakeConnection) Close() error {
+	hc.writeMutex.Lock()
+	defer hc.writeMutex.Unlock()
+	if hc.closed {
+		return errors.New("Closing a closed handshake connection.\n")
+	}
+	hc.closed = true
+	hc.lowerWriteClosed = true
+	if !hc.writeClosed {
+		hc.writeClosed = true
+		close(hc.done)
+	}
+	hc.mutex.Lock()
+	hc.readClosed = true
+	hc.mutex.Unlock()
+	return hc.lower.Close()
+}
+
+/*
+ * Constructs a connection that performs a three way handshake over the lower
+ * connection using isn as its initial sequence number. One side of the
+ * connection must be active and the other passive. The handshake starts
+ * immediately.
+ */
+func NewHandshakeConnection(lower Connection, active bool, isn int64) Connection {
+	hc := &handshakeConnection{
+		lower:       lower,
+		established: make(chan bool),
+		done:        make(chan bool),
+	}
+	go func() {
+		if active {
+			hc.finish(hc.connect(isn))
+		} else {
+			hc.finish(hc.accept(isn))
+		}
+	}()
+	return hc
+}
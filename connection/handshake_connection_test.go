@@ -0,0 +1,189 @@
+package connection
+
+import (
+	"testing"
+	"time"
+
+	"github.com/efarrer/evilproxy/packet"
+	"github.com/efarrer/evilproxy/pipe"
+	"github.com/efarrer/evilproxy/testing_utils"
+)
+
+func newHandshakeConnections(isn0, isn1 int64) (Connection, Connection) {
+	c0, c1 := NewBasicConnections(pipe.NewBasicPipe(), pipe.NewBasicPipe())
+	return NewHandshakeConnection(c0, true, isn0), NewHandshakeConnection(c1, false, isn1)
+}
+
+func TestConnectionBehaviorForHandshakeConnection(t *testing.T) {
+	PerformConnectionTests(func() (Connection, Connection) {
+		return newHandshakeConnections(100, 500)
+	}, t)
+}
+
+func TestHandshakeConnectionExchangesSynSynAckAck(t *testing.T) {
+	lower0, lower1 := NewBasicConnections(pipe.NewBasicPipe(), pipe.NewBasicPipe())
+	active := NewHandshakeConnection(lower0, true, 100)
+	defer active.Close()
+	defer lower1.Close()
+
+	syn, err := lower1.Read()
+	testing_utils.UnexpectedError(err, "reading syn", t)
+	if syn.Handshake != (packet.Header{Flags: packet.Syn, Seq: 100}) {
+		t.Fatalf("Expected a syn with seq 100 got %v", syn)
+	}
+	err = lower1.Write(&packet.Packet{
+		Handshake: packet.Header{Flags: packet.Syn | packet.Ack, Seq: 500, Ack: 101}})
+	testing_utils.UnexpectedError(err, "writing syn-ack", t)
+	ack, err := lower1.Read()
+	testing_utils.UnexpectedError(err, "reading ack", t)
+	if ack.Handshake != (packet.Header{Flags: packet.Ack, Seq: 101, Ack: 501}) {
+		t.Fatalf("Expected an ack with seq 101 and ack 501 got %v", ack)
+	}
+}
+
+func TestHandshakeConnectionNumbersPayload(t *testing.T) {
+	c0, c1 := newHandshakeConnections(100, 500)
+	defer c0.Close()
+	defer c1.Close()
+
+	for _, expected := range []int64{101, 104, 104} {
+		pkt := &packet.Packet{Payload: make([]byte, 3)}
+		if expected == 104 {
+			pkt.Payload = nil
+		}
+		err := c0.Write(pkt)
+		testing_utils.UnexpectedError(err, "writing", t)
+		rcvd, err := c1.Read()
+		testing_utils.UnexpectedError(err, "reading", t)
+		if rcvd.Handshake != (packet.Header{Flags: packet.Ack, Seq: expected, Ack: 501}) {
+			t.Fatalf("Expected seq %v ack 501 got %v", expected, rcvd)
+		}
+	}
+
+	err := c1.Write(&packet.Packet{Payload: make([]byte, 5)})
+	testing_utils.UnexpectedError(err, "writing", t)
+	rcvd, err := c0.Read()
+	testing_utils.UnexpectedError(err, "reading", t)
+	if rcvd.Handshake.Seq != 501 || rcvd.Handshake.Ack != 104 {
+		t.Fatalf("Expected seq 501 ack 104 got %v", rcvd)
+	}
+}
+
+func TestHandshakeConnectionLeavesThePacketsHeaderAlone(t *testing.T) {
+	c0, c1 := newHandshakeConnections(100, 500)
+	defer c0.Close()
+	defer c1.Close()
+
+	err := c0.Write(&packet.Packet{Flags: packet.Fin, Seq: 7, Ack: 9, Payload: make([]byte, 3)})
+	testing_utils.UnexpectedError(err, "writing", t)
+	rcvd, err := c1.Read()
+	testing_utils.UnexpectedError(err, "reading", t)
+	if rcvd.Flags != packet.Fin || rcvd.Seq != 7 || rcvd.Ack != 9 {
+		t.Fatalf("Expected flags %v seq 7 ack 9 got %v", packet.Fin, rcvd)
+	}
+}
+
+func TestHandshakeConnectionLeavesTheWrittenPacketAlone(t *testing.T) {
+	c0, c1 := newHandshakeConnections(100, 500)
+	defer c0.Close()
+	defer c1.Close()
+
+	pkt := &packet.Packet{Payload: make([]byte, 3)}
+	err := c0.Write(pkt)
+	testing_utils.UnexpectedError(err, "writing", t)
+	rcvd, err := c1.Read()
+	testing_utils.UnexpectedError(err, "reading", t)
+	if rcvd == pkt || pkt.Handshake != (packet.Header{}) {
+		t.Fatalf("Expected the written packet to be copied and left alone got %v", pkt)
+	}
+}
+
+func TestHandshakeConnectionFailsOnAnUnexpectedAck(t *testing.T) {
+	lower0, lower1 := NewBasicConnections(pipe.NewBasicPipe(), pipe.NewBasicPipe())
+	passive := NewHandshakeConnection(lower1, false, -1)
+	defer passive.Close()
+	defer lower0.Close()
+
+	// The passive side's isn plus one is zero, which must still be checked
+	err := lower0.Write(&packet.Packet{Handshake: packet.Header{Flags: packet.Syn, Seq: 100}})
+	testing_utils.UnexpectedError(err, "writing", t)
+	_, err = lower0.Read()
+	testing_utils.UnexpectedError(err, "reading syn-ack", t)
+	err = lower0.Write(&packet.Packet{Handshake: packet.Header{Flags: packet.Ack, Seq: 101, Ack: 5}})
+	testing_utils.UnexpectedError(err, "writing", t)
+	if err := passive.Write(&packet.Packet{}); err == nil {
+		t.Fatalf("Expected an error writing after a failed handshake")
+	}
+}
+
+/*
+ * Returns a pair of flow control connections over handshake connections
+ */
+func newStackedConnections(window int64) (Connection, Connection) {
+	hc0, hc1 := newHandshakeConnections(100, 500)
+	return NewFlowControlConnection(hc0, window), NewFlowControlConnection(hc1, window)
+}
+
+func TestConnectionBehaviorForFlowControlOverHandshakeConnection(t *testing.T) {
+	PerformConnectionTests(func() (Connection, Connection) {
+		return newStackedConnections(1024)
+	}, t)
+}
+
+func TestFlowControlOverHandshakeConnectionLimitsWrites(t *testing.T) {
+	c0, c1 := newStackedConnections(10)
+	defer c0.Close()
+	defer c1.Close()
+
+	err := c0.Write(&packet.Packet{Payload: make([]byte, 10)})
+	testing_utils.UnexpectedError(err, "writing", t)
+	written := writeInBackground(c0, &packet.Packet{Payload: make([]byte, 10)})
+	expectBlocked(written, 50*time.Millisecond, t)
+
+	_, err = c1.Read()
+	testing_utils.UnexpectedError(err, "reading", t)
+	testing_utils.UnexpectedError(<-written, "writing", t)
+}
+
+func TestHandshakeConnectionFailsOnUnexpectedPacket(t *testing.T) {
+	lower0, lower1 := NewBasicConnections(pipe.NewBasicPipe(), pipe.NewBasicPipe())
+	passive := NewHandshakeConnection(lower1, false, 500)
+	defer passive.Close()
+	defer lower0.Close()
+
+	err := lower0.Write(&packet.Packet{Payload: []byte("data before syn")})
+	testing_utils.UnexpectedError(err, "writing", t)
+	if err := passive.Write(&packet.Packet{}); err == nil {
+		t.Fatalf("Expected an error writing after a failed handshake")
+	}
+	if _, err := passive.Read(); err == nil {
+		t.Fatalf("Expected an error reading after a failed handshake")
+	}
+}
+
+func TestHandshakeConnectionDoesNotPassPayloadBeforeEstablishment(t *testing.T) {
+	lower0, lower1 := NewBasicConnections(pipe.NewBasicPipe(), pipe.NewBasicPipe())
+	active := NewHandshakeConnection(lower0, true, 100)
+	defer lower1.Close()
+
+	written := make(chan error, 1)
+	go func() { written <- active.Write(&packet.Packet{Payload: []byte("x")}) }()
+
+	// Nothing but the syn is written until the handshake completes
+	syn, err := lower1.Read()
+	testing_utils.UnexpectedError(err, "reading syn", t)
+	if syn.Handshake.Flags != packet.Syn || len(syn.Payload) != 0 {
+		t.Fatalf("Expected a syn got %v", syn)
+	}
+	select {
+	case err := <-written:
+		t.Fatalf("Expected the write to block until established got %v", err)
+	default:
+	}
+
+	// Closing the connection stops the write waiting
+	active.Close()
+	if err := <-written; err == nil {
+		t.Fatalf("Expected an error writing to a closed connection")
+	}
+}
@@ -0,0 +1,557 @@
+package connection
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/efarrer/evilproxy/packet"
+)
+
+const (
+	// The longest a reliable connection waits before retransmitting
+	maxRetransmitTimeout = time.Minute
+	// The number of times a packet is retransmitted before giving up
+	maxRetransmits = 15
+)
+
+/*
+ * A reliableConnection delivers every packet exactly once and in order over a
+ * lower connection that may lose, duplicate or reorder packets.
+ *
+ * The connection's Flags, Seq and Ack are kept in the packet's reliable
+ * header. Sequence numbers count bytes like TCP's. Each packet written is
+ * given the sequence number of its first byte, starting at one, and a packet
+ * without a payload takes up a sequence number of its own. The receiver
+ * acknowledges packets with an ack, a packet with the Ack flag, no sequence
+ * number, and an Ack of the next sequence number it expects. Packets that
+ * arrive early are held until the packets before them arrive and bytes that
+ * have already been delivered are discarded, so the lower connection may
+ * split packets into fragments as long as each fragment's Seq is advanced by
+ * its offset.
+ *
+ * If the oldest unacknowledged packet isn't acknowledged within the
+ * retransmission timeout it's sent again and the timeout is doubled. The
+ * timeout is reset whenever an ack acknowledges new packets. After
+ * maxRetransmits retransmissions of the same packet the connection gives up
+ * and writes fail.
+ *
+ * With congestion control the packets in flight are limited to the congestion
+ * window and writes block once it's full. Three duplicate acks for the oldest
+ * unacknowledged packet show it was lost, so it's retransmitted immediately
+ * and the connection enters fast recovery. During recovery each further
+ * duplicate ack lets another packet be sent, and an ack that doesn't
+ * acknowledge every packet sent before the loss retransmits the next lost
+ * packet, like NewReno.
+ *
+ * The packets written are copied before they're numbered, so the caller's
+ * packets are never changed, and each time a packet is sent a copy is sent so
+ * the layers that receive it can't change the packet that's held.
+ *
+ * Closing the connection for writing sends a Fin, a sequenced packet with
+ * only the Fin flag, and fails further writes. Once the peer's Fin has been
+ * delivered reads fail. Closing the connection also fails reads, packets that
+ * arrive afterwards are acknowledged and discarded. The lower connection is
+ * closed when both sides have closed for writing, their Fins have been
+ * acknowledged and either the peer's Fin has arrived or the connection has
+ * been closed, or when the peer closes the lower connection.
+ */
+type reliableConnection struct {
+	lower Connection
+	rto   time.Duration
+	cc    CongestionControl
+
+	mutex   sync.Mutex
+	changed *sync.Cond
+
+	// Writer state
+	nextSeq     int64
+	unacked     []*packet.Packet
+	timeout     time.Duration
+	timer       *time.Timer
+	generation  int
+	retransmits int
+	err         error
+	writeClosed bool
+	// The highest ack received
+	acked int64
+
+	// Congestion control state
+	dupAcks    int
+	recovering bool
+	// The last sequence number sent when the loss was detected
+	recover int64
+	// The packets the window is inflated by during recovery
+	inflation int
+
+	// Reader state
+	expected     int64
+	early        map[int64]*packet.Packet
+	queue        []*packet.Packet
+	readErr      error
+	peerFinished bool
+	readClosed   bool
+
+	// Held while writing to or closing the lower connection so a packet is
+	// never written after it is closed
+	writeMutex  sync.Mutex
+	lowerClosed bool
+}
+
+/*
+ * Writes a packet to the lower connection unless it's closed
+ */
+func (rc *reliableConnection) writeLower(p *packet.Packet) error {
+	rc.writeMutex.Lock()
+	defer rc.writeMutex.Unlock()
+	if rc.lowerClosed {
+		return errors.New("Writing on a closed reliable connection.\n")
+	}
+	return rc.lower.Write(p)
+}
+
+/*
+ * Writes a copy of a held packet to the lower connection
+ */
+func (rc *reliableConnection) send(p *packet.Packet) error {
+	return rc.writeLower(p.Clone())
+}
+
+/*
+ * Closes the lower connection unless it's already closed
+ */
+func (rc *reliableConnection) closeLower() error {
+	rc.writeMutex.Lock()
+	defer rc.writeMutex.Unlock()
+	if rc.lowerClosed {
+		return nil
+	}
+	rc.lowerClosed = true
+	return rc.lower.Close()
+}
+
+/*
+ * Returns the number of sequence numbers the packet takes up
+ */
+func seqLength(p *packet.Packet) int64 {
+	if len(p.Payload) == 0 {
+		return 1
+	}
+	return int64(len(p.Payload))
+}
+
+/*
+ * Starts the retransmission timer. Must be called with the mutex held.
+ */
+func (rc *reliableConnection) startTimer() {
+	rc.stopTimer()
+	rc.generation++
+	generation := rc.generation
+	rc.timer = time.AfterFunc(rc.timeout, func() { rc.expire(generation) })
+}
+
+/*
+ * Stops the retransmission timer. Must be called with the mutex held.
+ */
+func (rc *reliableConnection) stopTimer() {
+	if rc.timer != nil {
+		rc.timer.Stop()
+		rc.timer = nil
+	}
+}
+
+/*
+ * Stops retransmitting and fails further writes. Must be called with the
+ * mutex held. Returns true if the lower connection should be closed.
+ */
+func (rc *reliableConnection) fail(err error) bool {
+	rc.err = err
+	rc.unacked = nil
+	rc.stopTimer()
+	rc.changed.Broadcast()
+	return rc.writeClosed
+}
+
+/*
+ * Returns true if another packet can be sent. Must be called with the mutex
+ * held.
+ */
+func (rc *reliableConnection) windowOpen() bool {
+	if rc.cc == nil {
+		return true
+	}
+	window := int(rc.cc.Window())
+	if window < 1 {
+		window = 1
+	}
+	return len(rc.unacked) < window+rc.inflation
+}
+
+/*
+ * Returns true if both sides have closed for writing, all packets have been
+ * acknowledged and nothing more will be read. Must be called with the mutex
+ * held.
+ */
+func (rc *reliableConnection) finished() bool {
+	return rc.writeClosed && len(rc.unacked) == 0 && (rc.peerFinished || rc.readClosed)
+}
+
+/*
+ * Retransmits the oldest unacknowledged packet when the timer fires
+ */
+func (rc *reliableConnection) expire(generation int) {
+	rc.mutex.Lock()
+	if rc.generation != generation || rc.timer == nil || len(rc.unacked) == 0 {
+		rc.mutex.Unlock()
+		return
+	}
+	if rc.retransmits == maxRetransmits {
+		closeLower := rc.fail(errors.New(fmt.Sprintf(
+			"Reliable connection gave up after %v retransmissions.\n", maxRetransmits)))
+		rc.mutex.Unlock()
+		if closeLower {
+			rc.closeLower()
+		}
+		return
+	}
+	if rc.cc != nil {
+		rc.cc.Timeout(time.Now())
+		rc.dupAcks = 0
+		rc.recovering = false
+		rc.inflation = 0
+	}
+	rc.retransmits++
+	rc.timeout *= 2
+	if rc.timeout > maxRetransmitTimeout {
+		rc.timeout = maxRetransmitTimeout
+	}
+	oldest := rc.unacked[0]
+	rc.startTimer()
+	rc.mutex.Unlock()
+
+	rc.send(oldest)
+}
+
+/*
+ * Removes the packets acknowledged by ack. Must be called with the mutex held.
+ * Returns true if the lower connection should be closed, and the packet to
+ * retransmit if any.
+ */
+func (rc *reliableConnection) acknowledge(ack int64) (bool, *packet.Packet) {
+	acked := 0
+	for acked != len(rc.unacked) {
+		oldest := rc.unacked[acked]
+		if oldest.Reliable.Seq+seqLength(oldest) > ack {
+			break
+		}
+		acked++
+	}
+	if acked == 0 {
+		if len(rc.unacked) == 0 || ack < rc.acked {
+			return false, nil
+		}
+		if ack > rc.acked {
+			// Some fragments of the oldest packet arrived
+			rc.acked = ack
+			rc.retransmits = 0
+			rc.timeout = rc.rto
+			rc.startTimer()
+			return false, nil
+		}
+		if rc.cc == nil {
+			return false, nil
+		}
+		return false, rc.duplicateAck()
+	}
+
+	rc.acked = ack
+	rc.unacked = rc.unacked[acked:]
+	rc.retransmits = 0
+	rc.timeout = rc.rto
+	var retransmit *packet.Packet
+	if rc.cc != nil {
+		rc.dupAcks = 0
+		switch {
+		case !rc.recovering:
+			rc.cc.Acknowledged(acked, time.Now())
+		case ack > rc.recover:
+			rc.recovering = false
+			rc.inflation = 0
+		default:
+			// A partial ack means the next packet was lost too
+			rc.inflation -= acked
+			if rc.inflation < 0 {
+				rc.inflation = 0
+			}
+			retransmit = rc.unacked[0]
+		}
+		rc.changed.Broadcast()
+	}
+	if len(rc.unacked) == 0 {
+		rc.stopTimer()
+		return rc.finished(), nil
+	}
+	rc.startTimer()
+	return false, retransmit
+}
+
+/*
+ * Counts a duplicate ack of the oldest unacknowledged packet. Must be called
+ * with the mutex held. Returns the packet to retransmit if any.
+ */
+func (rc *reliableConnection) duplicateAck() *packet.Packet {
+	rc.dupAcks++
+	if rc.recovering {
+		rc.inflation++
+		rc.changed.Broadcast()
+		return nil
+	}
+	if rc.dupAcks != 3 {
+		return nil
+	}
+	rc.cc.Lost(time.Now())
+	rc.recovering = true
+	rc.recover = rc.nextSeq - 1
+	rc.inflation = 3
+	rc.startTimer()
+	return rc.unacked[0]
+}
+
+/*
+ * Queues a data packet for reading if it's the next one expected. Must be
+ * called with the mutex held.
+ */
+func (rc *reliableConnection) deliver(p *packet.Packet) {
+	if p.Reliable.Seq+seqLength(p) <= rc.expected {
+		return
+	}
+	if p.Reliable.Seq > rc.expected {
+		if held, ok := rc.early[p.Reliable.Seq]; !ok || seqLength(held) < seqLength(p) {
+			rc.early[p.Reliable.Seq] = p
+		}
+		return
+	}
+	misaligned := p.Reliable.Seq < rc.expected
+	if misaligned {
+		// The packet was split differently before, so only deliver its bytes
+		// that haven't been delivered yet
+		trimmed := *p
+		trimmed.Payload = p.Payload[rc.expected-p.Reliable.Seq:]
+		trimmed.Reliable.Seq = rc.expected
+		p = &trimmed
+	}
+	// Deliver the packet and any early packets that follow it
+	for ok := true; ok && !rc.peerFinished; p, ok = rc.early[rc.expected] {
+		delete(rc.early, p.Reliable.Seq)
+		rc.expected = p.Reliable.Seq + seqLength(p)
+		if p.Reliable.Flags&packet.Fin != 0 {
+			rc.peerFinished = true
+			rc.readErr = errors.New("Peer closed the reliable connection.\n")
+		} else if !rc.readClosed {
+			rc.queue = append(rc.queue, p)
+		}
+	}
+	if misaligned {
+		rc.discardDelivered()
+	}
+	rc.changed.Broadcast()
+}
+
+/*
+ * Discards the early packets whose bytes have all been delivered. Must be
+ * called with the mutex held.
+ */
+func (rc *reliableConnection) discardDelivered() {
+	for seq, held := range rc.early {
+		if held.Reliable.Seq+seqLength(held) <= rc.expected {
+			delete(rc.early, seq)
+		}
+	}
+}
+
+/*
+ * Reads packets from the lower connection until it fails, delivering data
+ * packets and processing acks
+ */
+func (rc *reliableConnection) receive() {
+	for {
+		pkt, err := rc.lower.Read()
+
+		rc.mutex.Lock()
+		if err != nil {
+			// Nothing more can be received or acknowledged
+			if rc.readErr == nil {
+				rc.readErr = err
+			}
+			rc.fail(errors.New(fmt.Sprintf("Reliable connection's peer is gone. %v", err)))
+			rc.changed.Broadcast()
+			rc.mutex.Unlock()
+			rc.closeLower()
+			return
+		}
+
+		if pkt.Reliable.Flags == packet.Ack && pkt.Reliable.Seq == 0 {
+			closeLower, retransmit := rc.acknowledge(pkt.Reliable.Ack)
+			rc.mutex.Unlock()
+			if retransmit != nil {
+				rc.send(retransmit)
+			}
+			if closeLower {
+				rc.closeLower()
+			}
+			continue
+		}
+
+		rc.deliver(pkt)
+		ack := &packet.Packet{Reliable: packet.Header{Flags: packet.Ack, Ack: rc.expected}}
+		finished := rc.finished()
+		rc.mutex.Unlock()
+		rc.writeLower(ack)
+		if finished {
+			rc.closeLower()
+		}
+	}
+}
+
+/*
+ * Gives a packet the next sequence number and holds it until it's
+ * acknowledged. Must be called with the mutex held.
+ */
+func (rc *reliableConnection) enqueue(p *packet.Packet) error {
+	if rc.err != nil {
+		return rc.err
+	}
+	p.Reliable.Seq = rc.nextSeq
+	rc.nextSeq += seqLength(p)
+	rc.unacked = append(rc.unacked, p)
+	if len(rc.unacked) == 1 {
+		rc.startTimer()
+	}
+	return nil
+}
+
+func (rc *reliableConnection) Write(p *packet.Packet) error {
+	rc.mutex.Lock()
+	for !rc.writeClosed && rc.err == nil && !rc.windowOpen() {
+		rc.changed.Wait()
+	}
+	if rc.writeClosed {
+		rc.mutex.Unlock()
+		return errors.New("Writing on a closed reliable connection.\n")
+	}
+	p = p.Clone()
+	err := rc.enqueue(p)
+	rc.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	return rc.send(p)
+}
+
+func (rc *reliableConnection) Read() (*packet.Packet, error) {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+	for len(rc.queue) == 0 && rc.readErr == nil && !rc.readClosed {
+		rc.changed.Wait()
+	}
+	if rc.readClosed {
+		return nil, errors.New("Reading from a closed reliable connection.\n")
+	}
+	if len(rc.queue) == 0 {
+		return nil, rc.readErr
+	}
+	pkt := rc.queue[0]
+	rc.queue = rc.queue[1:]
+	return pkt, nil
+}
+
+/*
+ * Sends a Fin unless one has already been sent. Must be called with the mutex
+ * held, which is released. Returns true if the connection is broken.
+ */
+func (rc *reliableConnection) sendFin() bool {
+	if rc.writeClosed {
+		rc.mutex.Unlock()
+		return rc.err != nil
+	}
+	rc.writeClosed = true
+	rc.changed.Broadcast()
+	fin := &packet.Packet{Reliable: packet.Header{Flags: packet.Fin}}
+	err := rc.enqueue(fin)
+	rc.mutex.Unlock()
+
+	if err != nil {
+		return true
+	}
+	rc.send(fin)
+	return false
+}
+
+func (rc *reliableConnection) CloseWrite() error {
+	rc.mutex.Lock()
+	if rc.writeClosed {
+		rc.mutex.Unlock()
+		return errors.New("Closing a closed reliable connection for writing.\n")
+	}
+	if rc.sendFin() {
+		// The connection is broken so there's no peer to wait for
+		return rc.closeLower()
+	}
+	return nil
+}
+
+func (rc *reliableConnection) Close() error {
+	rc.mutex.Lock()
+	if rc.readClosed {
+		rc.mutex.Unlock()
+		return errors.New("Closing a closed reliable connection.\n")
+	}
+	rc.readClosed = true
+	rc.queue = nil
+	rc.changed.Broadcast()
+	if rc.sendFin() {
+		// The connection is broken so there's no peer to wait for
+		return rc.closeLower()
+	}
+
+	rc.mutex.Lock()
+	finished := rc.finished()
+	rc.mutex.Unlock()
+	if finished {
+		rc.closeLower()
+	}
+	return nil
+}
+
+/*
+ * Constructs a connection that reliably delivers packets over the lower
+ * connection, retransmitting packets that aren't acknowledged within the
+ * retransmission timeout rto. Both sides of a connection must be reliable
+ * connections.
+ */
+func NewReliableConnection(lower Connection, rto time.Duration) Connection {
+	return NewCongestionControlledConnection(lower, rto, nil)
+}
+
+/*
+ * Constructs a reliable connection that limits the packets in flight with the
+ * congestion control algorithm. If the algorithm is nil the packets in flight
+ * aren't limited.
+ */
+func NewCongestionControlledConnection(lower Connection, rto time.Duration,
+	cc CongestionControl) Connection {
+	rc := &reliableConnection{
+		lower:    lower,
+		rto:      rto,
+		cc:       cc,
+		nextSeq:  1,
+		acked:    1,
+		timeout:  rto,
+		expected: 1,
+		early:    map[int64]*packet.Packet{},
+	}
+	rc.changed = sync.NewCond(&rc.mutex)
+	go rc.receive()
+	return rc
+}
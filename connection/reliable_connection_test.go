@@ -0,0 +1,351 @@
+package connection
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/efarrer/evilproxy/packet"
+	"github.com/efarrer/evilproxy/pipe"
+	"github.com/efarrer/evilproxy/testing_utils"
+)
+
+func newReliableConnections(p0, p1 pipe.Pipe, rto time.Duration) (Connection, Connection) {
+	c0, c1 := NewBasicConnections(p0, p1)
+	return NewReliableConnection(c0, rto), NewReliableConnection(c1, rto)
+}
+
+/*
+ * A connection that records when packets are written to it and if it's closed
+ */
+type recordingConnection struct {
+	Connection
+	mutex       sync.Mutex
+	writes      []time.Time
+	closed      bool
+	writeClosed bool
+}
+
+func (rc *recordingConnection) Close() error {
+	rc.mutex.Lock()
+	rc.closed = true
+	rc.mutex.Unlock()
+	return rc.Connection.Close()
+}
+
+func (rc *recordingConnection) isClosed() bool {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+	return rc.closed
+}
+
+func (rc *recordingConnection) CloseWrite() error {
+	rc.mutex.Lock()
+	rc.writeClosed = true
+	rc.mutex.Unlock()
+	return rc.Connection.CloseWrite()
+}
+
+func (rc *recordingConnection) isWriteClosed() bool {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+	return rc.writeClosed
+}
+
+func (rc *recordingConnection) Write(p *packet.Packet) error {
+	rc.mutex.Lock()
+	rc.writes = append(rc.writes, time.Now())
+	rc.mutex.Unlock()
+	return rc.Connection.Write(p)
+}
+
+func (rc *recordingConnection) written() []time.Time {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+	return append([]time.Time{}, rc.writes...)
+}
+
+/*
+ * Writes count packets to c0 and fails the test unless c1 reads each of them
+ * exactly once and in order
+ */
+func expectReliableDelivery(c0, c1 Connection, count int, t *testing.T) {
+	go func() {
+		for i := 0; i != count; i++ {
+			c0.Write(&packet.Packet{Payload: []byte{byte(i)}})
+		}
+	}()
+	for i := 0; i != count; i++ {
+		rcvd, err := c1.Read()
+		testing_utils.UnexpectedError(err, "reading", t)
+		if rcvd.Payload[0] != byte(i) {
+			t.Fatalf("Expected packet %v got %v", i, rcvd.Payload[0])
+		}
+	}
+}
+
+func TestConnectionBehaviorForReliableConnection(t *testing.T) {
+	PerformConnectionTests(func() (Connection, Connection) {
+		return newReliableConnections(pipe.NewBasicPipe(), pipe.NewBasicPipe(), time.Second)
+	}, t)
+}
+
+func TestReliableConnectionRecoversFromLoss(t *testing.T) {
+	c0, c1 := newReliableConnections(
+		pipe.NewLossyPipe(pipe.NewBasicPipe(), 0.2, 1),
+		pipe.NewLossyPipe(pipe.NewBasicPipe(), 0.2, 2), 5*time.Millisecond)
+	defer c0.Close()
+	defer c1.Close()
+	expectReliableDelivery(c0, c1, 50, t)
+}
+
+func TestReliableConnectionDiscardsDuplicates(t *testing.T) {
+	c0, c1 := newReliableConnections(
+		pipe.NewDuplicatePipe(pipe.NewBasicPipe(), 1, 0, 1),
+		pipe.NewBasicPipe(), time.Second)
+	defer c0.Close()
+	defer c1.Close()
+	expectReliableDelivery(c0, c1, 20, t)
+
+	err := c0.Write(&packet.Packet{Payload: []byte{20}})
+	testing_utils.UnexpectedError(err, "writing", t)
+	rcvd, err := c1.Read()
+	testing_utils.UnexpectedError(err, "reading", t)
+	if rcvd.Payload[0] != 20 {
+		t.Fatalf("Expected packet 20 got %v", rcvd.Payload[0])
+	}
+}
+
+func TestReliableConnectionDeliversReorderedPacketsInOrder(t *testing.T) {
+	c0, c1 := newReliableConnections(
+		pipe.NewSwapReorderPipe(pipe.NewBasicPipe(), 0.5, 1, 10*time.Millisecond),
+		pipe.NewBasicPipe(), time.Second)
+	defer c0.Close()
+	defer c1.Close()
+	expectReliableDelivery(c0, c1, 50, t)
+}
+
+func TestReliableConnectionNumbersAndAcknowledgesPackets(t *testing.T) {
+	lower0, lower1 := NewBasicConnections(pipe.NewBasicPipe(), pipe.NewBasicPipe())
+	c := NewReliableConnection(lower0, time.Second)
+	defer lower1.Close()
+
+	for _, expected := range []int64{1, 2} {
+		err := c.Write(&packet.Packet{})
+		testing_utils.UnexpectedError(err, "writing", t)
+		rcvd, err := lower1.Read()
+		testing_utils.UnexpectedError(err, "reading", t)
+		if rcvd.Reliable.Seq != expected {
+			t.Fatalf("Expected seq %v got %v", expected, rcvd.Reliable.Seq)
+		}
+	}
+
+	err := lower1.Write(&packet.Packet{Reliable: packet.Header{Seq: 1}})
+	testing_utils.UnexpectedError(err, "writing", t)
+	ack, err := lower1.Read()
+	testing_utils.UnexpectedError(err, "reading", t)
+	if ack.Reliable != (packet.Header{Flags: packet.Ack, Ack: 2}) {
+		t.Fatalf("Expected an ack of 2 got %v", ack)
+	}
+
+	err = lower1.Write(&packet.Packet{Reliable: packet.Header{Flags: packet.Ack, Ack: 3}})
+	testing_utils.UnexpectedError(err, "writing", t)
+	err = c.Close()
+	testing_utils.UnexpectedError(err, "closing", t)
+	fin, err := lower1.Read()
+	testing_utils.UnexpectedError(err, "reading", t)
+	if fin.Reliable != (packet.Header{Flags: packet.Fin, Seq: 3}) {
+		t.Fatalf("Expected a fin with seq 3 got %v", fin)
+	}
+}
+
+func TestReliableConnectionNumbersBytes(t *testing.T) {
+	lower0, lower1 := NewBasicConnections(pipe.NewBasicPipe(), pipe.NewBasicPipe())
+	c := NewReliableConnection(lower0, time.Second)
+	defer c.Close()
+	defer lower1.Close()
+
+	for _, expected := range []int64{1, 4} {
+		err := c.Write(&packet.Packet{Payload: []byte("abc")})
+		testing_utils.UnexpectedError(err, "writing", t)
+		rcvd, err := lower1.Read()
+		testing_utils.UnexpectedError(err, "reading", t)
+		if rcvd.Reliable.Seq != expected {
+			t.Fatalf("Expected seq %v got %v", expected, rcvd.Reliable.Seq)
+		}
+	}
+
+	// A fragment followed by a retransmission that was split differently
+	for _, pkt := range []*packet.Packet{
+		{Reliable: packet.Header{Seq: 1}, Payload: []byte("ab")},
+		{Reliable: packet.Header{Seq: 1}, Payload: []byte("abcde")},
+	} {
+		err := lower1.Write(pkt)
+		testing_utils.UnexpectedError(err, "writing", t)
+	}
+	for _, expected := range []string{"ab", "cde"} {
+		rcvd, err := c.Read()
+		testing_utils.UnexpectedError(err, "reading", t)
+		if string(rcvd.Payload) != expected {
+			t.Fatalf("Expected %q got %q", expected, rcvd.Payload)
+		}
+	}
+	for _, expected := range []int64{3, 6} {
+		ack, err := lower1.Read()
+		testing_utils.UnexpectedError(err, "reading", t)
+		if ack.Reliable.Flags != packet.Ack || ack.Reliable.Ack != expected {
+			t.Fatalf("Expected an ack of %v got %v", expected, ack)
+		}
+	}
+}
+
+func TestReliableConnectionBacksOffExponentially(t *testing.T) {
+	const rto = 20 * time.Millisecond
+	lower0, lower1 := NewBasicConnections(pipe.NewBasicPipe(), pipe.NewBasicPipe())
+	recorder := &recordingConnection{Connection: lower0}
+	c := NewReliableConnection(recorder, rto)
+	defer c.Close()
+	defer lower1.Close()
+	go func() {
+		// Never acknowledge anything
+		for {
+			if _, err := lower1.Read(); err != nil {
+				return
+			}
+		}
+	}()
+
+	err := c.Write(&packet.Packet{})
+	testing_utils.UnexpectedError(err, "writing", t)
+
+	writes := recorder.written()
+	for start := time.Now(); len(writes) < 4; writes = recorder.written() {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("Expected the packet to be sent 4 times got %v", len(writes))
+		}
+		time.Sleep(time.Millisecond)
+	}
+	for i := 1; i != len(writes); i++ {
+		gap := writes[i].Sub(writes[i-1])
+		if expected := rto << uint(i-1); gap < expected {
+			t.Fatalf("Expected retransmission %v after at least %v got %v", i, expected, gap)
+		}
+	}
+}
+
+func TestReliableConnectionClosesLowerOnceBothSidesHaveClosed(t *testing.T) {
+	lower0, lower1 := NewBasicConnections(pipe.NewBasicPipe(), pipe.NewBasicPipe())
+	recorder0 := &recordingConnection{Connection: lower0}
+	recorder1 := &recordingConnection{Connection: lower1}
+	c0 := NewReliableConnection(recorder0, time.Second)
+	c1 := NewReliableConnection(recorder1, time.Second)
+
+	err := c0.CloseWrite()
+	testing_utils.UnexpectedError(err, "closing for writing", t)
+	if _, err := c1.Read(); err == nil {
+		t.Fatalf("Expected an error reading from a closed peer")
+	}
+
+	// The closed side can still read from the side that hasn't closed
+	pkt := &packet.Packet{Payload: []byte("reply")}
+	err = c1.Write(pkt)
+	testing_utils.UnexpectedError(err, "writing", t)
+	rcvd, err := c0.Read()
+	testing_utils.UnexpectedError(err, "reading", t)
+	expectPacket(rcvd, pkt, t)
+
+	if recorder0.isClosed() || recorder1.isClosed() {
+		t.Fatalf("Expected the lower connections to stay open until both sides close")
+	}
+
+	err = c1.CloseWrite()
+	testing_utils.UnexpectedError(err, "closing", t)
+	if _, err := c0.Read(); err == nil {
+		t.Fatalf("Expected an error reading from a closed peer")
+	}
+	for start := time.Now(); !recorder0.isClosed() || !recorder1.isClosed(); {
+		if time.Since(start) > time.Second {
+			t.Fatalf("Expected the lower connections to be closed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestReliableConnectionCloseWakesABlockedRead(t *testing.T) {
+	lower0, lower1 := NewBasicConnections(pipe.NewBasicPipe(), pipe.NewBasicPipe())
+	c := NewReliableConnection(lower0, time.Second)
+	defer lower1.Close()
+
+	read := make(chan error, 1)
+	go func() {
+		_, err := c.Read()
+		read <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	testing_utils.UnexpectedError(c.Close(), "closing", t)
+
+	select {
+	case err := <-read:
+		if err == nil {
+			t.Fatalf("Expected an error reading from a closed connection")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected closing to wake the blocked read")
+	}
+}
+
+func TestReliableConnectionDeliversPacketsWithOnlyTheFinFlag(t *testing.T) {
+	c0, c1 := newReliableConnections(pipe.NewBasicPipe(), pipe.NewBasicPipe(), time.Second)
+	defer c0.Close()
+	defer c1.Close()
+
+	// Only the connection's own Fin ends the stream
+	for _, payload := range []string{"fin", "more"} {
+		err := c0.Write(&packet.Packet{Flags: packet.Fin, Payload: []byte(payload)})
+		testing_utils.UnexpectedError(err, "writing", t)
+	}
+	for _, expected := range []string{"fin", "more"} {
+		rcvd, err := c1.Read()
+		testing_utils.UnexpectedError(err, "reading", t)
+		if rcvd.Flags != packet.Fin || string(rcvd.Payload) != expected {
+			t.Fatalf("Expected a packet with the Fin flag and %q got %v", expected, rcvd)
+		}
+	}
+}
+
+func TestReliableConnectionLeavesTheWrittenPacketAlone(t *testing.T) {
+	c0, c1 := newReliableConnections(pipe.NewBasicPipe(), pipe.NewBasicPipe(), time.Second)
+	defer c0.Close()
+	defer c1.Close()
+
+	pkt := &packet.Packet{Seq: 7, Payload: []byte("abc")}
+	err := c0.Write(pkt)
+	testing_utils.UnexpectedError(err, "writing", t)
+	rcvd, err := c1.Read()
+	testing_utils.UnexpectedError(err, "reading", t)
+	if rcvd == pkt || pkt.Seq != 7 {
+		t.Fatalf("Expected the written packet to be left alone got %v", pkt)
+	}
+}
+
+func TestReliableConnectionRetransmitsTheWholePacket(t *testing.T) {
+	lower0, lower1 := NewBasicConnections(pipe.NewBasicPipe(), pipe.NewBasicPipe())
+	c := NewReliableConnection(lower0, 10*time.Millisecond)
+	defer c.Close()
+	defer lower1.Close()
+
+	err := c.Write(&packet.Packet{Payload: []byte("abc")})
+	testing_utils.UnexpectedError(err, "writing", t)
+
+	// Reading part of the packet through an adaptor shortens its payload
+	reader := ConnectionReaderAdaptor(lower1)
+	n, err := reader.Read(make([]byte, 1))
+	if err != nil || n != 1 {
+		t.Fatalf("Expected to read 1 byte got %v %v", n, err)
+	}
+	retransmitted, err := lower1.Read()
+	testing_utils.UnexpectedError(err, "reading", t)
+	if retransmitted.Reliable.Seq != 1 || string(retransmitted.Payload) != "abc" {
+		t.Fatalf("Expected the whole packet to be retransmitted got %v", retransmitted)
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/efarrer/evilproxy/parser"
+)
+
+/*
+ * A controlServer tracks the connections being proxied so their pipes can be
+ * inspected and tuned over HTTP while traffic flows.
+ *
+ *     GET  /connections
+ *         Lists the live connections and the pipes of each direction.
+ *     POST /connections/<id>/<direction>/<index>
+ *         Tunes a pipe. The body is a JSON object of parameters to change, e.g.
+ *         {"latency": "100ms", "loss": "1%", "bandwidth": "1Mbps"}. The id and
+ *         index may be "all" and the direction is "up", "down" or "all". The
+ *         pipes inside profiles and schedules can't be tuned, and are skipped
+ *         when the index is "all".
+ */
+type controlServer struct {
+	mutex       sync.Mutex
+	nextId      int
+	connections map[int]*controlledConnection
+}
+
+type controlledConnection struct {
+	client  string
+	network *parser.Network
+}
+
+func newControlServer() *controlServer {
+	return &controlServer{connections: map[int]*controlledConnection{}}
+}
+
+/*
+ * Starts tracking a connection and returns its id
+ */
+func (cs *controlServer) add(client string, network *parser.Network) int {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	cs.nextId++
+	cs.connections[cs.nextId] = &controlledConnection{client, network}
+	return cs.nextId
+}
+
+/*
+ * Stops tracking a connection
+ */
+func (cs *controlServer) remove(id int) {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	delete(cs.connections, id)
+}
+
+type pipeStatus struct {
+	Index int    `json:"index"`
+	Name  string `json:"name"`
+}
+
+type connectionStatus struct {
+	Id         int          `json:"id"`
+	Client     string       `json:"client"`
+	Upstream   []pipeStatus `json:"upstream"`
+	Downstream []pipeStatus `json:"downstream"`
+}
+
+func stageStatus(stages []parser.Stage) []pipeStatus {
+	status := []pipeStatus{}
+	for i, stage := range stages {
+		status = append(status, pipeStatus{i, stage.Name})
+	}
+	return status
+}
+
+/*
+ * Returns the status of the live connections ordered by id
+ */
+func (cs *controlServer) status() []connectionStatus {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	status := []connectionStatus{}
+	for id, conn := range cs.connections {
+		status = append(status, connectionStatus{id, conn.client,
+			stageStatus(conn.network.Upstream), stageStatus(conn.network.Downstream)})
+	}
+	sort.Slice(status, func(i, j int) bool { return status[i].Id < status[j].Id })
+	return status
+}
+
+/*
+ * Returns the stages selected by the id, direction and index, each of which may
+ * be "all"
+ */
+func (cs *controlServer) selectStages(id, direction, index string) ([]parser.Stage, error) {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	conns := []*controlledConnection{}
+	if id == "all" {
+		for _, conn := range cs.connections {
+			conns = append(conns, conn)
+		}
+	} else {
+		n, err := strconv.Atoi(id)
+		conn, ok := cs.connections[n]
+		if err != nil || !ok {
+			return nil, errors.New(fmt.Sprintf("Unknown connection \"%v\".", id))
+		}
+		conns = append(conns, conn)
+	}
+
+	selected := []parser.Stage{}
+	for _, conn := range conns {
+		stages := []parser.Stage{}
+		switch direction {
+		case "up":
+			stages = conn.network.Upstream
+		case "down":
+			stages = conn.network.Downstream
+		case "all":
+			stages = append(append(stages, conn.network.Upstream...), conn.network.Downstream...)
+		default:
+			return nil, errors.New(fmt.Sprintf("Unknown direction \"%v\".", direction))
+		}
+
+		if index == "all" {
+			selected = append(selected, stages...)
+			continue
+		}
+		n, err := strconv.Atoi(index)
+		if err != nil || n < 0 || n >= len(stages) {
+			return nil, errors.New(fmt.Sprintf("Unknown pipe \"%v\".", index))
+		}
+		selected = append(selected, stages[n])
+	}
+	return selected, nil
+}
+
+/*
+ * Returns the error's message starting with a capital letter so it can follow
+ * another sentence
+ */
+func sentence(err error) string {
+	message := err.Error()
+	return strings.ToUpper(message[:1]) + message[1:]
+}
+
+/*
+ * Applies the parameters to the selected pipes. When tuning many pipes at once
+ * pipes that don't support a parameter are skipped, but at least one pipe must
+ * accept each parameter. Nested stages are skipped when the index is "all",
+ * but selecting one by index is an error rather than leaving its pipes
+ * untouched. Every parameter is checked before any pipe is
+ * changed, so a request that fails changes nothing.
+ */
+func (cs *controlServer) tune(id, direction, index string, parameters map[string]string) error {
+	stages, err := cs.selectStages(id, direction, index)
+	if err != nil {
+		return err
+	}
+	// The pipes inside nested stages can't be tuned. They're skipped when
+	// every pipe is selected, but selecting one by index is an error.
+	tunable := []parser.Stage{}
+	for _, stage := range stages {
+		if !stage.Nested {
+			tunable = append(tunable, stage)
+		} else if index != "all" {
+			return errors.New(fmt.Sprintf("Unable to tune the pipes inside %v.", stage.Name))
+		}
+	}
+	stages = tunable
+
+	// Checked in order so the same request always fails the same way
+	names := []string{}
+	for parameter := range parameters {
+		names = append(names, parameter)
+	}
+	sort.Strings(names)
+
+	tunings := []parser.Tuning{}
+	for _, parameter := range names {
+		tuning, err := parser.ParseTuning(parameter, parameters[parameter])
+		if err != nil {
+			return errors.New(fmt.Sprintf("Unable to tune \"%v\". %v.", parameter, sentence(err)))
+		}
+		tuned := false
+		for _, stage := range stages {
+			tuned = tuned || tuning.Tunes(stage.Pipe)
+		}
+		if !tuned {
+			if len(stages) == 0 {
+				return errors.New(fmt.Sprintf("Unable to tune \"%v\". No pipes selected.", parameter))
+			}
+			return errors.New(fmt.Sprintf("Unable to tune \"%v\". No selected pipe can tune it.", parameter))
+		}
+		tunings = append(tunings, tuning)
+	}
+
+	for _, tuning := range tunings {
+		for _, stage := range stages {
+			if tuning.Tunes(stage.Pipe) {
+				tuning.Apply(stage.Pipe)
+			}
+		}
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, code int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(value)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
+
+func (cs *controlServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if path[0] != "connections" {
+		writeError(w, http.StatusNotFound, errors.New("Unknown resource."))
+		return
+	}
+
+	switch {
+	case len(path) == 1 && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, cs.status())
+
+	case len(path) == 4 && r.Method == http.MethodPost:
+		parameters := map[string]string{}
+		if err := json.NewDecoder(r.Body).Decode(&parameters); err != nil {
+			writeError(w, http.StatusBadRequest, errors.New(fmt.Sprintf("Invalid JSON. %v", err)))
+			return
+		}
+		if err := cs.tune(path[1], path[2], path[3], parameters); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errors.New("Unsupported request."))
+	}
+}
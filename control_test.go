@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/efarrer/evilproxy/parser"
+	"github.com/efarrer/evilproxy/pipe"
+	"github.com/efarrer/evilproxy/testing_utils"
+)
+
+func newControlledNetwork(rule string, t *testing.T) *parser.Network {
+	r, err := parser.Parse(rule)
+	testing_utils.UnexpectedError(err, "parsing", t)
+	return r.Network()
+}
+
+func controlRequest(cs *controlServer, method, path, body string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	cs.ServeHTTP(recorder, httptest.NewRequest(method, path, strings.NewReader(body)))
+	return recorder
+}
+
+func TestControlServerListsConnections(t *testing.T) {
+	cs := newControlServer()
+	network := newControlledNetwork("up: latency(1ms); down: loss(1%) | bandwidth(1Mbps)", t)
+	defer network.Server.Close()
+	defer network.Client.Close()
+	id := cs.add("127.0.0.1:1234", network)
+
+	recorder := controlRequest(cs, http.MethodGet, "/connections", "")
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected status %v got %v\n", http.StatusOK, recorder.Code)
+	}
+	status := []connectionStatus{}
+	err := json.NewDecoder(recorder.Body).Decode(&status)
+	testing_utils.UnexpectedError(err, "decoding", t)
+	if len(status) != 1 || status[0].Id != id || status[0].Client != "127.0.0.1:1234" ||
+		len(status[0].Upstream) != 1 || len(status[0].Downstream) != 2 ||
+		status[0].Downstream[1].Name != "bandwidth" {
+		t.Fatalf("Unexpected status %v\n", status)
+	}
+
+	cs.remove(id)
+	recorder = controlRequest(cs, http.MethodGet, "/connections", "")
+	if strings.TrimSpace(recorder.Body.String()) != "[]" {
+		t.Fatalf("Expected no connections after removal got %v\n", recorder.Body.String())
+	}
+}
+
+func TestControlServerTunesPipes(t *testing.T) {
+	cs := newControlServer()
+	network := newControlledNetwork("latency(1ms) | loss(0)", t)
+	defer network.Server.Close()
+	defer network.Client.Close()
+	cs.add("127.0.0.1:1234", network)
+
+	for path, body := range map[string]string{
+		"/connections/1/up/0":      `{"latency": "100ms"}`,
+		"/connections/all/all/all": `{"latency": "10ms", "loss": "1%"}`,
+	} {
+		recorder := controlRequest(cs, http.MethodPost, path, body)
+		if recorder.Code != http.StatusNoContent {
+			t.Fatalf("Expected status %v for %v got %v %v\n",
+				http.StatusNoContent, path, recorder.Code, recorder.Body.String())
+		}
+	}
+}
+
+func TestControlServerChangesNothingWhenAParameterIsRejected(t *testing.T) {
+	cs := newControlServer()
+	network := newControlledNetwork("partition(none) | loss(0)", t)
+	defer network.Server.Close()
+	defer network.Client.Close()
+	cs.add("127.0.0.1:1234", network)
+
+	for _, body := range []string{
+		`{"partition": "reject", "loss": "bogus"}`,
+		`{"partition": "reject", "latency": "10ms"}`,
+		`{"partition": "reject", "colour": "blue"}`,
+	} {
+		recorder := controlRequest(cs, http.MethodPost, "/connections/all/all/all", body)
+		if recorder.Code != http.StatusBadRequest {
+			t.Fatalf("Expected status %v for %v got %v\n", http.StatusBadRequest, body, recorder.Code)
+		}
+		if mode := network.Upstream[0].Pipe.(pipe.PartitionPipe).Mode(); mode != pipe.PartitionNone {
+			t.Fatalf("Expected the partition to be left at none for %v got %v\n", body, mode)
+		}
+	}
+}
+
+func TestControlServerSkipsNestedStagesUnlessSelectedByIndex(t *testing.T) {
+	cs := newControlServer()
+	network := newControlledNetwork("profile(3g) | loss(0) | schedule(1s: latency(1ms))", t)
+	defer network.Server.Close()
+	defer network.Client.Close()
+	cs.add("127.0.0.1:1234", network)
+
+	for path, code := range map[string]int{
+		"/connections/1/up/0":      http.StatusBadRequest,
+		"/connections/1/down/2":    http.StatusBadRequest,
+		"/connections/all/all/all": http.StatusNoContent,
+		"/connections/1/all/1":     http.StatusNoContent,
+	} {
+		recorder := controlRequest(cs, http.MethodPost, path, `{"loss": "1%"}`)
+		if recorder.Code != code {
+			t.Fatalf("Expected status %v for %v got %v %v\n",
+				code, path, recorder.Code, recorder.Body.String())
+		}
+	}
+
+	// Only nested stages can tune latency
+	recorder := controlRequest(cs, http.MethodPost, "/connections/all/all/all", `{"latency": "1ms"}`)
+	if recorder.Code != http.StatusBadRequest {
+		t.Fatalf("Expected status %v tuning only nested stages got %v\n",
+			http.StatusBadRequest, recorder.Code)
+	}
+}
+
+func TestControlServerRejectsBadRequests(t *testing.T) {
+	cs := newControlServer()
+	network := newControlledNetwork("latency(1ms)", t)
+	defer network.Server.Close()
+	defer network.Client.Close()
+	cs.add("127.0.0.1:1234", network)
+
+	for _, request := range []struct {
+		method, path, body string
+		code               int
+		message            string
+	}{
+		{http.MethodGet, "/bogus", "", http.StatusNotFound, "Unknown resource."},
+		{http.MethodDelete, "/connections", "", http.StatusMethodNotAllowed, "Unsupported request."},
+		{http.MethodPost, "/connections/1/up/0", `{"latency": `, http.StatusBadRequest, "Invalid JSON. unexpected EOF"},
+		{http.MethodPost, "/connections/2/up/0", `{"latency": "1ms"}`, http.StatusBadRequest,
+			"Unknown connection \"2\"."},
+		{http.MethodPost, "/connections/1/sideways/0", `{"latency": "1ms"}`, http.StatusBadRequest,
+			"Unknown direction \"sideways\"."},
+		{http.MethodPost, "/connections/1/up/1", `{"latency": "1ms"}`, http.StatusBadRequest,
+			"Unknown pipe \"1\"."},
+		{http.MethodPost, "/connections/1/up/0", `{"latency": "fast"}`, http.StatusBadRequest,
+			"Unable to tune \"latency\". Invalid duration \"fast\"."},
+		{http.MethodPost, "/connections/1/up/0", `{"loss": "1%"}`, http.StatusBadRequest,
+			"Unable to tune \"loss\". No selected pipe can tune it."},
+	} {
+		recorder := controlRequest(cs, request.method, request.path, request.body)
+		if recorder.Code != request.code {
+			t.Fatalf("Expected status %v for %v %v got %v\n",
+				request.code, request.method, request.path, recorder.Code)
+		}
+		body := map[string]string{}
+		json.NewDecoder(recorder.Body).Decode(&body)
+		if body["error"] != request.message {
+			t.Fatalf("Expected error %q for %v %v got %q\n",
+				request.message, request.method, request.path, body["error"])
+		}
+	}
+}
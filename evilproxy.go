@@ -3,77 +3,197 @@ package main
 import (
 	"bytes"
 	"flag"
-	"io"
+	"io/ioutil"
 	"log"
 	"net"
+	"net/http"
+	"os"
+	"os/signal"
 	"runtime/pprof"
-	"sync"
+	"syscall"
 	"time"
 
-	"github.com/efarrer/evilproxy/connection"
 	"github.com/efarrer/evilproxy/debug"
 	"github.com/efarrer/evilproxy/parser"
 )
 
+/*
+ * Returns the number of goroutines that aren't part of the runtime and a
+ * description of them
+ */
+func outstandingGoRoutines() (int, string) {
+	buffer := &bytes.Buffer{}
+	pprof.Lookup("goroutine").WriteTo(buffer, 2)
+	return debug.OutstandingGoRoutines(buffer.String())
+}
+
 func main() {
 	var client = flag.String("client", ":80", "Client connection address")
 	var server = flag.String("server", ":8080", "Server connection address")
-	var connections = flag.Int("connections", -1, "Number of connections to allow")
-	var debugEnabled = flag.Bool("debug", false, "Enable additional debug functionality")
+	var s settings
+	flag.IntVar(&s.connections, "connections", -1, "Number of connections to allow")
+	flag.DurationVar(&s.drainTimeout, "drain-timeout", 10*time.Second, "How long to wait for connections to finish when shutting down")
+	flag.IntVar(&s.maxConcurrent, "max-concurrent", 0, "Maximum number of connections to serve at once, 0 for no limit")
+	flag.BoolVar(&s.debug, "debug", false, "Enable additional debug functionality")
+	var ruleText = flag.String("rule", "", "Rule describing the network to simulate")
+	var ruleFile = flag.String("rule-file", "", "File containing the rule describing the network to simulate")
+	var routesFile = flag.String("routes", "", "File containing a routing table of addresses to listen on, upstream addresses and rules")
+	var configFile = flag.String("config", "", "JSON or YAML file containing the settings and routes, instead of the other flags")
+	flag.StringVar(&s.profiles, "profiles", "", "File containing additional named network profiles")
+	flag.StringVar(&s.control, "control", "", "Address of the HTTP/JSON control endpoint for tuning live connections")
+	flag.Int64Var(&s.fault.afterBytes, "reset-after-bytes", 0, "Abruptly reset connections after forwarding this many bytes")
+	flag.DurationVar(&s.fault.afterTime, "reset-after", 0, "Abruptly reset connections after this long")
+	flag.StringVar(&s.fault.sockets, "reset-socket", "both", "Socket to reset: accepted, dialed or both")
+	flag.BoolVar(&s.fault.midWrite, "reset-mid-write", false, "Reset part way through forwarding data")
+	flag.StringVar(&s.transport.name, "transport", "none", "Protocol layers to run over the simulated network: none, reliable, reno or cubic, optionally with handshake and flow, separated by commas")
+	flag.DurationVar(&s.transport.rto, "rto", 200*time.Millisecond, "Initial retransmission timeout of the reliable transport")
+	flag.Int64Var(&s.transport.window, "window", 65536, "Receive window in bytes of the flow transport layer")
 	flag.Parse()
 
-	var outstandingConns sync.WaitGroup
+	var cfg *config
+	if *configFile != "" {
+		flag.Visit(func(f *flag.Flag) {
+			if f.Name != "config" {
+				log.Fatalf("-config can't be combined with -%v.\n", f.Name)
+			}
+		})
+		var err error
+		if cfg, err = loadConfig(*configFile); err != nil {
+			log.Fatalf("Invalid config. %v\n", err)
+		}
+		if err := cfg.apply(&s); err != nil {
+			log.Fatalf("Invalid config. %v\n", err)
+		}
+	}
+	fault, tr := s.fault, s.transport
 
-	serv, err := net.Listen("tcp", *server)
-	if err != nil {
-		log.Fatalf("Unable start server on \"%s\". %v\n", *server, err)
+	if s.drainTimeout < 0 {
+		log.Fatalf("The drain timeout can't be negative.\n")
+	}
+	if s.maxConcurrent < 0 {
+		log.Fatalf("The maximum number of concurrent connections can't be negative.\n")
+	}
+	if err := fault.validate(); err != nil {
+		log.Fatalf("Invalid reset fault. %v\n", err)
+	}
+	if err := tr.validate(); err != nil {
+		log.Fatalf("Invalid transport. %v\n", err)
 	}
 
-	for i := 0; i != *connections; i++ {
+	if s.profiles != "" {
+		if err := parser.LoadProfiles(s.profiles); err != nil {
+			log.Fatalf("Unable to load profiles. %v\n", err)
+		}
+	}
 
-		ssock, err := serv.Accept()
+	var routes []route
+	if cfg != nil {
+		var err error
+		if routes, err = cfg.routes(); err != nil {
+			log.Fatalf("Invalid config. %v\n", err)
+		}
+	} else if *routesFile != "" {
+		flag.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "server", "client", "rule", "rule-file":
+				log.Fatalf("-routes can't be combined with -%v.\n", f.Name)
+			}
+		})
+		var err error
+		routes, err = loadRoutes(*routesFile)
 		if err != nil {
-			log.Fatalf("Unable accept client connection. %v\n", err)
+			log.Fatalf("Invalid routing table. %v\n", err)
 		}
-
-		outstandingConns.Add(1)
-		// Complete the connection
-		go func(client string) {
-			defer outstandingConns.Done()
-
-			csock, err := net.DialTimeout("tcp", client, time.Second*3)
-			if err != nil {
-				log.Printf("Unable to connect to \"%s\". %v\n", client, err)
+	} else {
+		if *ruleFile != "" {
+			if *ruleText != "" {
+				log.Fatalf("Only one of -rule and -rule-file can be given.\n")
 			}
-
-			rule := ""
-			cconn, sconn, err := parser.ConstructConnections(rule)
+			text, err := ioutil.ReadFile(*ruleFile)
 			if err != nil {
-				log.Printf("Error (%v) unable to parse rule. \"%v\"\n", rule, err)
+				log.Fatalf("Unable to read rule file \"%s\". %v\n", *ruleFile, err)
 			}
+			*ruleText = string(text)
+		}
+		rule, err := parser.Parse(*ruleText)
+		if err != nil {
+			log.Fatalf("Invalid rule. %v\n", err)
+		}
+		routes = []route{{*server, *client, rule}}
+	}
 
-			go io.Copy(csock, connection.ConnectionReaderAdaptor(cconn))
-			go io.Copy(connection.ConnectionWriterAdaptor(cconn), csock)
+	control := newControlServer()
+	if s.control != "" {
+		listener, err := net.Listen("tcp", s.control)
+		if err != nil {
+			log.Fatalf("Unable start control endpoint on \"%s\". %v\n", s.control, err)
+		}
+		go func() {
+			log.Printf("Control endpoint stopped. %v\n", http.Serve(listener, control))
+		}()
+	}
 
-			go io.Copy(ssock, connection.ConnectionReaderAdaptor(sconn))
-			io.Copy(connection.ConnectionWriterAdaptor(sconn), ssock)
+	listeners := make([]net.Listener, len(routes))
+	for i, rt := range routes {
+		listener, err := net.Listen("tcp", rt.listen)
+		if err != nil {
+			log.Fatalf("Unable start server on \"%s\". %v\n", rt.listen, err)
+		}
+		listeners[i] = listener
+	}
 
-			defer ssock.Close()
-			defer csock.Close()
-			defer cconn.Close()
-			defer sconn.Close()
+	// The connections being proxied
+	inFlight := newConnectionSet()
+	stats := &proxyStats{}
 
-			// TODO Make sure all socket/connections get closed
-		}(*client)
+	// Proxies a connection accepted from a client along the route of the
+	// listener it was accepted on
+	proxy := func(ssock net.Conn, index int) {
+		rt := routes[index]
+		stats.accept()
+		network := rt.rule.Network()
+		id := control.add(ssock.RemoteAddr().String(), network)
+		defer control.remove(id)
 
-		outstandingConns.Wait()
-		if *debugEnabled {
-			time.Sleep(1 * time.Second)
-			buffer := &bytes.Buffer{}
-			pprof.Lookup("goroutine").WriteTo(buffer, 2)
-			if cnt, value := debug.OutstandingGoRoutines(buffer.String()); cnt != 1 {
-				log.Printf("%v\n\nOutstanding goroutines %v", value, cnt)
-			}
+		pc, err := dialProxiedConnection(ssock, rt.upstream, time.Second*3,
+			tr.wrap(network.Client, true), tr.wrap(network.Server, false))
+		if err != nil {
+			log.Printf("%v\n", err)
+			stats.finish(0, 0)
+			return
 		}
+
+		inFlight.add(pc)
+		defer inFlight.remove(pc)
+
+		if fault.enabled() {
+			resetter := fault.start(pc.accepted, pc.dialed, pc.fail)
+			defer resetter.stop()
+			pc.wrapWriters(resetter.writer)
+		}
+		stats.finish(pc.run())
 	}
+
+	ps := newProxyServer(listeners, proxy, s.connections, s.maxConcurrent, s.drainTimeout)
+	if s.debug {
+		ps.leaked = func(count int, description string) {
+			log.Printf("%v\n\nOutstanding goroutines %v", description, count)
+		}
+	}
+
+	// Stop accepting and shut down the connections on the first signal and
+	// exit immediately on the second
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.Printf("Received %v, shutting down.\n", sig)
+		ps.shutdown()
+		inFlight.shutdown()
+		<-signals
+		log.Fatalf("Received a second signal, exiting immediately.\n")
+	}()
+
+	ps.serve()
+	log.Printf("%v\n", stats)
 }
@@ -2,4 +2,7 @@ module github.com/efarrer/evilproxy
 
 go 1.12
 
-require github.com/efarrer/gofutures v0.0.0-20140117232330-2f835b537bab
+require (
+	github.com/efarrer/gofutures v0.0.0-20140117232330-2f835b537bab
+	gopkg.in/yaml.v3 v3.0.1
+)
@@ -7,12 +7,140 @@ const (
 	Syn  Flags = 1
 	Ack  Flags = 2
 	Fin  Flags = 4
+	// Marks a packet that only advertises the sender's receive window
+	Window Flags = 8
 )
 
+/*
+ * The header of a connection layer. Each layer keeps its header apart from
+ * those of the other layers, and from the packet's own Flags, Seq, Ack and
+ * WindowSize, so any layers can be stacked. A header's Seq is the sequence
+ * number of the first byte of the payload, or zero if the layer doesn't number
+ * its packets.
+ */
+type Header struct {
+	Flags      Flags
+	Seq        int64
+	Ack        int64
+	WindowSize int64
+}
+
 type Packet struct {
 	Flags      Flags
 	Seq        int64
 	Ack        int64
 	WindowSize int64
 	Payload    []byte
+	// The headers of the connection layers
+	Handshake   Header
+	FlowControl Header
+	Reliable    Header
+}
+
+/*
+ * Returns a deep copy of the packet
+ */
+func (p *Packet) Clone() *Packet {
+	clone := *p
+	if p.Payload != nil {
+		clone.Payload = make([]byte, len(p.Payload))
+		copy(clone.Payload, p.Payload)
+	}
+	return &clone
+}
+
+/*
+ * Returns the packet's own header followed by the headers of the connection
+ * layers. Changes to the returned header of the packet itself aren't kept.
+ */
+func (p *Packet) headers() []Header {
+	return []Header{{p.Flags, p.Seq, p.Ack, p.WindowSize}, p.Handshake, p.FlowControl, p.Reliable}
+}
+
+/*
+ * Sets the packet's own header and the headers of the connection layers, in
+ * the order returned by headers
+ */
+func (p *Packet) setHeaders(headers []Header) {
+	own := headers[0]
+	p.Flags, p.Seq, p.Ack, p.WindowSize = own.Flags, own.Seq, own.Ack, own.WindowSize
+	p.Handshake, p.FlowControl, p.Reliable = headers[1], headers[2], headers[3]
+}
+
+/*
+ * Returns a copy of the part of the packet whose payload runs from offset to
+ * end. The Seq of each numbered header is advanced by offset. A Syn flag is
+ * only kept if the part starts the payload and a Fin flag only if it ends it.
+ */
+func (p *Packet) Fragment(offset, end int) *Packet {
+	frag := *p
+	frag.Payload = make([]byte, end-offset)
+	copy(frag.Payload, p.Payload[offset:end])
+	headers := p.headers()
+	for i := range headers {
+		if headers[i].Seq != 0 {
+			headers[i].Seq += int64(offset)
+		}
+		if offset != 0 {
+			headers[i].Flags &^= Syn
+		}
+		if end != len(p.Payload) {
+			headers[i].Flags &^= Fin
+		}
+	}
+	frag.setHeaders(headers)
+	return &frag
+}
+
+/*
+ * Returns true if the packet's payload can be joined with others. Packets
+ * without a payload, such as acks and window updates, and packets with a Syn
+ * or Fin flag in any header are never joined.
+ */
+func (p *Packet) Joinable() bool {
+	if len(p.Payload) == 0 {
+		return false
+	}
+	for _, header := range p.headers() {
+		if header.Flags&(Syn|Fin) != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+ * Returns true if next can be joined onto the end of the packet. Both must be
+ * joinable and have the same flags in each header, and the Seq of each of
+ * next's headers must follow the packet's payload unless neither is numbered.
+ */
+func (p *Packet) Continues(next *Packet) bool {
+	if !p.Joinable() || !next.Joinable() {
+		return false
+	}
+	nextHeaders := next.headers()
+	for i, header := range p.headers() {
+		if header.Flags != nextHeaders[i].Flags {
+			return false
+		}
+		if (header.Seq != 0 || nextHeaders[i].Seq != 0) &&
+			nextHeaders[i].Seq != header.Seq+int64(len(p.Payload)) {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+ * Appends next's payload, which must continue the packet. The packet keeps its
+ * headers except for their Acks and WindowSizes which are taken from next.
+ */
+func (p *Packet) Join(next *Packet) {
+	p.Payload = append(p.Payload, next.Payload...)
+	headers := p.headers()
+	for i, header := range next.headers() {
+		headers[i].Ack = header.Ack
+		headers[i].WindowSize = header.WindowSize
+	}
+	p.setHeaders(headers)
 }
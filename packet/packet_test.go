@@ -0,0 +1,30 @@
+package packet
+
+import (
+	"testing"
+)
+
+func TestCloneCopiesPayload(t *testing.T) {
+	pkt := &Packet{Syn, 1, 2, 3, []byte{1, 2, 3}, Header{Ack, 4, 5, 0}, Header{Window, 0, 6, 7},
+		Header{Fin, 8, 9, 0}}
+	clone := pkt.Clone()
+	if clone == pkt {
+		t.Fatalf("Expected clone to be a new packet\n")
+	}
+	if clone.Flags != pkt.Flags || clone.Seq != pkt.Seq || clone.Ack != pkt.Ack ||
+		clone.WindowSize != pkt.WindowSize || string(clone.Payload) != string(pkt.Payload) ||
+		clone.Handshake != pkt.Handshake || clone.FlowControl != pkt.FlowControl ||
+		clone.Reliable != pkt.Reliable {
+		t.Fatalf("Expected clone %v to equal %v\n", clone, pkt)
+	}
+	pkt.Payload[0] = 9
+	if clone.Payload[0] != 1 {
+		t.Fatalf("Expected clone's payload to be unaffected by changes to the original\n")
+	}
+}
+
+func TestCloneKeepsNilPayload(t *testing.T) {
+	if clone := (&Packet{}).Clone(); clone.Payload != nil {
+		t.Fatalf("Expected clone of packet without payload to have no payload\n")
+	}
+}
@@ -0,0 +1,205 @@
+package parser
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+/*
+ * An argument passed to a pipe. Positional arguments have an empty name.
+ */
+type argument struct {
+	name  token
+	value token
+}
+
+/*
+ * The arguments passed to a single pipe in a rule. The typed accessors record
+ * the first error they encounter, which is then reported by 'finish' along
+ * with any arguments that weren't consumed.
+ */
+type arguments struct {
+	rule  string
+	stage token
+	list  []argument
+	used  []bool
+	err   error
+}
+
+func newArguments(rule string, stage token, list []argument) *arguments {
+	return &arguments{rule, stage, list, make([]bool, len(list)), nil}
+}
+
+func (a *arguments) fail(pos int, msg string) {
+	if a.err == nil {
+		a.err = newParseError(a.rule, pos, msg)
+	}
+}
+
+/*
+ * Finds the argument that is either at the given position or has the given
+ * name. Pass a negative index for arguments that can only be named. Marks the
+ * argument as used.
+ */
+func (a *arguments) lookup(index int, name string, required bool) (token, bool) {
+	found := -1
+	positional := 0
+	for i, arg := range a.list {
+		matches := false
+		if arg.name.text == "" {
+			matches = positional == index
+			positional++
+		} else {
+			matches = arg.name.text == name
+		}
+		if !matches {
+			continue
+		}
+		if found != -1 {
+			a.fail(arg.value.pos, fmt.Sprintf("argument \"%v\" given more than once", name))
+			return token{}, false
+		}
+		found = i
+	}
+
+	if found == -1 {
+		if required {
+			a.fail(a.stage.pos, fmt.Sprintf("%v requires argument \"%v\"", a.stage.text, name))
+		}
+		return token{}, false
+	}
+	a.used[found] = true
+	return a.list[found].value, true
+}
+
+/*
+ * Returns the position of the name of the argument with the given name, if it
+ * was given
+ */
+func (a *arguments) named(name string) (int, bool) {
+	for _, arg := range a.list {
+		if arg.name.text == name {
+			return arg.name.pos, true
+		}
+	}
+	return 0, false
+}
+
+/*
+ * Converts an argument with the given converter, reporting conversion errors
+ * against the argument's value.
+ */
+func (a *arguments) convert(index int, name string, required bool,
+	converter func(string) error) {
+	value, ok := a.lookup(index, name, required)
+	if !ok {
+		return
+	}
+	if err := converter(value.text); err != nil {
+		a.fail(value.pos, err.Error())
+	}
+}
+
+func (a *arguments) duration(index int, name string, value *time.Duration, required bool) {
+	a.convert(index, name, required, func(text string) (err error) {
+		*value, err = parseDuration(text)
+		return
+	})
+}
+
+func (a *arguments) rate(index int, name string, value *int64, required bool) {
+	a.convert(index, name, required, func(text string) (err error) {
+		*value, err = parseRate(text)
+		return
+	})
+}
+
+func (a *arguments) size(index int, name string, value *int64, required bool) {
+	a.convert(index, name, required, func(text string) (err error) {
+		*value, err = parseSize(text)
+		return
+	})
+}
+
+func (a *arguments) probability(index int, name string, value *float64, required bool) {
+	a.convert(index, name, required, func(text string) (err error) {
+		*value, err = parseProbability(text)
+		return
+	})
+}
+
+func (a *arguments) integer(index int, name string, value *int64, required bool) {
+	a.convert(index, name, required, func(text string) (err error) {
+		*value, err = parseInteger(text)
+		return
+	})
+}
+
+func (a *arguments) positive(index int, name string, value *float64, required bool) {
+	a.convert(index, name, required, func(text string) (err error) {
+		*value, err = parsePositive(text)
+		return
+	})
+}
+
+func (a *arguments) boolean(index int, name string, value *bool, required bool) {
+	a.convert(index, name, required, func(text string) (err error) {
+		*value, err = parseBool(text)
+		return
+	})
+}
+
+/*
+ * Parses an argument that must be one of the given choices
+ */
+func (a *arguments) choice(index int, name string, value *string, required bool,
+	choices ...string) {
+	a.convert(index, name, required, func(text string) error {
+		for _, choice := range choices {
+			if text == choice {
+				*value = text
+				return nil
+			}
+		}
+		return errors.New(fmt.Sprintf("invalid %v \"%v\", expected one of %v",
+			name, text, strings.Join(choices, ", ")))
+	})
+}
+
+/*
+ * Parses an optional "seed" argument. Returns a function that returns the seed
+ * if one was given, and otherwise a seed based on the current time.
+ */
+func (a *arguments) seed() func() int64 {
+	var seed int64
+	if _, ok := a.lookup(-1, "seed", false); !ok {
+		return func() int64 { return time.Now().UnixNano() }
+	}
+	a.integer(-1, "seed", &seed, true)
+	return func() int64 { return seed }
+}
+
+/*
+ * Returns the first error encountered, or an error for the first argument that
+ * the pipe doesn't understand.
+ */
+func (a *arguments) finish() error {
+	if a.err != nil {
+		return a.err
+	}
+	for i, used := range a.used {
+		if used {
+			continue
+		}
+		arg := a.list[i]
+		if arg.name.text != "" {
+			return newParseError(a.rule, arg.name.pos,
+				fmt.Sprintf("%v has no argument named \"%v\"", a.stage.text, arg.name.text))
+		}
+		return newParseError(a.rule, arg.value.pos,
+			fmt.Sprintf("too many arguments for %v", a.stage.text))
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package parser
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+/*
+ * A ParseError describes a problem with a rule. Pos is the zero based byte
+ * offset of the offending token within Rule.
+ */
+type ParseError struct {
+	Rule string
+	Pos  int
+	Msg  string
+}
+
+func newParseError(rule string, pos int, msg string) *ParseError {
+	return &ParseError{rule, pos, msg}
+}
+
+/*
+ * Returns the part of the rule before the offending token. A Pos outside the
+ * rule is taken to be its start or end.
+ */
+func (e *ParseError) before() string {
+	switch {
+	case e.Pos < 0:
+		return ""
+	case e.Pos > len(e.Rule):
+		return e.Rule
+	}
+	return e.Rule[:e.Pos]
+}
+
+/*
+ * Returns the one based line of the offending token
+ */
+func (e *ParseError) Line() int {
+	return strings.Count(e.before(), "\n") + 1
+}
+
+/*
+ * Returns the one based column of the offending token within its line
+ */
+func (e *ParseError) Column() int {
+	before := e.before()
+	lineStart := strings.LastIndex(before, "\n") + 1
+	return utf8.RuneCountInString(before[lineStart:]) + 1
+}
+
+/*
+ * Formats the error with the offending line of the rule and a marker pointing
+ * at the offending token
+ */
+func (e *ParseError) Error() string {
+	lines := strings.Split(e.Rule, "\n")
+	location := fmt.Sprintf("column %v", e.Column())
+	if len(lines) > 1 {
+		location = fmt.Sprintf("line %v, %v", e.Line(), location)
+	}
+	return fmt.Sprintf("Unable to parse rule at %v: %v.\n\t%v\n\t%v^",
+		location, e.Msg, lines[e.Line()-1], strings.Repeat(" ", e.Column()-1))
+}
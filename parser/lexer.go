@@ -0,0 +1,98 @@
+package parser
+
+import (
+	"fmt"
+	"unicode"
+	"unicode/utf8"
+)
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenWord
+	tokenLParen
+	tokenRParen
+	tokenComma
+	tokenBar
+	tokenEquals
+	tokenColon
+	tokenSemicolon
+)
+
+/*
+ * A token is a lexical element of a rule. Pos is the zero based byte offset of
+ * the token within the rule.
+ */
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func (t token) String() string {
+	if t.kind == tokenEOF {
+		return "end of rule"
+	}
+	return fmt.Sprintf("\"%v\"", t.text)
+}
+
+var punctuation = map[rune]tokenKind{
+	'(': tokenLParen,
+	')': tokenRParen,
+	',': tokenComma,
+	'|': tokenBar,
+	'=': tokenEquals,
+	':': tokenColon,
+	';': tokenSemicolon,
+}
+
+/*
+ * Returns true if the rune can be part of a word. Words hold pipe names,
+ * argument names and values such as "50ms", "1.5Mbps" or "1%".
+ */
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) ||
+		r == '.' || r == '%' || r == '_' || r == '-'
+}
+
+/*
+ * Splits a rule into tokens. Anything following a '#' on a line is a comment.
+ * The returned slice always ends with a tokenEOF. Bytes that aren't valid
+ * UTF-8 are one byte wide, so they don't shift the offsets of later tokens.
+ */
+func lex(rule string) ([]token, error) {
+	tokens := []token{}
+
+	for i := 0; i < len(rule); {
+		r, size := utf8.DecodeRuneInString(rule[i:])
+		switch {
+		case unicode.IsSpace(r):
+			i += size
+		case r == '#':
+			for i < len(rule) && rule[i] != '\n' {
+				i++
+			}
+		case isWordRune(r):
+			start := i
+			for i < len(rule) {
+				r, size := utf8.DecodeRuneInString(rule[i:])
+				if !isWordRune(r) {
+					break
+				}
+				i += size
+			}
+			tokens = append(tokens, token{tokenWord, rule[start:i], start})
+		default:
+			kind, ok := punctuation[r]
+			if !ok {
+				return nil, newParseError(rule, i,
+					fmt.Sprintf("unexpected character \"%c\"", r))
+			}
+			tokens = append(tokens, token{kind, string(r), i})
+			i += size
+		}
+	}
+
+	return append(tokens, token{tokenEOF, "", len(rule)}), nil
+}
@@ -1,20 +1,346 @@
 package parser
 
 import (
-	"errors"
 	"fmt"
 
 	"github.com/efarrer/evilproxy/connection"
 	"github.com/efarrer/evilproxy/pipe"
 )
 
+/*
+ * A stage is a single configured pipe within a chain. Most pipes are the same
+ * in both directions, but a stage such as a profile can expand differently for
+ * each direction. Nested stages expand into chains of their own.
+ */
+type stage struct {
+	name   string
+	up     pipeFactory
+	down   pipeFactory
+	nested bool
+}
+
+/*
+ * A chain is a sequence of pipes that packets travel through from left to
+ * right before being delivered
+ */
+type chain []stage
+
+/*
+ * Wraps the base pipe with the pipes of the chain for the given direction and
+ * returns the first pipe of the chain
+ */
+func (c chain) wrap(base pipe.Pipe, upstream bool) pipe.Pipe {
+	base, _ = c.record(base, upstream)
+	return base
+}
+
+/*
+ * Wraps the base pipe with the pipes of the chain for the given direction.
+ * Returns the first pipe of the chain along with the pipe of each stage.
+ */
+func (c chain) record(base pipe.Pipe, upstream bool) (pipe.Pipe, []Stage) {
+	stages := make([]Stage, len(c))
+	for i := len(c) - 1; i >= 0; i-- {
+		if upstream {
+			base = c[i].up(base)
+		} else {
+			base = c[i].down(base)
+		}
+		stages[i] = Stage{c[i].name, base, c[i].nested}
+	}
+	return base, stages
+}
+
+/*
+ * A Stage is a live pipe constructed for one of a rule's stages
+ */
+type Stage struct {
+	Name string
+	Pipe pipe.Pipe
+
+	/*
+	 * True for stages such as profiles and schedules whose pipes are built
+	 * from chains of their own, so they can't be tuned through Pipe
+	 */
+	Nested bool
+}
+
+/*
+ * A Network is the pair of connections constructed from a rule along with the
+ * pipes of each direction, so they can be tuned while the connections are in
+ * use.
+ */
+type Network struct {
+	/*
+	 * The server's end. Packets written to it travel downstream.
+	 */
+	Server connection.Connection
+
+	/*
+	 * The client's end. Packets written to it travel upstream.
+	 */
+	Client connection.Connection
+
+	/*
+	 * The pipes of each direction in the order packets travel through them
+	 */
+	Upstream   []Stage
+	Downstream []Stage
+}
+
+/*
+ * A Rule is a parsed and validated description of the network to simulate.
+ *
+ * A rule is a chain of pipes separated by '|', e.g.
+ *
+ *     latency(50ms) | latency(latency=10ms)
+ *
+ * Packets travel through the pipes from left to right. Arguments are either
+ * positional or named. The empty rule simulates a perfect network.
+ *
+ * A plain chain is applied to both directions. Separate chains for the
+ * upstream (client to server) and downstream (server to client) directions
+ * are given as sections separated by ';'. A direction without a section
+ * simulates a perfect network.
+ *
+ *     up: latency(20ms); down: latency(300ms)
+ */
+type Rule struct {
+	up   chain
+	down chain
+}
+
+/*
+ * Parses and validates the rule
+ */
+func Parse(rule string) (*Rule, error) {
+	tokens, err := lex(rule)
+	if err != nil {
+		return nil, err
+	}
+	p := &ruleParser{rule, tokens, 0}
+
+	if !p.atSection() {
+		c, err := p.parseChain()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(tokenEOF, "'|'"); err != nil {
+			return nil, err
+		}
+		return &Rule{c, c}, nil
+	}
+
+	r := &Rule{chain{}, chain{}}
+	seen := map[string]bool{}
+	for p.peek().kind != tokenEOF {
+		direction := p.peek()
+		if !p.atSection() {
+			return nil, p.errorAt(direction,
+				fmt.Sprintf("expected \"up:\" or \"down:\" but found %v", direction))
+		}
+		if direction.text != "up" && direction.text != "down" {
+			return nil, p.errorAt(direction,
+				fmt.Sprintf("unknown direction \"%v\", expected \"up\" or \"down\"", direction.text))
+		}
+		if seen[direction.text] {
+			return nil, p.errorAt(direction,
+				fmt.Sprintf("direction \"%v\" given more than once", direction.text))
+		}
+		seen[direction.text] = true
+		p.advance()
+		p.advance()
+
+		c, err := p.parseChain()
+		if err != nil {
+			return nil, err
+		}
+		if direction.text == "up" {
+			r.up = c
+		} else {
+			r.down = c
+		}
+
+		if p.peek().kind == tokenEOF {
+			break
+		}
+		if err := p.expect(tokenSemicolon, "'|' or ';'"); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+/*
+ * Constructs a pair of connections that simulate the rule's network. Each
+ * direction gets its own instance of its chain's pipes.
+ *
+ * The first connection is the server's end. Packets written to it travel
+ * downstream and are read from the second connection. The second connection is
+ * the client's end. Packets written to it travel upstream and are read from the
+ * first connection.
+ */
+func (r *Rule) Connections() (connection.Connection, connection.Connection) {
+	n := r.Network()
+	return n.Server, n.Client
+}
+
+/*
+ * Constructs a network that simulates the rule. See Connections.
+ */
+func (r *Rule) Network() *Network {
+	down, downStages := r.down.record(pipe.NewBasicPipe(), false)
+	up, upStages := r.up.record(pipe.NewBasicPipe(), true)
+	server, client := connection.NewBasicConnections(down, up)
+	return &Network{server, client, upStages, downStages}
+}
+
+/*
+ * Parses the rule and constructs a pair of connections that simulate it
+ */
 func ConstructConnections(rule string) (connection.Connection, connection.Connection, error) {
-	if rule == "" {
-		c0, c1 := connection.NewBasicConnections(
-			pipe.NewBasicPipe(),
-			pipe.NewBasicPipe())
-		return c0, c1, nil
+	r, err := Parse(rule)
+	if err != nil {
+		return nil, nil, err
 	}
+	c0, c1 := r.Connections()
+	return c0, c1, nil
+}
 
-	return nil, nil, errors.New(fmt.Sprintf("Unable to parse \"%v\"", rule))
+type ruleParser struct {
+	rule   string
+	tokens []token
+	next   int
+}
+
+func (p *ruleParser) peek() token {
+	return p.tokens[p.next]
+}
+
+func (p *ruleParser) advance() token {
+	t := p.tokens[p.next]
+	if t.kind != tokenEOF {
+		p.next++
+	}
+	return t
+}
+
+/*
+ * Returns true if the next tokens start a section such as "up:"
+ */
+func (p *ruleParser) atSection() bool {
+	return p.peek().kind == tokenWord && p.tokens[p.next+1].kind == tokenColon
+}
+
+func (p *ruleParser) errorAt(t token, msg string) error {
+	return newParseError(p.rule, t.pos, msg)
+}
+
+/*
+ * Consumes a token of the given kind or returns an error describing what was
+ * expected instead
+ */
+func (p *ruleParser) expect(kind tokenKind, expected string) error {
+	t := p.peek()
+	if t.kind != kind {
+		return p.errorAt(t, fmt.Sprintf("expected %v but found %v", expected, t))
+	}
+	p.advance()
+	return nil
+}
+
+/*
+ * chain := [ stage { '|' stage } ]
+ */
+func (p *ruleParser) parseChain() (chain, error) {
+	c := chain{}
+	switch p.peek().kind {
+	case tokenEOF, tokenSemicolon, tokenComma, tokenRParen:
+		return c, nil
+	}
+	for {
+		s, err := p.parseStage()
+		if err != nil {
+			return nil, err
+		}
+		c = append(c, s)
+		if p.peek().kind != tokenBar {
+			return c, nil
+		}
+		p.advance()
+	}
+}
+
+/*
+ * stage := name [ '(' [ argument { ',' argument } ] ')' ]
+ */
+func (p *ruleParser) parseStage() (stage, error) {
+	name := p.peek()
+	if name.kind != tokenWord {
+		return stage{}, p.errorAt(name, fmt.Sprintf("expected a pipe name but found %v", name))
+	}
+	p.advance()
+	if name.text == "schedule" {
+		return p.parseSchedule(name)
+	}
+	compiler, ok := pipeCompilers[name.text]
+	directionalCompiler, directional := directionalCompilers[name.text]
+	if !ok && !directional {
+		return stage{}, p.errorAt(name, fmt.Sprintf("unknown pipe \"%v\"", name.text))
+	}
+
+	args := []argument{}
+	if p.peek().kind == tokenLParen {
+		p.advance()
+		for p.peek().kind != tokenRParen {
+			if len(args) != 0 {
+				if err := p.expect(tokenComma, "',' or ')'"); err != nil {
+					return stage{}, err
+				}
+			}
+			arg, err := p.parseArgument()
+			if err != nil {
+				return stage{}, err
+			}
+			args = append(args, arg)
+		}
+		p.advance()
+	}
+
+	if directional {
+		up, down, err := directionalCompiler(newArguments(p.rule, name, args))
+		if err != nil {
+			return stage{}, err
+		}
+		return stage{name.text, up, down, true}, nil
+	}
+	factory, err := compiler(newArguments(p.rule, name, args))
+	if err != nil {
+		return stage{}, err
+	}
+	return stage{name.text, factory, factory, false}, nil
+}
+
+/*
+ * argument := [ name '=' ] value
+ */
+func (p *ruleParser) parseArgument() (argument, error) {
+	value := p.peek()
+	if value.kind != tokenWord {
+		return argument{}, p.errorAt(value, fmt.Sprintf("expected an argument but found %v", value))
+	}
+	p.advance()
+	if p.peek().kind != tokenEquals {
+		return argument{token{}, value}, nil
+	}
+	p.advance()
+
+	name := value
+	value = p.peek()
+	if value.kind != tokenWord {
+		return argument{}, p.errorAt(value,
+			fmt.Sprintf("expected a value for \"%v\" but found %v", name.text, value))
+	}
+	p.advance()
+	return argument{name, value}, nil
 }
@@ -1,7 +1,13 @@
 package parser
 
 import (
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/efarrer/evilproxy/connection"
+	"github.com/efarrer/evilproxy/packet"
+	"github.com/efarrer/evilproxy/testing_utils"
 )
 
 func TestParsingBogusRuleReturnsError(t *testing.T) {
@@ -19,3 +25,237 @@ func TestParsingEmptyStringSucceedes(t *testing.T) {
 		t.Fatalf("Expecting basicConnections of basicPipes got an error %v\n", err)
 	}
 }
+
+/*
+ * Asserts that parsing the rule fails with an error at the given column
+ */
+func expectParseErrorAt(rule string, column int, t *testing.T) {
+	_, err := Parse(rule)
+	if err == nil {
+		t.Fatalf("Expecting error parsing \"%v\"\n", rule)
+	}
+	perr, ok := err.(*ParseError)
+	if !ok {
+		t.Fatalf("Expecting a *ParseError parsing \"%v\" got %T\n", rule, err)
+	}
+	if perr.Column() != column {
+		t.Fatalf("Expecting error at column %v got %v for \"%v\"\n%v\n",
+			column, perr.Column(), rule, err)
+	}
+}
+
+func TestParsingLatencyChainSucceeds(t *testing.T) {
+	for _, rule := range []string{
+		"latency(50ms)",
+		"latency(latency=50ms)",
+		" latency( 1s ) | latency(0) ",
+		"bandwidth(1Mbps)",
+		"latency(50ms) # A comment\n| bandwidth(1Mbps) # Another comment",
+		"latency(50ms) | bandwidth(256kbps, burst=16KB)",
+		"loss(1%) | loss(0.5, seed=-7)",
+		"latency(50ms, jitter=10ms)",
+		"reorder(5) | reorder(every=10, distance=3, maxhold=1s)",
+		"swap(10%) | swap(1%, maxhold=20ms, seed=4)",
+		"duplicate(1%) | duplicate(5%, delay=10ms, seed=2)",
+		"corrupt(0.001%) | corrupt(1%, unit=byte, start=20, end=1KB, seed=5)",
+		"mtu(1500) | mtu(536, coalesce=200ms)",
+		"partition() | partition(stall) | partition(mode=blackhole)",
+		"schedule(30s: latency(10ms), 5s: loss(100%), 1m: bandwidth(64kbps) | loss(1%))",
+		"latency(1ms) | schedule(repeat=false, 1s: , 1s: profile(3g)) | loss(1%)",
+		"up: schedule(1s: latency(1ms)); down: schedule(2s: latency(2ms), 1s: latency(3ms))",
+		"latency(50ms, jitter=10ms, distribution=pareto, shape=1.5, reorder=true, seed=1)",
+		"burstloss(1%, 25%) | burstloss(p=1%, r=25%, good=0.1%, bad=50%, seed=3)",
+	} {
+		_, err := Parse(rule)
+		testing_utils.UnexpectedError(err, "parsing "+rule, t)
+	}
+}
+
+func TestParseErrorsPointAtOffendingToken(t *testing.T) {
+	expectParseErrorAt("bogus", 1, t)
+	expectParseErrorAt("latency(50ms) | bogus(1)", 17, t)
+	expectParseErrorAt("latency(50xs)", 9, t)
+	expectParseErrorAt("latency()", 1, t)
+	expectParseErrorAt("latency(50ms, 10ms)", 15, t)
+	expectParseErrorAt("latency(bogus=10ms, latency=1ms)", 9, t)
+	expectParseErrorAt("latency(50ms", 13, t)
+	expectParseErrorAt("latency(50ms) latency(50ms)", 15, t)
+	expectParseErrorAt("latency(50ms) |", 16, t)
+	expectParseErrorAt("latency(50ms) & latency(1ms)", 15, t)
+	expectParseErrorAt("latency(=1ms)", 9, t)
+	expectParseErrorAt("bandwidth(1Mbit)", 11, t)
+	expectParseErrorAt("bandwidth(1Mbps, burst=1XB)", 24, t)
+	expectParseErrorAt("loss(1%, seed=x)", 15, t)
+	expectParseErrorAt("loss(1%, seed=1, seed=2)", 23, t)
+	expectParseErrorAt("burstloss(1%)", 1, t)
+	expectParseErrorAt("latency(5ms, jitter=1ms, distribution=poisson)", 39, t)
+	expectParseErrorAt("latency(5ms, reorder=maybe)", 22, t)
+	expectParseErrorAt("latency(5ms, shape=0)", 20, t)
+	expectParseErrorAt("latency(5ms, distribution=pareto, shape=NaN)", 41, t)
+	expectParseErrorAt("latency(5ms, distribution=pareto, shape=+Inf)", 41, t)
+	expectParseErrorAt("latency(5ms, jitter=1ms, shape=1.5)", 26, t)
+	expectParseErrorAt("latency(5ms, jitter=1ms, distribution=normal, shape=1.5)", 47, t)
+	expectParseErrorAt("latency(1ms) | reorder(0)", 16, t)
+	expectParseErrorAt("reorder(1, distance=x)", 21, t)
+	expectParseErrorAt("duplicate(1%, 1%)", 15, t)
+	expectParseErrorAt("corrupt(1%, unit=word)", 18, t)
+	expectParseErrorAt("corrupt(1%, start=20, end=10)", 1, t)
+	expectParseErrorAt("mtu(0)", 1, t)
+	expectParseErrorAt("mtu(1.5)", 5, t)
+	expectParseErrorAt("mtu(100, 1ms) | reorder(2.5)", 25, t)
+	expectParseErrorAt("reorder(2, distance=1.5)", 21, t)
+	expectParseErrorAt("corrupt(1%, start=0.5)", 19, t)
+	expectParseErrorAt("corrupt(1%, end=10.5)", 17, t)
+	expectParseErrorAt("bandwidth(1Mbps, burst=1.5)", 24, t)
+	expectParseErrorAt("partition(down)", 11, t)
+	expectParseErrorAt("schedule()", 10, t)
+	expectParseErrorAt("schedule(repeat=true)", 1, t)
+	expectParseErrorAt("schedule(0s: latency(1ms))", 10, t)
+	expectParseErrorAt("schedule(1s latency(1ms))", 13, t)
+	expectParseErrorAt("schedule(1s: latency(1ms) 2s: loss(1%))", 27, t)
+	expectParseErrorAt("schedule(1s: bogus)", 14, t)
+	expectParseErrorAt("schedule(1s: latency(1ms), repeat=maybe)", 35, t)
+	expectParseErrorAt("schedule(1s: latency(1ms)", 26, t)
+}
+
+func TestConstructedConnectionsDeliverPackets(t *testing.T) {
+	cconn, sconn, err := ConstructConnections("latency(1ms) | latency(1ms)")
+	testing_utils.UnexpectedError(err, "constructing", t)
+	defer cconn.Close()
+	defer sconn.Close()
+
+	pkt := &packet.Packet{}
+	err = cconn.Write(pkt)
+	testing_utils.UnexpectedError(err, "writing", t)
+	read, err := sconn.Read()
+	testing_utils.UnexpectedError(err, "reading", t)
+	if read != pkt {
+		t.Fatalf("Didn't get expected packet. Got %v expected %v\n", read, pkt)
+	}
+}
+
+func TestParsingDirectionalSectionsSucceeds(t *testing.T) {
+	for _, rule := range []string{
+		"up: latency(20ms); down: latency(1ms)",
+		"down: latency(1ms)",
+		"up: latency(20ms);",
+		"up: ; down: latency(1ms) | latency(2ms)",
+	} {
+		_, err := Parse(rule)
+		testing_utils.UnexpectedError(err, "parsing "+rule, t)
+	}
+}
+
+func TestDirectionalParseErrorsPointAtOffendingToken(t *testing.T) {
+	expectParseErrorAt("up: latency(1ms); up: latency(2ms)", 19, t)
+	expectParseErrorAt("up: latency(1ms); latency(2ms)", 19, t)
+	expectParseErrorAt("up: latency(1ms) down: latency(2ms)", 18, t)
+	expectParseErrorAt("latency(1ms); down: latency(2ms)", 13, t)
+	expectParseErrorAt("sideways: latency(1ms)", 1, t)
+}
+
+/*
+ * Returns how long it took for a packet written to the writer to be read from
+ * the reader
+ */
+func timeDelivery(writer, reader connection.Connection, t *testing.T) time.Duration {
+	start := time.Now()
+	err := writer.Write(&packet.Packet{})
+	testing_utils.UnexpectedError(err, "writing", t)
+	_, err = reader.Read()
+	testing_utils.UnexpectedError(err, "reading", t)
+	return time.Since(start)
+}
+
+func TestDirectionalRulesAreAsymmetric(t *testing.T) {
+	const delay = 100 * time.Millisecond
+	cconn, sconn, err := ConstructConnections("up: latency(100ms)")
+	testing_utils.UnexpectedError(err, "constructing", t)
+	defer cconn.Close()
+	defer sconn.Close()
+
+	if up := timeDelivery(sconn, cconn, t); up < delay {
+		t.Fatalf("Expected upstream latency of at least %v got %v\n", delay, up)
+	}
+	if down := timeDelivery(cconn, sconn, t); down >= delay {
+		t.Fatalf("Expected no downstream latency got %v\n", down)
+	}
+}
+
+func TestParseErrorsInMultiLineRulesReportLine(t *testing.T) {
+	_, err := Parse("up: latency(20ms);\ndown: latency(1ms) |\n  bogus")
+	perr, ok := err.(*ParseError)
+	if !ok {
+		t.Fatalf("Expecting a *ParseError got %v\n", err)
+	}
+	if perr.Line() != 3 || perr.Column() != 3 {
+		t.Fatalf("Expecting error at line 3, column 3 got line %v, column %v\n",
+			perr.Line(), perr.Column())
+	}
+}
+
+func TestScheduledRulesChangeOverTime(t *testing.T) {
+	const delay = 100 * time.Millisecond
+	cconn, sconn, err := ConstructConnections("schedule(50ms: , 1h: latency(100ms))")
+	testing_utils.UnexpectedError(err, "constructing", t)
+	defer cconn.Close()
+	defer sconn.Close()
+
+	if up := timeDelivery(sconn, cconn, t); up >= delay {
+		t.Fatalf("Expected no latency in the first phase got %v\n", up)
+	}
+	time.Sleep(delay)
+	if up := timeDelivery(sconn, cconn, t); up < delay {
+		t.Fatalf("Expected latency of at least %v in the second phase got %v\n", delay, up)
+	}
+}
+
+func TestCommentsInRuleFilesAreIgnored(t *testing.T) {
+	for text, pipes := range map[string]int{
+		"# Nothing but a comment": 0,
+		"# The office network\n\n# ( | ; are fine here\nlatency(50ms)\n":                   1,
+		"latency(50ms) |# No space before the comment\r\nloss(1%) # No newline at the end": 2,
+		"up: latency(5ms); # down: bogus(\ndown: loss(1%)":                                 1,
+	} {
+		rule, err := Parse(text)
+		testing_utils.UnexpectedError(err, "parsing a rule with comments", t)
+		if n := len(rule.Network().Upstream); n != pipes {
+			t.Fatalf("Expecting %v pipes got %v for %q\n", pipes, n, text)
+		}
+	}
+}
+
+func TestParseErrorsAfterCommentsReportLine(t *testing.T) {
+	_, err := Parse("# A comment with (, | and ;\nlatency(5ms) # Another\n  bogus")
+	perr, ok := err.(*ParseError)
+	if !ok {
+		t.Fatalf("Expecting a *ParseError got %v\n", err)
+	}
+	if perr.Line() != 3 || perr.Column() != 3 {
+		t.Fatalf("Expecting error at line 3, column 3 got line %v, column %v\n",
+			perr.Line(), perr.Column())
+	}
+}
+
+func TestParseErrorsAfterInvalidUTF8ReportTheirPosition(t *testing.T) {
+	expectParseErrorAt("\xe9", 1, t)
+	expectParseErrorAt("latency(5ms) | \xe9", 16, t)
+
+	_, err := Parse("#\xff\xff\n@")
+	perr, ok := err.(*ParseError)
+	if !ok {
+		t.Fatalf("Expecting a *ParseError got %v\n", err)
+	}
+	if perr.Line() != 2 || perr.Column() != 1 || !strings.Contains(perr.Error(), "line 2, column 1") {
+		t.Fatalf("Expecting error at line 2, column 1 got %v\n", perr)
+	}
+}
+
+func TestParseErrorsOutsideTheRuleDontPanic(t *testing.T) {
+	for _, pos := range []int{-1, 100} {
+		perr := newParseError("latency(\n5ms)", pos, "test")
+		if !strings.Contains(perr.Error(), "test") {
+			t.Fatalf("Expecting the message in %v\n", perr)
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package parser
+
+import (
+	"time"
+
+	"github.com/efarrer/evilproxy/pipe"
+)
+
+/*
+ * A pipeFactory wraps a base pipe with a configured pipe
+ */
+type pipeFactory func(base pipe.Pipe) pipe.Pipe
+
+/*
+ * A pipeCompiler validates the arguments of a pipe and returns a factory for
+ * creating it
+ */
+type pipeCompiler func(args *arguments) (pipeFactory, error)
+
+/*
+ * A directionalCompiler validates the arguments of a stage and returns
+ * factories for creating its upstream and downstream pipes
+ */
+type directionalCompiler func(args *arguments) (pipeFactory, pipeFactory, error)
+
+/*
+ * The pipes that can be used in a rule
+ */
+var pipeCompilers map[string]pipeCompiler
+
+/*
+ * The stages that can be used in a rule that differ by direction
+ */
+var directionalCompilers map[string]directionalCompiler
+
+func init() {
+	pipeCompilers = map[string]pipeCompiler{
+		"latency":   compileLatency,
+		"bandwidth": compileBandwidth,
+		"loss":      compileLoss,
+		"burstloss": compileBurstLoss,
+		"reorder":   compileReorder,
+		"swap":      compileSwap,
+		"duplicate": compileDuplicate,
+		"corrupt":   compileCorrupt,
+		"mtu":       compileMTU,
+		"partition": compilePartition,
+	}
+	directionalCompilers = map[string]directionalCompiler{
+		"profile": compileProfile,
+	}
+}
+
+/*
+ * latency(<duration> [, jitter=<duration>]
+ *     [, distribution=uniform|normal|pareto] [, shape=<number>]
+ *     [, reorder=<bool>] [, seed=<integer>])
+ *
+ * For the uniform distribution jitter is the maximum variation, for the normal
+ * distribution it is the standard deviation and for the pareto distribution it
+ * is the scale. The shape can only be given for the pareto distribution.
+ */
+func compileLatency(args *arguments) (pipeFactory, error) {
+	var latency, jitter time.Duration
+	distribution := "uniform"
+	shape := 2.5
+	reorder := false
+	args.duration(0, "latency", &latency, true)
+	args.duration(-1, "jitter", &jitter, false)
+	args.choice(-1, "distribution", &distribution, false, "uniform", "normal", "pareto")
+	args.positive(-1, "shape", &shape, false)
+	args.boolean(-1, "reorder", &reorder, false)
+	seed := args.seed()
+	if pos, ok := args.named("shape"); ok && distribution != "pareto" {
+		args.fail(pos, "shape only applies to the pareto distribution")
+	}
+
+	var dist pipe.Distribution
+	switch {
+	case jitter == 0:
+		dist = nil
+	case distribution == "uniform":
+		dist = pipe.UniformJitter(jitter)
+	case distribution == "normal":
+		dist = pipe.NormalJitter(jitter)
+	case distribution == "pareto":
+		dist = pipe.ParetoJitter(jitter, shape)
+	}
+	return func(base pipe.Pipe) pipe.Pipe {
+		return pipe.NewJitteryLatentPipe(base, latency, dist, reorder, seed())
+	}, args.finish()
+}
+
+/*
+ * bandwidth(<rate> [, burst=<size>])
+ */
+func compileBandwidth(args *arguments) (pipeFactory, error) {
+	var rate, burst int64
+	args.rate(0, "rate", &rate, true)
+	args.size(1, "burst", &burst, false)
+	return func(base pipe.Pipe) pipe.Pipe {
+		return pipe.NewBurstyBandwidthPipe(base, rate, burst)
+	}, args.finish()
+}
+
+/*
+ * loss(<probability> [, seed=<integer>])
+ */
+func compileLoss(args *arguments) (pipeFactory, error) {
+	var probability float64
+	args.probability(0, "probability", &probability, true)
+	seed := args.seed()
+	return func(base pipe.Pipe) pipe.Pipe {
+		return pipe.NewLossyPipe(base, probability, seed())
+	}, args.finish()
+}
+
+/*
+ * burstloss(<p>, <r> [, good=<probability>] [, bad=<probability>]
+ *     [, seed=<integer>])
+ */
+func compileBurstLoss(args *arguments) (pipeFactory, error) {
+	model := pipe.GilbertElliott{GoodLoss: 0, BadLoss: 1}
+	args.probability(0, "p", &model.P, true)
+	args.probability(1, "r", &model.R, true)
+	args.probability(2, "good", &model.GoodLoss, false)
+	args.probability(3, "bad", &model.BadLoss, false)
+	seed := args.seed()
+	return func(base pipe.Pipe) pipe.Pipe {
+		return pipe.NewGilbertElliottPipe(base, model, seed())
+	}, args.finish()
+}
+
+/*
+ * reorder(<every> [, distance=<integer>] [, maxhold=<duration>])
+ */
+func compileReorder(args *arguments) (pipeFactory, error) {
+	var every int64
+	var distance int64 = 1
+	maxHold := 100 * time.Millisecond
+	args.integer(0, "every", &every, true)
+	args.integer(1, "distance", &distance, false)
+	args.duration(-1, "maxhold", &maxHold, false)
+	if every < 1 {
+		args.fail(args.stage.pos, "reorder requires \"every\" to be at least 1")
+	}
+	if distance < 1 {
+		args.fail(args.stage.pos, "reorder requires \"distance\" to be at least 1")
+	}
+	return func(base pipe.Pipe) pipe.Pipe {
+		return pipe.NewNthReorderPipe(base, int(every), int(distance), maxHold)
+	}, args.finish()
+}
+
+/*
+ * swap(<probability> [, maxhold=<duration>] [, seed=<integer>])
+ */
+func compileSwap(args *arguments) (pipeFactory, error) {
+	var probability float64
+	maxHold := 100 * time.Millisecond
+	args.probability(0, "probability", &probability, true)
+	args.duration(-1, "maxhold", &maxHold, false)
+	seed := args.seed()
+	return func(base pipe.Pipe) pipe.Pipe {
+		return pipe.NewSwapReorderPipe(base, probability, seed(), maxHold)
+	}, args.finish()
+}
+
+/*
+ * duplicate(<probability> [, delay=<duration>] [, seed=<integer>])
+ */
+func compileDuplicate(args *arguments) (pipeFactory, error) {
+	var probability float64
+	var delay time.Duration
+	args.probability(0, "probability", &probability, true)
+	args.duration(1, "delay", &delay, false)
+	seed := args.seed()
+	return func(base pipe.Pipe) pipe.Pipe {
+		return pipe.NewDuplicatePipe(base, probability, delay, seed())
+	}, args.finish()
+}
+
+/*
+ * corrupt(<rate> [, unit=bit|byte] [, start=<size>] [, end=<size>]
+ *     [, seed=<integer>])
+ */
+func compileCorrupt(args *arguments) (pipeFactory, error) {
+	var rate float64
+	unit := "bit"
+	var start int64
+	var end int64 = -1
+	args.probability(0, "rate", &rate, true)
+	args.choice(-1, "unit", &unit, false, "bit", "byte")
+	args.size(-1, "start", &start, false)
+	args.size(-1, "end", &end, false)
+	seed := args.seed()
+	if end >= 0 && end <= start {
+		args.fail(args.stage.pos, "corrupt requires \"end\" to be after \"start\"")
+	}
+
+	corruptionUnit := pipe.CorruptBits
+	if unit == "byte" {
+		corruptionUnit = pipe.CorruptBytes
+	}
+	return func(base pipe.Pipe) pipe.Pipe {
+		return pipe.NewCorruptRangePipe(base, rate, corruptionUnit, int(start), int(end), seed())
+	}, args.finish()
+}
+
+/*
+ * mtu(<size> [, coalesce=<duration>])
+ */
+func compileMTU(args *arguments) (pipeFactory, error) {
+	var mtu int64
+	var coalesce time.Duration
+	args.size(0, "mtu", &mtu, true)
+	args.duration(1, "coalesce", &coalesce, false)
+	if args.err == nil && mtu < 1 {
+		args.fail(args.stage.pos, "mtu requires \"mtu\" to be at least 1")
+	}
+	return func(base pipe.Pipe) pipe.Pipe {
+		return pipe.NewCoalescingMTUPipe(base, int(mtu), coalesce)
+	}, args.finish()
+}
+
+/*
+ * The partition modes by name
+ */
+var partitionModes = map[string]pipe.PartitionMode{
+	"none":      pipe.PartitionNone,
+	"blackhole": pipe.PartitionBlackhole,
+	"stall":     pipe.PartitionStall,
+	"reject":    pipe.PartitionReject,
+}
+
+/*
+ * partition([mode=none|blackhole|stall|reject])
+ */
+func compilePartition(args *arguments) (pipeFactory, error) {
+	mode := "none"
+	args.choice(0, "mode", &mode, false, "none", "blackhole", "stall", "reject")
+	return func(base pipe.Pipe) pipe.Pipe {
+		return pipe.NewPartitionPipe(base, partitionModes[mode])
+	}, args.finish()
+}
@@ -0,0 +1,203 @@
+package parser
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/efarrer/evilproxy/pipe"
+)
+
+/*
+ * The built in profiles. Latencies are one way so the round trip time is
+ * roughly the sum of the upstream and downstream latencies.
+ */
+var builtinProfiles = map[string]string{
+	"3g": `
+		up: latency(100ms, jitter=20ms, distribution=normal) | bandwidth(768kbps) | loss(1%);
+		down: latency(100ms, jitter=20ms, distribution=normal) | bandwidth(1600kbps) | loss(1%)`,
+	"lte": `
+		up: latency(25ms, jitter=5ms, distribution=normal) | bandwidth(10Mbps) | loss(0.1%);
+		down: latency(25ms, jitter=5ms, distribution=normal) | bandwidth(30Mbps) | loss(0.1%)`,
+	"satellite": `
+		up: latency(300ms, jitter=10ms) | bandwidth(1Mbps) | loss(0.5%);
+		down: latency(300ms, jitter=10ms) | bandwidth(15Mbps, burst=64KB) | loss(0.5%)`,
+	"dsl": `
+		up: latency(15ms, jitter=2ms) | bandwidth(1Mbps) | loss(0.1%);
+		down: latency(15ms, jitter=2ms) | bandwidth(8Mbps, burst=16KB) | loss(0.1%)`,
+	"wifi": `
+		up: latency(2ms, jitter=2ms, distribution=pareto) | bandwidth(20Mbps) |
+			burstloss(0.5%, 30%, bad=50%);
+		down: latency(2ms, jitter=2ms, distribution=pareto) | bandwidth(20Mbps) |
+			burstloss(0.5%, 30%, bad=50%)`,
+}
+
+var profilesMutex sync.Mutex
+
+/*
+ * The registered profiles by name
+ */
+var profiles = map[string]*Rule{}
+
+var builtinProfilesOnce sync.Once
+
+/*
+ * Registers the built in profiles the first time it's called. This is done
+ * lazily rather than from init so the pipes are registered first. Built in
+ * profiles must not reference other profiles.
+ */
+func registerBuiltinProfiles() {
+	builtinProfilesOnce.Do(func() {
+		for name, rule := range builtinProfiles {
+			r, err := Parse(rule)
+			if err != nil {
+				panic(fmt.Sprintf("Invalid built in profile \"%v\". %v", name, err))
+			}
+			profiles[name] = r
+		}
+	})
+}
+
+var profileNameRx = regexp.MustCompile("^[A-Za-z0-9_.-]+$")
+
+/*
+ * Registers a named profile that rules can reference with "profile(<name>)".
+ * The profile's rule may use "up:" and "down:" sections and may reference
+ * profiles that are already registered. Registering an existing name replaces
+ * the profile.
+ */
+func RegisterProfile(name string, rule string) error {
+	if !profileNameRx.MatchString(name) {
+		return errors.New(fmt.Sprintf("Invalid profile name \"%v\".", name))
+	}
+	r, err := Parse(rule)
+	if err != nil {
+		return err
+	}
+
+	registerBuiltinProfiles()
+	profilesMutex.Lock()
+	defer profilesMutex.Unlock()
+	profiles[name] = r
+	return nil
+}
+
+/*
+ * Returns the names of the registered profiles in sorted order
+ */
+func Profiles() []string {
+	registerBuiltinProfiles()
+	profilesMutex.Lock()
+	defer profilesMutex.Unlock()
+	names := []string{}
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func lookupProfile(name string) (*Rule, bool) {
+	registerBuiltinProfiles()
+	profilesMutex.Lock()
+	defer profilesMutex.Unlock()
+	r, ok := profiles[name]
+	return r, ok
+}
+
+var profileHeaderRx = regexp.MustCompile(`^\s*\[\s*([^\]\s]*)\s*\]\s*(#.*)?$`)
+
+/*
+ * Registers the profiles read from the reader. Each profile starts with its
+ * name in square brackets on a line of its own, and is followed by its rule.
+ *
+ *     [slow-office]
+ *     # Comments start with '#'
+ *     up: latency(40ms) | bandwidth(2Mbps);
+ *     down: latency(40ms) | bandwidth(10Mbps)
+ *
+ * The source is used to describe the location of errors.
+ */
+func ReadProfiles(reader io.Reader, source string) error {
+	name := ""
+	nameLine := 0
+	rule := []string{}
+	register := func() error {
+		if name == "" {
+			return nil
+		}
+		if err := RegisterProfile(name, strings.Join(rule, "\n")); err != nil {
+			if perr, ok := err.(*ParseError); ok {
+				return errors.New(fmt.Sprintf("%v:%v: profile \"%v\". %v",
+					source, nameLine+perr.Line(), name, err))
+			}
+			return errors.New(fmt.Sprintf("%v:%v: %v", source, nameLine, err))
+		}
+		return nil
+	}
+
+	scanner := bufio.NewScanner(reader)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if match := profileHeaderRx.FindStringSubmatch(text); match != nil {
+			if err := register(); err != nil {
+				return err
+			}
+			name, nameLine, rule = match[1], line, []string{}
+			continue
+		}
+		if name == "" {
+			if strings.TrimSpace(strings.SplitN(text, "#", 2)[0]) != "" {
+				return errors.New(fmt.Sprintf("%v:%v: expected a [profile] header.", source, line))
+			}
+			continue
+		}
+		rule = append(rule, text)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return register()
+}
+
+/*
+ * Registers the profiles in the file. See ReadProfiles for the format.
+ */
+func LoadProfiles(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return ReadProfiles(file, path)
+}
+
+/*
+ * profile(<name>)
+ */
+func compileProfile(args *arguments) (pipeFactory, pipeFactory, error) {
+	var profile *Rule
+	args.convert(0, "name", true, func(text string) error {
+		r, ok := lookupProfile(text)
+		if !ok {
+			return errors.New(fmt.Sprintf("unknown profile \"%v\", expected one of %v",
+				text, strings.Join(Profiles(), ", ")))
+		}
+		profile = r
+		return nil
+	})
+	if err := args.finish(); err != nil {
+		return nil, nil, err
+	}
+	return func(base pipe.Pipe) pipe.Pipe {
+			return profile.up.wrap(base, true)
+		}, func(base pipe.Pipe) pipe.Pipe {
+			return profile.down.wrap(base, false)
+		}, nil
+}
@@ -0,0 +1,92 @@
+package parser
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/efarrer/evilproxy/testing_utils"
+)
+
+func TestBuiltinProfilesAreRegistered(t *testing.T) {
+	registered := strings.Join(Profiles(), ",")
+	for name := range builtinProfiles {
+		if !strings.Contains(registered, name) {
+			t.Fatalf("Expected built in profile \"%v\" in %v\n", name, registered)
+		}
+		_, err := Parse("profile(" + name + ")")
+		testing_utils.UnexpectedError(err, "parsing profile "+name, t)
+	}
+}
+
+func TestUnknownProfileReturnsError(t *testing.T) {
+	expectParseErrorAt("latency(1ms) | profile(56k)", 24, t)
+	expectParseErrorAt("profile()", 1, t)
+}
+
+func TestRegisterProfileRejectsInvalidProfiles(t *testing.T) {
+	if err := RegisterProfile("bad name", "latency(1ms)"); err == nil {
+		t.Fatalf("Expected error registering profile with invalid name\n")
+	}
+	if err := RegisterProfile("bad-rule", "latency(1xs)"); err == nil {
+		t.Fatalf("Expected error registering profile with invalid rule\n")
+	}
+}
+
+func TestProfilesExpandPerDirection(t *testing.T) {
+	const delay = 100 * time.Millisecond
+	err := RegisterProfile("test-slow-upload", "up: latency(100ms)")
+	testing_utils.UnexpectedError(err, "registering", t)
+
+	cconn, sconn, err := ConstructConnections("profile(test-slow-upload)")
+	testing_utils.UnexpectedError(err, "constructing", t)
+	defer cconn.Close()
+	defer sconn.Close()
+	if up := timeDelivery(sconn, cconn, t); up < delay {
+		t.Fatalf("Expected upstream latency of at least %v got %v\n", delay, up)
+	}
+	if down := timeDelivery(cconn, sconn, t); down >= delay {
+		t.Fatalf("Expected no downstream latency got %v\n", down)
+	}
+}
+
+func TestReadProfilesRegistersEachProfile(t *testing.T) {
+	err := ReadProfiles(strings.NewReader(`
+# Team profiles
+[test-office]
+up: latency(40ms) | bandwidth(2Mbps);  # Slow upload
+down: latency(40ms) | bandwidth(10Mbps)
+
+[test-office-lossy]
+profile(test-office) | loss(1%)
+`), "profiles.txt")
+	testing_utils.UnexpectedError(err, "reading profiles", t)
+
+	_, err = Parse("profile(test-office-lossy)")
+	testing_utils.UnexpectedError(err, "parsing", t)
+}
+
+func TestReadProfilesReportsLineOfError(t *testing.T) {
+	err := ReadProfiles(strings.NewReader(`[test-ok]
+latency(1ms)
+
+[test-bad]
+up: latency(1ms);
+down: bogus(1ms)
+`), "profiles.txt")
+	if err == nil || !strings.HasPrefix(err.Error(), "profiles.txt:6:") {
+		t.Fatalf("Expected error on line 6 got %v\n", err)
+	}
+
+	// Bytes that aren't valid UTF-8 in a comment don't move the error
+	err = ReadProfiles(strings.NewReader("[test-office]\n# \xe9\xe9\xe9\xe9\xe9\xe9\xe9\nbogus(1)\n"),
+		"profiles.txt")
+	if err == nil || !strings.HasPrefix(err.Error(), "profiles.txt:3:") {
+		t.Fatalf("Expected error on line 3 got %v\n", err)
+	}
+
+	err = ReadProfiles(strings.NewReader("latency(1ms)\n"), "profiles.txt")
+	if err == nil || !strings.HasPrefix(err.Error(), "profiles.txt:1:") {
+		t.Fatalf("Expected error on line 1 got %v\n", err)
+	}
+}
@@ -0,0 +1,106 @@
+package parser
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/efarrer/evilproxy/pipe"
+)
+
+/*
+ * A phase of a schedule
+ */
+type phase struct {
+	duration time.Duration
+	chain    chain
+}
+
+/*
+ * Returns true if the next tokens are a named argument such as "repeat=true"
+ */
+func (p *ruleParser) atNamedArgument() bool {
+	return p.peek().kind == tokenWord && p.tokens[p.next+1].kind == tokenEquals
+}
+
+/*
+ * schedule := 'schedule' '(' item { ',' item } ')'
+ * item := duration ':' chain | name '=' value
+ *
+ * Each phase lasts for its duration. The schedule repeats unless the "repeat"
+ * argument is false, in which case the last phase lasts forever.
+ */
+func (p *ruleParser) parseSchedule(name token) (stage, error) {
+	if err := p.expect(tokenLParen, "'('"); err != nil {
+		return stage{}, err
+	}
+
+	phases := []phase{}
+	args := []argument{}
+	for {
+		if p.atNamedArgument() {
+			arg, err := p.parseArgument()
+			if err != nil {
+				return stage{}, err
+			}
+			args = append(args, arg)
+		} else {
+			durationToken := p.peek()
+			if durationToken.kind != tokenWord {
+				return stage{}, p.errorAt(durationToken,
+					fmt.Sprintf("expected a phase duration but found %v", durationToken))
+			}
+			p.advance()
+			duration, err := parseDuration(durationToken.text)
+			if err == nil && duration == 0 {
+				err = errors.New("phase duration must be greater than zero")
+			}
+			if err != nil {
+				return stage{}, p.errorAt(durationToken, err.Error())
+			}
+			if err := p.expect(tokenColon, "':'"); err != nil {
+				return stage{}, err
+			}
+			c, err := p.parseChain()
+			if err != nil {
+				return stage{}, err
+			}
+			phases = append(phases, phase{duration, c})
+		}
+
+		if p.peek().kind == tokenRParen {
+			p.advance()
+			break
+		}
+		if err := p.expect(tokenComma, "',' or ')'"); err != nil {
+			return stage{}, err
+		}
+	}
+
+	if len(phases) == 0 {
+		return stage{}, p.errorAt(name, "schedule requires at least one phase")
+	}
+	repeat := true
+	arguments := newArguments(p.rule, name, args)
+	arguments.boolean(-1, "repeat", &repeat, false)
+	if err := arguments.finish(); err != nil {
+		return stage{}, err
+	}
+
+	factory := func(upstream bool) pipeFactory {
+		return func(base pipe.Pipe) pipe.Pipe {
+			pipePhases := []pipe.Phase{}
+			for _, ph := range phases {
+				c := ph.chain
+				pipePhases = append(pipePhases, pipe.Phase{
+					Duration: ph.duration,
+					Build: func(base pipe.Pipe) pipe.Pipe {
+						return c.wrap(base, upstream)
+					},
+				})
+			}
+			return pipe.NewSchedulePipe(base, pipePhases, repeat)
+		}
+	}
+	return stage{name.text, factory(true), factory(false), true}, nil
+}
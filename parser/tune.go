@@ -0,0 +1,101 @@
+package parser
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/efarrer/evilproxy/pipe"
+)
+
+/*
+ * A Tuning is a change to a parameter of live pipes whose value has been
+ * parsed, so it can be checked against every pipe before any are changed.
+ */
+type Tuning struct {
+	Parameter   string
+	latency     time.Duration
+	probability float64
+	rate        int64
+	mode        pipe.PartitionMode
+}
+
+/*
+ * Parses a change to a parameter of live pipes. The value is given the same
+ * way as in a rule. The parameters are:
+ *
+ *     latency    a duration such as "50ms"
+ *     loss       a probability such as "1%"
+ *     bandwidth  a rate such as "1Mbps"
+ *     partition  one of "none", "blackhole", "stall" or "reject"
+ */
+func ParseTuning(parameter string, value string) (Tuning, error) {
+	tuning := Tuning{Parameter: parameter}
+	var err error
+	switch parameter {
+	case "latency":
+		tuning.latency, err = parseDuration(value)
+	case "loss":
+		tuning.probability, err = parseProbability(value)
+	case "bandwidth":
+		tuning.rate, err = parseRate(value)
+	case "partition":
+		mode, ok := partitionModes[value]
+		if !ok {
+			err = errors.New(fmt.Sprintf("invalid partition \"%v\"", value))
+		}
+		tuning.mode = mode
+	default:
+		err = errors.New(fmt.Sprintf("unknown parameter \"%v\"", parameter))
+	}
+	return tuning, err
+}
+
+/*
+ * Returns true if the pipe can be tuned
+ */
+func (t Tuning) Tunes(p pipe.Pipe) bool {
+	var ok bool
+	switch t.Parameter {
+	case "latency":
+		_, ok = p.(pipe.LatencyTuner)
+	case "loss":
+		_, ok = p.(pipe.LossTuner)
+	case "bandwidth":
+		_, ok = p.(pipe.BandwidthTuner)
+	case "partition":
+		_, ok = p.(pipe.PartitionPipe)
+	}
+	return ok
+}
+
+/*
+ * Changes the parameter of the live pipe
+ */
+func (t Tuning) Apply(p pipe.Pipe) error {
+	if !t.Tunes(p) {
+		return errors.New(fmt.Sprintf("pipe can't tune \"%v\"", t.Parameter))
+	}
+	switch t.Parameter {
+	case "latency":
+		p.(pipe.LatencyTuner).SetLatency(t.latency)
+	case "loss":
+		p.(pipe.LossTuner).SetLossProbability(t.probability)
+	case "bandwidth":
+		p.(pipe.BandwidthTuner).SetBandwidth(t.rate)
+	case "partition":
+		p.(pipe.PartitionPipe).SetMode(t.mode)
+	}
+	return nil
+}
+
+/*
+ * Changes a parameter of a live pipe, see ParseTuning for the parameters
+ */
+func Tune(p pipe.Pipe, parameter string, value string) error {
+	tuning, err := ParseTuning(parameter, value)
+	if err != nil {
+		return err
+	}
+	return tuning.Apply(p)
+}
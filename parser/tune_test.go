@@ -0,0 +1,107 @@
+package parser
+
+import (
+	"testing"
+	"time"
+
+	"github.com/efarrer/evilproxy/packet"
+	"github.com/efarrer/evilproxy/testing_utils"
+)
+
+func TestNetworkRecordsPipesOfEachDirection(t *testing.T) {
+	r, err := Parse("up: latency(1ms) | loss(1%); down: bandwidth(1Mbps)")
+	testing_utils.UnexpectedError(err, "parsing", t)
+	n := r.Network()
+	defer n.Server.Close()
+	defer n.Client.Close()
+
+	if len(n.Upstream) != 2 || n.Upstream[0].Name != "latency" || n.Upstream[1].Name != "loss" {
+		t.Fatalf("Expected upstream latency and loss stages got %v\n", n.Upstream)
+	}
+	if len(n.Downstream) != 1 || n.Downstream[0].Name != "bandwidth" {
+		t.Fatalf("Expected a downstream bandwidth stage got %v\n", n.Downstream)
+	}
+}
+
+func TestTuningLatencyChangesLiveNetwork(t *testing.T) {
+	const delay = 100 * time.Millisecond
+	r, err := Parse("latency(0) | loss(0) | bandwidth(1Gbps)")
+	testing_utils.UnexpectedError(err, "parsing", t)
+	n := r.Network()
+	defer n.Server.Close()
+	defer n.Client.Close()
+
+	if up := timeDelivery(n.Client, n.Server, t); up >= delay {
+		t.Fatalf("Expected no latency before tuning got %v\n", up)
+	}
+	err = Tune(n.Upstream[0].Pipe, "latency", "100ms")
+	testing_utils.UnexpectedError(err, "tuning latency", t)
+	err = Tune(n.Upstream[1].Pipe, "loss", "0%")
+	testing_utils.UnexpectedError(err, "tuning loss", t)
+	err = Tune(n.Upstream[2].Pipe, "bandwidth", "10Mbps")
+	testing_utils.UnexpectedError(err, "tuning bandwidth", t)
+	if up := timeDelivery(n.Client, n.Server, t); up < delay {
+		t.Fatalf("Expected latency of at least %v after tuning got %v\n", delay, up)
+	}
+}
+
+func TestTuningReturnsErrors(t *testing.T) {
+	r, err := Parse("latency(0) | bandwidth(1Mbps)")
+	testing_utils.UnexpectedError(err, "parsing", t)
+	n := r.Network()
+	defer n.Server.Close()
+	defer n.Client.Close()
+
+	latency := n.Upstream[0].Pipe
+	if err := Tune(latency, "latency", "fast"); err == nil {
+		t.Fatalf("Expected error tuning with an invalid value\n")
+	}
+	if err := Tune(latency, "loss", "1%"); err == nil {
+		t.Fatalf("Expected error tuning loss of a latent pipe\n")
+	}
+	if err := Tune(latency, "colour", "blue"); err == nil {
+		t.Fatalf("Expected error tuning an unknown parameter\n")
+	}
+	if err := Tune(n.Upstream[1].Pipe, "bandwidth", "99999999999999999999Gbps"); err == nil {
+		t.Fatalf("Expected error tuning with a bandwidth that's too large\n")
+	}
+}
+
+func TestTuningPartitionCutsOffLiveNetwork(t *testing.T) {
+	r, err := Parse("partition(reject)")
+	testing_utils.UnexpectedError(err, "parsing", t)
+	n := r.Network()
+	defer n.Server.Close()
+	defer n.Client.Close()
+
+	if err := n.Client.Write(&packet.Packet{}); err == nil {
+		t.Fatalf("Expected error writing to a rejecting network\n")
+	}
+	if err := Tune(n.Upstream[0].Pipe, "partition", "down"); err == nil {
+		t.Fatalf("Expected error tuning with an invalid partition\n")
+	}
+	err = Tune(n.Upstream[0].Pipe, "partition", "none")
+	testing_utils.UnexpectedError(err, "tuning partition", t)
+	timeDelivery(n.Client, n.Server, t)
+}
+
+func TestParsedTuningIsCheckedBeforeItIsApplied(t *testing.T) {
+	r, err := Parse("latency(0) | loss(0)")
+	testing_utils.UnexpectedError(err, "parsing", t)
+	n := r.Network()
+	defer n.Server.Close()
+	defer n.Client.Close()
+
+	if _, err := ParseTuning("loss", "bogus"); err == nil {
+		t.Fatalf("Expected error parsing a tuning with an invalid value\n")
+	}
+	tuning, err := ParseTuning("loss", "1%")
+	testing_utils.UnexpectedError(err, "parsing tuning", t)
+	if tuning.Tunes(n.Upstream[0].Pipe) || !tuning.Tunes(n.Upstream[1].Pipe) {
+		t.Fatalf("Expected only the lossy pipe to be tuned by loss\n")
+	}
+	if err := tuning.Apply(n.Upstream[0].Pipe); err == nil {
+		t.Fatalf("Expected error applying loss to a latent pipe\n")
+	}
+	testing_utils.UnexpectedError(tuning.Apply(n.Upstream[1].Pipe), "applying tuning", t)
+}
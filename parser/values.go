@@ -0,0 +1,172 @@
+package parser
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ * Splits a value such as "1.5Mbps" into its number ("1.5") and unit ("Mbps")
+ */
+func splitUnit(text string) (string, string) {
+	i := 0
+	for i < len(text) && (text[i] == '.' || text[i] == '-' ||
+		(text[i] >= '0' && text[i] <= '9')) {
+		i++
+	}
+	return text[:i], text[i:]
+}
+
+/*
+ * Parses a non-negative number followed by a unit from the given table of
+ * multipliers
+ */
+func parseWithUnits(text string, what string, units map[string]float64) (float64, error) {
+	number, unit := splitUnit(text)
+	multiplier, ok := units[unit]
+	if !ok {
+		return 0, errors.New(fmt.Sprintf("unknown %v unit \"%v\" in \"%v\"", what, unit, text))
+	}
+	value, err := strconv.ParseFloat(number, 64)
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("invalid %v \"%v\"", what, text))
+	}
+	if value < 0 {
+		return 0, errors.New(fmt.Sprintf("%v \"%v\" can't be negative", what, text))
+	}
+	return value * multiplier, nil
+}
+
+/*
+ * Parses a duration such as "50ms" or "1.5s". A bare "0" is also accepted.
+ */
+func parseDuration(text string) (time.Duration, error) {
+	if text == "0" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(text)
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("invalid duration \"%v\"", text))
+	}
+	if d < 0 {
+		return 0, errors.New(fmt.Sprintf("duration \"%v\" can't be negative", text))
+	}
+	return d, nil
+}
+
+/*
+ * Parses a probability given either as a percentage ("1%") or a fraction
+ * ("0.01")
+ */
+func parseProbability(text string) (float64, error) {
+	value, err := parseWithUnits(text, "probability", map[string]float64{
+		"":  1,
+		"%": 0.01,
+	})
+	if err != nil {
+		return 0, err
+	}
+	if value > 1 {
+		return 0, errors.New(fmt.Sprintf("probability \"%v\" can't exceed 100%%", text))
+	}
+	return value, nil
+}
+
+/*
+ * Parses an integer
+ */
+func parseInteger(text string) (int64, error) {
+	value, err := strconv.ParseInt(text, 10, 64)
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("invalid integer \"%v\"", text))
+	}
+	return value, nil
+}
+
+/*
+ * Parses a finite positive number
+ */
+func parsePositive(text string) (float64, error) {
+	value, err := strconv.ParseFloat(text, 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) || value <= 0 {
+		return 0, errors.New(fmt.Sprintf("invalid positive number \"%v\"", text))
+	}
+	return value, nil
+}
+
+/*
+ * Parses a boolean such as "true", "off" or "yes"
+ */
+func parseBool(text string) (bool, error) {
+	switch strings.ToLower(text) {
+	case "true", "yes", "on":
+		return true, nil
+	case "false", "no", "off":
+		return false, nil
+	}
+	return false, errors.New(fmt.Sprintf("invalid boolean \"%v\"", text))
+}
+
+var rateUnits = map[string]float64{
+	"bps":  1.0 / 8,
+	"kbps": 1e3 / 8,
+	"Kbps": 1e3 / 8,
+	"Mbps": 1e6 / 8,
+	"Gbps": 1e9 / 8,
+	"Bps":  1,
+	"kBps": 1e3,
+	"KBps": 1e3,
+	"MBps": 1e6,
+	"GBps": 1e9,
+}
+
+/*
+ * Parses a data rate such as "256kbps" (bits) or "1MBps" (bytes) into bytes
+ * per second
+ */
+func parseRate(text string) (int64, error) {
+	value, err := parseWithUnits(text, "rate", rateUnits)
+	if err != nil {
+		return 0, err
+	}
+	if value < 1 {
+		return 0, errors.New(fmt.Sprintf("rate \"%v\" must be at least 1Bps", text))
+	}
+	if value >= math.MaxInt64 {
+		return 0, errors.New(fmt.Sprintf("rate \"%v\" is too large", text))
+	}
+	return int64(value), nil
+}
+
+var sizeUnits = map[string]float64{
+	"":    1,
+	"B":   1,
+	"KB":  1e3,
+	"kB":  1e3,
+	"MB":  1e6,
+	"GB":  1e9,
+	"KiB": 1 << 10,
+	"MiB": 1 << 20,
+	"GiB": 1 << 30,
+}
+
+/*
+ * Parses a whole number of bytes such as "1500", "16KB" or "1.5MiB"
+ */
+func parseSize(text string) (int64, error) {
+	value, err := parseWithUnits(text, "size", sizeUnits)
+	if err != nil {
+		return 0, err
+	}
+	if value != math.Trunc(value) {
+		return 0, errors.New(fmt.Sprintf("size \"%v\" isn't a whole number of bytes", text))
+	}
+	if value >= math.MaxInt64 {
+		return 0, errors.New(fmt.Sprintf("size \"%v\" is too large", text))
+	}
+	return int64(value), nil
+}
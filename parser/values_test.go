@@ -0,0 +1,118 @@
+package parser
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseDuration(t *testing.T) {
+	for text, expected := range map[string]time.Duration{
+		"0":     0,
+		"50ms":  50 * time.Millisecond,
+		"1.5s":  1500 * time.Millisecond,
+		"100us": 100 * time.Microsecond,
+	} {
+		value, err := parseDuration(text)
+		if err != nil || value != expected {
+			t.Fatalf("Parsing \"%v\" got %v, %v expected %v\n", text, value, err, expected)
+		}
+	}
+	for _, text := range []string{"", "50", "-1s", "fast"} {
+		if _, err := parseDuration(text); err == nil {
+			t.Fatalf("Expected error parsing \"%v\"\n", text)
+		}
+	}
+}
+
+func TestParseRate(t *testing.T) {
+	for text, expected := range map[string]int64{
+		"8bps":    1,
+		"256kbps": 32000,
+		"1Mbps":   125000,
+		"1.5MBps": 1500000,
+		"100Bps":  100,
+	} {
+		value, err := parseRate(text)
+		if err != nil || value != expected {
+			t.Fatalf("Parsing \"%v\" got %v, %v expected %v\n", text, value, err, expected)
+		}
+	}
+	for _, text := range []string{"", "1", "1bps", "1Mbit", "-1Mbps", "Mbps", "99999999999999999999Gbps"} {
+		if _, err := parseRate(text); err == nil {
+			t.Fatalf("Expected error parsing \"%v\"\n", text)
+		}
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	for text, expected := range map[string]int64{
+		"1500":  1500,
+		"0":     0,
+		"16KB":  16000,
+		"64KiB": 65536,
+		"1MB":   1000000,
+		"1.5KB": 1500,
+	} {
+		value, err := parseSize(text)
+		if err != nil || value != expected {
+			t.Fatalf("Parsing \"%v\" got %v, %v expected %v\n", text, value, err, expected)
+		}
+	}
+	for _, text := range []string{"", "1XB", "-1B", "1.5", "1.5B", "0.0001KB", "10000000000GB"} {
+		if _, err := parseSize(text); err == nil {
+			t.Fatalf("Expected error parsing \"%v\"\n", text)
+		}
+	}
+}
+
+func TestParseProbability(t *testing.T) {
+	for text, expected := range map[string]float64{
+		"0":    0,
+		"1":    1,
+		"0.25": 0.25,
+		"50%":  0.5,
+		"100%": 1,
+	} {
+		value, err := parseProbability(text)
+		if err != nil || value != expected {
+			t.Fatalf("Parsing \"%v\" got %v, %v expected %v\n", text, value, err, expected)
+		}
+	}
+	for _, text := range []string{"", "2", "101%", "-1%", "1x"} {
+		if _, err := parseProbability(text); err == nil {
+			t.Fatalf("Expected error parsing \"%v\"\n", text)
+		}
+	}
+}
+
+func TestParseBool(t *testing.T) {
+	for text, expected := range map[string]bool{
+		"true": true, "On": true, "yes": true,
+		"false": false, "off": false, "NO": false,
+	} {
+		value, err := parseBool(text)
+		if err != nil || value != expected {
+			t.Fatalf("Parsing \"%v\" got %v, %v expected %v\n", text, value, err, expected)
+		}
+	}
+	if _, err := parseBool("maybe"); err == nil {
+		t.Fatalf("Expected error parsing \"maybe\"\n")
+	}
+}
+
+func TestParsePositive(t *testing.T) {
+	for text, expected := range map[string]float64{
+		"2.5": 2.5,
+		"1":   1,
+	} {
+		value, err := parsePositive(text)
+		if err != nil || value != expected {
+			t.Fatalf("Parsing \"%v\" got %v, %v expected %v\n", text, value, err, expected)
+		}
+	}
+	for _, text := range []string{"", "0", "-1", "NaN", "Inf", "+Inf", "-Inf", "1e400"} {
+		if _, err := parsePositive(text); err == nil {
+			t.Fatalf("Expected error parsing \"%v\"\n", text)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package pipe
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/efarrer/evilproxy/packet"
+)
+
+/*
+ * A bandwidthPipe is a pipe that simulates a link with limited bandwidth. It
+ * uses a token bucket that fills at bytesPerSecond up to burst bytes. A packet
+ * is forwarded once the bucket holds a token for each byte of its payload, and
+ * those tokens are then removed from the bucket. A bucket is allowed to grow
+ * past burst to hold a packet that is larger than burst.
+ */
+type bandwidthPipe struct {
+	inputChan      chan *packet.Packet
+	basePipe       Pipe
+	mutex          sync.Mutex
+	bytesPerSecond int64
+	// Signaled when bytesPerSecond changes
+	retune chan bool
+	burst  int64
+	// Held while sending to or closing inputChan
+	sendMutex sync.Mutex
+	closed    bool
+}
+
+/*
+ * Send a packet over a bandwidth pipe
+ */
+func (bp *bandwidthPipe) Send(p *packet.Packet) error {
+	bp.sendMutex.Lock()
+	defer bp.sendMutex.Unlock()
+	if bp.closed {
+		return errors.New("Sending on a closed bandwidth pipe.\n")
+	}
+	bp.inputChan <- p
+	return nil
+}
+
+/*
+ * Receive a packet from the bandwidth pipe
+ */
+func (bp *bandwidthPipe) Recv() (*packet.Packet, error) {
+	return bp.basePipe.Recv()
+}
+
+/*
+ * Close the bandwidth pipe
+ */
+func (bp *bandwidthPipe) Close() error {
+	bp.sendMutex.Lock()
+	defer bp.sendMutex.Unlock()
+	if bp.closed {
+		return errors.New("Closing a closed bandwidth pipe.\n")
+	}
+	close(bp.inputChan)
+	bp.closed = true
+	return nil
+}
+
+/*
+ * Sets the rate that packets are forwarded at. Panics unless bytesPerSecond is
+ * positive.
+ */
+func (bp *bandwidthPipe) SetBandwidth(bytesPerSecond int64) {
+	checkBandwidth(bytesPerSecond)
+	bp.mutex.Lock()
+	bp.bytesPerSecond = bytesPerSecond
+	bp.mutex.Unlock()
+	// Wake the forwarding goroutine unless it's already been woken
+	select {
+	case bp.retune <- true:
+	default:
+	}
+}
+
+/*
+ * Panics unless bytesPerSecond is positive, a packet would never be forwarded
+ * otherwise
+ */
+func checkBandwidth(bytesPerSecond int64) {
+	if bytesPerSecond <= 0 {
+		panic(fmt.Sprintf("Bandwidth must be positive got %v.\n", bytesPerSecond))
+	}
+}
+
+func (bp *bandwidthPipe) rate() float64 {
+	bp.mutex.Lock()
+	defer bp.mutex.Unlock()
+	return float64(bp.bytesPerSecond)
+}
+
+/*
+ * Constructs a new bandwidth pipe that forwards bytesPerSecond with no burst.
+ */
+func NewBandwidthPipe(p Pipe, bytesPerSecond int64) Pipe {
+	return NewBurstyBandwidthPipe(p, bytesPerSecond, 0)
+}
+
+/*
+ * Constructs a new bandwidth pipe that forwards bytesPerSecond and allows up to
+ * burst bytes to be sent back to back after the link has been idle. Panics
+ * unless bytesPerSecond is positive.
+ */
+func NewBurstyBandwidthPipe(p Pipe, bytesPerSecond int64, burst int64) Pipe {
+	checkBandwidth(bytesPerSecond)
+	bp := &bandwidthPipe{
+		inputChan:      make(chan *packet.Packet),
+		basePipe:       p,
+		bytesPerSecond: bytesPerSecond,
+		retune:         make(chan bool, 1),
+		burst:          burst,
+	}
+
+	go func() {
+		var shutdown = false
+		// Nil once the pipe is closed, otherwise the closed channel would
+		// keep being received from while the packets wait for tokens
+		inputChan := bp.inputChan
+		// Fires when the bucket holds enough tokens for the head packet
+		var timer <-chan time.Time = nil
+
+		// The bucket starts full
+		tokens := float64(burst)
+		lastFill := time.Now()
+		fill := func(capacity float64) {
+			now := time.Now()
+			tokens += now.Sub(lastFill).Seconds() * bp.rate()
+			if tokens > capacity {
+				tokens = capacity
+			}
+			lastFill = now
+		}
+
+		// The packets waiting for tokens
+		waiting := list.New()
+
+		// Forwards all packets that the bucket has tokens for and starts the
+		// timer for the next packet
+		forward := func() {
+			timer = nil
+			for waiting.Len() != 0 {
+				pkt := waiting.Front().Value.(*packet.Packet)
+				size := float64(len(pkt.Payload))
+				fill(math.Max(size, float64(burst)))
+				if tokens < size {
+					wait := (size - tokens) / bp.rate()
+					timer = time.After(time.Duration(wait * float64(time.Second)))
+					return
+				}
+				tokens -= size
+				waiting.Remove(waiting.Front())
+				bp.basePipe.Send(pkt)
+			}
+		}
+
+		for {
+			// If we've been shutdown and all packets have been forwarded then
+			// we can close the basePipe and exit
+			if shutdown && waiting.Len() == 0 {
+				bp.basePipe.Close()
+				return
+			}
+
+			select {
+			// We got a new packet to queue
+			case input, ok := <-inputChan:
+				// We've been shutdown, but we need to forward the waiting
+				// packets, so just set a flag for now.
+				if !ok {
+					shutdown = true
+					inputChan = nil
+					continue
+				}
+
+				waiting.PushBack(input)
+				// If the timer is running then this packet will be forwarded
+				// after those ahead of it
+				if timer == nil {
+					forward()
+				}
+
+			// The bucket has enough tokens for the head packet
+			case <-timer:
+				forward()
+
+			// The rate changed so the head packet may be due sooner or later
+			case <-bp.retune:
+				if timer != nil {
+					forward()
+				}
+			}
+		}
+	}()
+
+	return bp
+}
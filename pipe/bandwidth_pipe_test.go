@@ -0,0 +1,102 @@
+package pipe
+
+import (
+	"testing"
+	"time"
+
+	"github.com/efarrer/evilproxy/packet"
+	"github.com/efarrer/evilproxy/testing_utils"
+)
+
+func TestPipeBehaviorForBandwidthPipe(t *testing.T) {
+	PerformPipeTests(func() Pipe { return NewBandwidthPipe(NewBasicPipe(), 1000) }, t)
+}
+
+func TestPipeBehaviorForBurstyBandwidthPipe(t *testing.T) {
+	PerformPipeTests(func() Pipe { return NewBurstyBandwidthPipe(NewBasicPipe(), 1000, 1000) }, t)
+}
+
+/*
+ * Sends the packets and returns how long it took to receive all of them
+ */
+func timePackets(pipe Pipe, pkts []*packet.Packet, t *testing.T) time.Duration {
+	start := time.Now()
+	for _, pkt := range pkts {
+		err := pipe.Send(pkt)
+		testing_utils.UnexpectedError(err, "sending", t)
+	}
+	for _, pkt := range pkts {
+		rcvd, err := pipe.Recv()
+		testing_utils.UnexpectedError(err, "recving", t)
+		if rcvd != pkt {
+			t.Fatalf("Didn't get expected packet from pipe. Got %v expected %v", rcvd, pkt)
+		}
+	}
+	return time.Since(start)
+}
+
+func TestBandwidthPipeDelaysPacketsByPayloadSize(t *testing.T) {
+	const expected = 200 * time.Millisecond
+	pipe := NewBandwidthPipe(NewBasicPipe(), 10000)
+	defer pipe.Close()
+	pkts := []*packet.Packet{
+		{Payload: make([]byte, 1000)},
+		{Payload: make([]byte, 1000)},
+	}
+	elapsed := timePackets(pipe, pkts, t)
+	if !testing_utils.FuzzyEquals(expected, elapsed, 50*time.Millisecond) {
+		t.Fatalf("Bandwidth pipe took %v expected %v", elapsed, expected)
+	}
+}
+
+func TestBurstyBandwidthPipeSendsBurstImmediately(t *testing.T) {
+	const expected = 100 * time.Millisecond
+	pipe := NewBurstyBandwidthPipe(NewBasicPipe(), 10000, 2000)
+	defer pipe.Close()
+	pkts := []*packet.Packet{
+		{Payload: make([]byte, 1000)},
+		{Payload: make([]byte, 1000)},
+		{Payload: make([]byte, 1000)},
+	}
+	elapsed := timePackets(pipe, pkts, t)
+	if !testing_utils.FuzzyEquals(expected, elapsed, 50*time.Millisecond) {
+		t.Fatalf("Bursty bandwidth pipe took %v expected %v", elapsed, expected)
+	}
+}
+
+func TestBandwidthPipeBandwidthCanBeTunedWhilePacketsWait(t *testing.T) {
+	pipe := NewBandwidthPipe(NewBasicPipe(), 1)
+	defer pipe.Close()
+	start := time.Now()
+	err := pipe.Send(&packet.Packet{Payload: make([]byte, 1000)})
+	testing_utils.UnexpectedError(err, "sending", t)
+	// The packet would take over 16 minutes at the original bandwidth
+	time.Sleep(10 * time.Millisecond)
+	pipe.(BandwidthTuner).SetBandwidth(10000)
+	_, err = pipe.Recv()
+	testing_utils.UnexpectedError(err, "recving", t)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Expected the waiting packet to be forwarded at the tuned bandwidth, took %v", elapsed)
+	}
+}
+
+func TestBandwidthPipePanicsWithoutAPositiveBandwidth(t *testing.T) {
+	for _, bytesPerSecond := range []int64{0, -1} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatalf("Expected a bandwidth of %v to panic", bytesPerSecond)
+				}
+			}()
+			NewBandwidthPipe(NewBasicPipe(), bytesPerSecond)
+		}()
+	}
+	pipe := NewBandwidthPipe(NewBasicPipe(), 1000)
+	defer pipe.Close()
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("Expected tuning to a negative bandwidth to panic")
+		}
+	}()
+	pipe.(BandwidthTuner).SetBandwidth(-1)
+}
@@ -3,6 +3,7 @@ package pipe
 import (
 	"container/list"
 	"errors"
+	"sync"
 
 	"github.com/efarrer/evilproxy/packet"
 )
@@ -13,13 +14,17 @@ import (
 type basicPipe struct {
 	inputChan  chan *packet.Packet
 	outputChan chan *packet.Packet
-	closed     bool
+	// Held while sending to or closing inputChan
+	sendMutex sync.Mutex
+	closed    bool
 }
 
 /*
  * Send a packet over a basic pipe
  */
 func (bp *basicPipe) Send(p *packet.Packet) error {
+	bp.sendMutex.Lock()
+	defer bp.sendMutex.Unlock()
 	if bp.closed {
 		return errors.New("Sending on a closed basic pipe.\n")
 	}
@@ -42,6 +47,8 @@ func (bp *basicPipe) Recv() (*packet.Packet, error) {
  * Close the basic pipe
  */
 func (bp *basicPipe) Close() error {
+	bp.sendMutex.Lock()
+	defer bp.sendMutex.Unlock()
 	if bp.closed {
 		return errors.New("Closing a closed basic pipe.\n")
 	}
@@ -54,10 +61,14 @@ func (bp *basicPipe) Close() error {
  * Constructs a new basic pipe
  */
 func NewBasicPipe() Pipe {
-	bp := &basicPipe{make(chan *packet.Packet), make(chan *packet.Packet), false}
+	bp := &basicPipe{inputChan: make(chan *packet.Packet), outputChan: make(chan *packet.Packet)}
 
 	go func() {
 		var shutdown = false
+		// Holds bp.inputChan until it's closed and nil afterwards, a
+		// closed channel is always ready so it would be selected over and
+		// over while the arrived packets wait to be recv'd
+		inputChan := bp.inputChan
 
 		// The packets that have arrived and are ready to be recv'd
 		arrived := list.New()
@@ -79,12 +90,13 @@ func NewBasicPipe() Pipe {
 
 			select {
 			// We got a new packet to queue
-			case input, ok := <-bp.inputChan:
+			case input, ok := <-inputChan:
 				// We've been shutdown, but we need to wait for packets in the
 				// arrived queued data to be delivered, so just set a flag for
 				// now.
 				if !ok {
 					shutdown = true
+					inputChan = nil
 					continue
 				}
 
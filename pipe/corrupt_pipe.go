@@ -0,0 +1,184 @@
+package pipe
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"sync"
+
+	"github.com/efarrer/evilproxy/packet"
+)
+
+/*
+ * A 'CorruptingPipe' is a 'Pipe' that corrupts the payload of some of the
+ * packets sent over it.
+ */
+type CorruptingPipe interface {
+	Pipe
+
+	/*
+	 * Returns the number of packets that have been corrupted
+	 */
+	Corrupted() int64
+}
+
+/*
+ * The unit of data that a corrupting pipe damages
+ */
+type CorruptionUnit int
+
+const (
+	/*
+	 * Each bit is flipped with the error rate
+	 */
+	CorruptBits CorruptionUnit = iota
+
+	/*
+	 * Each byte is replaced by a different random byte with the error rate
+	 */
+	CorruptBytes
+)
+
+/*
+ * A corruptPipe is a pipe that simulates transmission errors
+ */
+type corruptPipe struct {
+	mutex     sync.Mutex
+	basePipe  Pipe
+	rate      float64
+	unit      CorruptionUnit
+	start     int
+	end       int
+	rand      *rand.Rand
+	corrupted int64
+	closed    bool
+}
+
+/*
+ * Returns the number of units to skip before the next error. Must be called
+ * with the mutex held.
+ */
+func (cp *corruptPipe) skip() int {
+	if cp.rate >= 1 {
+		return 0
+	}
+	// Sample a geometric distribution so long payloads with low error rates
+	// don't need a random number per unit
+	skip := math.Floor(math.Log(1-cp.rand.Float64()) / math.Log(1-cp.rate))
+	if skip > math.MaxInt32 {
+		return math.MaxInt32
+	}
+	return int(skip)
+}
+
+/*
+ * Returns a corrupted copy of the packet, or the packet itself if it wasn't
+ * corrupted. Must be called with the mutex held.
+ */
+func (cp *corruptPipe) corrupt(p *packet.Packet) *packet.Packet {
+	if cp.rate <= 0 {
+		return p
+	}
+	start, end := cp.start, cp.end
+	if end < 0 || end > len(p.Payload) {
+		end = len(p.Payload)
+	}
+	if start >= end {
+		return p
+	}
+
+	bitsPerUnit := 1
+	if cp.unit == CorruptBits {
+		bitsPerUnit = 8
+	}
+	units := (end - start) * bitsPerUnit
+
+	var corrupted *packet.Packet = nil
+	for unit := cp.skip(); unit < units; unit += cp.skip() + 1 {
+		if corrupted == nil {
+			corrupted = p.Clone()
+		}
+		if cp.unit == CorruptBits {
+			corrupted.Payload[start+unit/8] ^= 1 << uint(unit%8)
+		} else {
+			corrupted.Payload[start+unit] ^= byte(cp.rand.Intn(255) + 1)
+		}
+	}
+
+	if corrupted == nil {
+		return p
+	}
+	cp.corrupted++
+	return corrupted
+}
+
+/*
+ * Send a packet over a corrupt pipe
+ */
+func (cp *corruptPipe) Send(p *packet.Packet) error {
+	cp.mutex.Lock()
+	if cp.closed {
+		cp.mutex.Unlock()
+		return errors.New("Sending on a closed corrupt pipe.\n")
+	}
+	p = cp.corrupt(p)
+	cp.mutex.Unlock()
+
+	return cp.basePipe.Send(p)
+}
+
+/*
+ * Receive a packet from the corrupt pipe
+ */
+func (cp *corruptPipe) Recv() (*packet.Packet, error) {
+	return cp.basePipe.Recv()
+}
+
+/*
+ * Close the corrupt pipe
+ */
+func (cp *corruptPipe) Close() error {
+	cp.mutex.Lock()
+	defer cp.mutex.Unlock()
+	if cp.closed {
+		return errors.New("Closing a closed corrupt pipe.\n")
+	}
+	cp.closed = true
+	return cp.basePipe.Close()
+}
+
+/*
+ * Returns the number of packets that have been corrupted
+ */
+func (cp *corruptPipe) Corrupted() int64 {
+	cp.mutex.Lock()
+	defer cp.mutex.Unlock()
+	return cp.corrupted
+}
+
+/*
+ * Constructs a new corrupt pipe that damages each unit of a packet's payload
+ * with the given error rate. Corrupted packets are delivered as copies so the
+ * sender's packet is never modified. Pipes constructed with the same seed
+ * corrupt the same data.
+ */
+func NewCorruptPipe(p Pipe, rate float64, unit CorruptionUnit, seed int64) CorruptingPipe {
+	return NewCorruptRangePipe(p, rate, unit, 0, -1, seed)
+}
+
+/*
+ * Constructs a new corrupt pipe that only damages the payload between the
+ * start offset (inclusive) and the end offset (exclusive). A negative end
+ * offset is the end of the payload.
+ */
+func NewCorruptRangePipe(p Pipe, rate float64, unit CorruptionUnit, start, end int,
+	seed int64) CorruptingPipe {
+	return &corruptPipe{
+		basePipe: p,
+		rate:     rate,
+		unit:     unit,
+		start:    start,
+		end:      end,
+		rand:     rand.New(rand.NewSource(seed)),
+	}
+}
@@ -0,0 +1,97 @@
+package pipe
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/efarrer/evilproxy/packet"
+	"github.com/efarrer/evilproxy/testing_utils"
+)
+
+func TestPipeBehaviorForCorruptPipe(t *testing.T) {
+	PerformPipeTests(func() Pipe { return NewCorruptPipe(NewBasicPipe(), 0, CorruptBits, 1) }, t)
+}
+
+/*
+ * Sends a packet with the payload over the pipe and returns the received packet
+ */
+func sendPayload(pipe Pipe, payload []byte, t *testing.T) *packet.Packet {
+	err := pipe.Send(&packet.Packet{Payload: payload})
+	testing_utils.UnexpectedError(err, "sending", t)
+	rcvd, err := pipe.Recv()
+	testing_utils.UnexpectedError(err, "recving", t)
+	return rcvd
+}
+
+/*
+ * Returns the number of bits that differ between a and b
+ */
+func bitErrors(a, b []byte) int {
+	count := 0
+	for i := range a {
+		for diff := a[i] ^ b[i]; diff != 0; diff &= diff - 1 {
+			count++
+		}
+	}
+	return count
+}
+
+func TestCorruptPipeFlipsBitsAtErrorRate(t *testing.T) {
+	payload := make([]byte, 10000)
+	original := make([]byte, len(payload))
+	pipe := NewCorruptPipe(NewBasicPipe(), 0.01, CorruptBits, 1)
+	defer pipe.Close()
+
+	rcvd := sendPayload(pipe, payload, t)
+	if !bytes.Equal(payload, original) {
+		t.Fatalf("Expected the sender's payload to be unmodified")
+	}
+	// 1% of 80000 bits
+	if errs := bitErrors(rcvd.Payload, original); errs < 700 || errs > 900 {
+		t.Fatalf("Expected about 800 bit errors got %v", errs)
+	}
+	if pipe.Corrupted() != 1 {
+		t.Fatalf("Expected 1 corrupted packet got %v", pipe.Corrupted())
+	}
+}
+
+func TestCorruptPipeReplacesEveryByteWithCertainError(t *testing.T) {
+	payload := []byte("abcdefgh")
+	pipe := NewCorruptPipe(NewBasicPipe(), 1, CorruptBytes, 1)
+	defer pipe.Close()
+
+	rcvd := sendPayload(pipe, payload, t)
+	for i := range payload {
+		if rcvd.Payload[i] == payload[i] {
+			t.Fatalf("Expected every byte to be replaced got %v", rcvd.Payload)
+		}
+	}
+}
+
+func TestCorruptRangePipeOnlyCorruptsRange(t *testing.T) {
+	payload := make([]byte, 100)
+	pipe := NewCorruptRangePipe(NewBasicPipe(), 1, CorruptBits, 10, 20, 1)
+	defer pipe.Close()
+
+	rcvd := sendPayload(pipe, payload, t)
+	for i, b := range rcvd.Payload {
+		inRange := i >= 10 && i < 20
+		if inRange && b != 0xff || !inRange && b != 0 {
+			t.Fatalf("Expected only bytes 10 to 19 to be corrupted got %v", rcvd.Payload)
+		}
+	}
+}
+
+func TestCorruptPipeDeliversShortPacketsUntouched(t *testing.T) {
+	pkt := &packet.Packet{Payload: make([]byte, 5)}
+	pipe := NewCorruptRangePipe(NewBasicPipe(), 1, CorruptBits, 10, -1, 1)
+	defer pipe.Close()
+
+	err := pipe.Send(pkt)
+	testing_utils.UnexpectedError(err, "sending", t)
+	rcvd, err := pipe.Recv()
+	testing_utils.UnexpectedError(err, "recving", t)
+	if rcvd != pkt || pipe.Corrupted() != 0 {
+		t.Fatalf("Expected the packet to be delivered untouched")
+	}
+}
@@ -0,0 +1,141 @@
+package pipe
+
+import (
+	"container/list"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/efarrer/evilproxy/packet"
+)
+
+/*
+ * A duplicatePipe is a pipe that duplicates some of the packets sent over it.
+ * The duplicate is a deep copy of the original, so changes to one packet don't
+ * affect the other, and is forwarded after the given delay.
+ */
+type duplicatePipe struct {
+	inputChan chan *packet.Packet
+	basePipe  Pipe
+	// Held while sending to or closing inputChan
+	sendMutex sync.Mutex
+	closed    bool
+}
+
+/*
+ * A duplicate packet waiting to be forwarded
+ */
+type duplicatePacket struct {
+	packet  *packet.Packet
+	dueTime time.Time
+}
+
+/*
+ * Send a packet over a duplicate pipe
+ */
+func (dp *duplicatePipe) Send(p *packet.Packet) error {
+	dp.sendMutex.Lock()
+	defer dp.sendMutex.Unlock()
+	if dp.closed {
+		return errors.New("Sending on a closed duplicate pipe.\n")
+	}
+	dp.inputChan <- p
+	return nil
+}
+
+/*
+ * Receive a packet from the duplicate pipe
+ */
+func (dp *duplicatePipe) Recv() (*packet.Packet, error) {
+	return dp.basePipe.Recv()
+}
+
+/*
+ * Close the duplicate pipe
+ */
+func (dp *duplicatePipe) Close() error {
+	dp.sendMutex.Lock()
+	defer dp.sendMutex.Unlock()
+	if dp.closed {
+		return errors.New("Closing a closed duplicate pipe.\n")
+	}
+	close(dp.inputChan)
+	dp.closed = true
+	return nil
+}
+
+/*
+ * Constructs a new duplicate pipe that duplicates each packet with the given
+ * probability. The duplicate is forwarded delay after the original. Pipes
+ * constructed with the same seed duplicate the same packets.
+ */
+func NewDuplicatePipe(p Pipe, probability float64, delay time.Duration, seed int64) Pipe {
+	dp := &duplicatePipe{inputChan: make(chan *packet.Packet), basePipe: p}
+
+	go func() {
+		var shutdown = false
+		// Cleared when the pipe is closed, as receiving from the closed
+		// channel would never block while the duplicates wait
+		inputChan := dp.inputChan
+		random := rand.New(rand.NewSource(seed))
+
+		// The duplicates waiting to be forwarded, oldest first
+		duplicates := list.New()
+
+		// Fires when the oldest duplicate is due
+		var timer <-chan time.Time = nil
+		restartTimer := func() {
+			if duplicates.Len() == 0 {
+				timer = nil
+			} else {
+				dueTime := duplicates.Front().Value.(*duplicatePacket).dueTime
+				timer = time.After(dueTime.Sub(time.Now()))
+			}
+		}
+
+		for {
+			// If we've been shutdown and all duplicates have been forwarded
+			// then we can close the basePipe and exit
+			if shutdown && duplicates.Len() == 0 {
+				dp.basePipe.Close()
+				return
+			}
+
+			select {
+			// We got a new packet to forward
+			case input, ok := <-inputChan:
+				// We've been shutdown, but we need to forward the waiting
+				// duplicates, so just set a flag for now.
+				if !ok {
+					shutdown = true
+					inputChan = nil
+					continue
+				}
+
+				if random.Float64() < probability {
+					duplicates.PushBack(&duplicatePacket{input.Clone(), time.Now().Add(delay)})
+					if timer == nil {
+						restartTimer()
+					}
+				}
+				dp.basePipe.Send(input)
+
+			// The oldest duplicate is due
+			case <-timer:
+				now := time.Now()
+				for duplicates.Len() != 0 {
+					dup := duplicates.Front().Value.(*duplicatePacket)
+					if dup.dueTime.After(now) {
+						break
+					}
+					duplicates.Remove(duplicates.Front())
+					dp.basePipe.Send(dup.packet)
+				}
+				restartTimer()
+			}
+		}
+	}()
+
+	return dp
+}
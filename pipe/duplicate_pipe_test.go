@@ -0,0 +1,62 @@
+package pipe
+
+import (
+	"testing"
+	"time"
+
+	"github.com/efarrer/evilproxy/packet"
+	"github.com/efarrer/evilproxy/testing_utils"
+)
+
+func TestPipeBehaviorForDuplicatePipe(t *testing.T) {
+	PerformPipeTests(func() Pipe { return NewDuplicatePipe(NewBasicPipe(), 0, 0, 1) }, t)
+}
+
+func TestDuplicatePipeDeliversDeepCopyAfterOriginal(t *testing.T) {
+	const delay = 50 * time.Millisecond
+	pkt := &packet.Packet{Seq: 7, Payload: []byte("payload")}
+	pipe := NewDuplicatePipe(NewBasicPipe(), 1, delay, 1)
+	defer pipe.Close()
+
+	start := time.Now()
+	err := pipe.Send(pkt)
+	testing_utils.UnexpectedError(err, "sending", t)
+	rcvd, err := pipe.Recv()
+	testing_utils.UnexpectedError(err, "recving", t)
+	if rcvd != pkt {
+		t.Fatalf("Expected the original packet first. Got %v expected %v", rcvd, pkt)
+	}
+	// Mutating the original must not corrupt the duplicate
+	pkt.Payload[0] = 'X'
+	pkt.Payload = pkt.Payload[1:]
+
+	dup, err := pipe.Recv()
+	testing_utils.UnexpectedError(err, "recving", t)
+	if elapsed := time.Since(start); elapsed < delay {
+		t.Fatalf("Expected duplicate after %v got it after %v", delay, elapsed)
+	}
+	if dup == pkt || dup.Seq != 7 || string(dup.Payload) != "payload" {
+		t.Fatalf("Expected an unmodified copy of the original packet. Got %v", dup)
+	}
+}
+
+func TestClosingDuplicatePipeDeliversPendingDuplicates(t *testing.T) {
+	pipe := NewDuplicatePipe(NewBasicPipe(), 1, time.Millisecond*10, 1)
+	err := pipe.Send(&packet.Packet{})
+	testing_utils.UnexpectedError(err, "sending", t)
+	err = pipe.Close()
+	testing_utils.UnexpectedError(err, "closing", t)
+	for i := 0; i != 2; i++ {
+		_, err := pipe.Recv()
+		testing_utils.UnexpectedError(err, "recving", t)
+	}
+	if _, err := pipe.Recv(); err == nil {
+		t.Fatalf("Expected an error after receiving all packets from a closed pipe")
+	}
+}
+
+func TestClosedDuplicatePipeWaitsForDuplicatesWithoutSpinning(t *testing.T) {
+	testClosedPipeWaitsWithoutSpinning(func() Pipe {
+		return NewDuplicatePipe(NewBasicPipe(), 1, time.Millisecond*300, 1)
+	}, t)
+}
@@ -0,0 +1,68 @@
+package pipe
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+/*
+ * A 'Distribution' generates random variations in latency.
+ */
+type Distribution interface {
+	/*
+	 * Returns a random duration to add to a packet's latency. The duration may
+	 * be negative.
+	 */
+	Sample(r *rand.Rand) time.Duration
+}
+
+type uniformDistribution struct {
+	max time.Duration
+}
+
+func (d uniformDistribution) Sample(r *rand.Rand) time.Duration {
+	return time.Duration((r.Float64()*2 - 1) * float64(d.max))
+}
+
+/*
+ * Returns a distribution that is uniform between -max and max
+ */
+func UniformJitter(max time.Duration) Distribution {
+	return uniformDistribution{max}
+}
+
+type normalDistribution struct {
+	stddev time.Duration
+}
+
+func (d normalDistribution) Sample(r *rand.Rand) time.Duration {
+	return time.Duration(r.NormFloat64() * float64(d.stddev))
+}
+
+/*
+ * Returns a normal distribution with a mean of zero and the given standard
+ * deviation
+ */
+func NormalJitter(stddev time.Duration) Distribution {
+	return normalDistribution{stddev}
+}
+
+type paretoDistribution struct {
+	scale time.Duration
+	shape float64
+}
+
+func (d paretoDistribution) Sample(r *rand.Rand) time.Duration {
+	// 1-Float64() is in (0, 1] so the power is always finite
+	return time.Duration(float64(d.scale) * (math.Pow(1-r.Float64(), -1/d.shape) - 1))
+}
+
+/*
+ * Returns a heavy tailed (Pareto type II) distribution that only adds latency.
+ * Most samples are close to zero but a few are many times the scale. Smaller
+ * shapes give heavier tails.
+ */
+func ParetoJitter(scale time.Duration, shape float64) Distribution {
+	return paretoDistribution{scale, shape}
+}
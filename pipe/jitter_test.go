@@ -0,0 +1,54 @@
+package pipe
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestUniformJitterIsWithinBounds(t *testing.T) {
+	const max = time.Millisecond * 10
+	random := rand.New(rand.NewSource(1))
+	jitter := UniformJitter(max)
+	for i := 0; i != 1000; i++ {
+		if sample := jitter.Sample(random); sample < -max || sample > max {
+			t.Fatalf("Uniform jitter %v isn't within +/-%v", sample, max)
+		}
+	}
+}
+
+func TestNormalJitterHasExpectedDeviation(t *testing.T) {
+	const stddev = time.Millisecond * 10
+	const count = 10000
+	random := rand.New(rand.NewSource(1))
+	jitter := NormalJitter(stddev)
+	within := 0
+	for i := 0; i != count; i++ {
+		if sample := jitter.Sample(random); sample >= -stddev && sample <= stddev {
+			within++
+		}
+	}
+	// About 68% of samples should be within one standard deviation
+	if within < count*64/100 || within > count*72/100 {
+		t.Fatalf("Expected about 68%% of samples within %v got %v of %v", stddev, within, count)
+	}
+}
+
+func TestParetoJitterOnlyAddsLatency(t *testing.T) {
+	const scale = time.Millisecond * 10
+	random := rand.New(rand.NewSource(1))
+	jitter := ParetoJitter(scale, 1.5)
+	var max time.Duration
+	for i := 0; i != 1000; i++ {
+		sample := jitter.Sample(random)
+		if sample < 0 {
+			t.Fatalf("Pareto jitter %v is negative", sample)
+		}
+		if sample > max {
+			max = sample
+		}
+	}
+	if max < scale*5 {
+		t.Fatalf("Expected a heavy tail but the largest sample was %v", max)
+	}
+}
@@ -1,20 +1,27 @@
 package pipe
 
 import (
-	"container/list"
+	"container/heap"
 	"errors"
+	"math/rand"
+	"sync"
 	"time"
 
 	"github.com/efarrer/evilproxy/packet"
 )
 
 /*
- * A latentPipe is a pipe that simulates latency
+ * A latentPipe is a pipe that simulates latency, optionally with jitter
  */
 type latentPipe struct {
 	inputChan chan *latentPacket
 	basePipe  Pipe
+	mutex     sync.Mutex
 	latency   time.Duration
+	jitter    Distribution
+	reorder   bool
+	// Held while sending to or closing inputChan
+	sendMutex sync.Mutex
 	closed    bool
 }
 
@@ -24,16 +31,52 @@ type latentPipe struct {
 type latentPacket struct {
 	packet      *packet.Packet
 	arrivalTime time.Time
+	// The order the packet was sent in, used to keep packets that arrive at
+	// the same time in order
+	sequence int64
+}
+
+/*
+ * A heap of latent packets ordered by arrival time
+ */
+type latentPackets []*latentPacket
+
+func (lps latentPackets) Len() int {
+	return len(lps)
+}
+
+func (lps latentPackets) Less(i, j int) bool {
+	if lps[i].arrivalTime.Equal(lps[j].arrivalTime) {
+		return lps[i].sequence < lps[j].sequence
+	}
+	return lps[i].arrivalTime.Before(lps[j].arrivalTime)
+}
+
+func (lps latentPackets) Swap(i, j int) {
+	lps[i], lps[j] = lps[j], lps[i]
+}
+
+func (lps *latentPackets) Push(x interface{}) {
+	*lps = append(*lps, x.(*latentPacket))
+}
+
+func (lps *latentPackets) Pop() interface{} {
+	old := *lps
+	lp := old[len(old)-1]
+	*lps = old[:len(old)-1]
+	return lp
 }
 
 /*
  * Send a packet over a latent pipe
  */
 func (lp *latentPipe) Send(p *packet.Packet) error {
+	lp.sendMutex.Lock()
+	defer lp.sendMutex.Unlock()
 	if lp.closed {
 		return errors.New("Sending on a closed latent pipe.\n")
 	}
-	lp.inputChan <- &latentPacket{p, time.Now().Add(lp.latency)}
+	lp.inputChan <- &latentPacket{p, time.Now(), 0}
 	return nil
 }
 
@@ -48,6 +91,8 @@ func (lp *latentPipe) Recv() (*packet.Packet, error) {
  * Close the latent pipe
  */
 func (lp *latentPipe) Close() error {
+	lp.sendMutex.Lock()
+	defer lp.sendMutex.Unlock()
 	if lp.closed {
 		return errors.New("Closing a closed latent pipe.\n")
 	}
@@ -56,73 +101,116 @@ func (lp *latentPipe) Close() error {
 	return nil
 }
 
+/*
+ * Sets the latency of packets sent from now on
+ */
+func (lp *latentPipe) SetLatency(latency time.Duration) {
+	lp.mutex.Lock()
+	defer lp.mutex.Unlock()
+	lp.latency = latency
+}
+
 /*
  * Constructs a new latent pipe, with the given latency
  */
 func NewLatentPipe(p Pipe, latency time.Duration) Pipe {
-	lp := &latentPipe{make(chan *latentPacket), p, latency, false}
+	return NewJitteryLatentPipe(p, latency, nil, false, 0)
+}
+
+/*
+ * Constructs a new latent pipe, with the given latency plus a random jitter
+ * drawn from the distribution for each packet. The total delay of a packet is
+ * never less than zero.
+ *
+ * If reorder is true packets are delivered in the order they arrive, so a
+ * packet with a small jitter can overtake an earlier packet with a large one.
+ * Otherwise a packet is held until all earlier packets have been delivered, so
+ * order is kept at the expense of additional latency.
+ *
+ * Pipes constructed with the same seed see the same jitter.
+ */
+func NewJitteryLatentPipe(p Pipe, latency time.Duration, jitter Distribution,
+	reorder bool, seed int64) Pipe {
+	lp := &latentPipe{
+		inputChan: make(chan *latentPacket),
+		basePipe:  p,
+		latency:   latency,
+		jitter:    jitter,
+		reorder:   reorder,
+	}
 
 	go func() {
 		var shutdown = false
-		// The next packet on the queue to be sent
-		var timer <-chan time.Time = nil
-		restartTimer := func(lp *latentPacket) {
-			timer = time.After(lp.arrivalTime.Sub(time.Now()))
-		}
+		// Receives the packets to send until the pipe is closed, then it's
+		// nil so we don't busy loop while the packets in transit arrive
+		inputChan := lp.inputChan
+		random := rand.New(rand.NewSource(seed))
 
 		// The packets that are in transit over the latent pipe
-		intransit := list.New()
-		var intransit_head *latentPacket = nil
+		intransit := &latentPackets{}
+		var sequence int64 = 0
+		// The latest arrival time of any packet sent so far
+		var lastArrival time.Time
 
-		// The packets that have arrived and are ready to be recv'd
-		arrived := list.New()
-		var arrived_head *packet.Packet = nil
+		// Fires when the first packet in transit arrives
+		var timer <-chan time.Time = nil
+		restartTimer := func() {
+			if intransit.Len() == 0 {
+				timer = nil
+			} else {
+				timer = time.After((*intransit)[0].arrivalTime.Sub(time.Now()))
+			}
+		}
 
 		for {
-			// If we've been shutdown and the arrived queue is empty then we can
-			// close the basePipe and exit
-			if shutdown &&
-				arrived_head == nil && arrived.Len() == 0 &&
-				intransit_head == nil && intransit.Len() == 0 {
+			// If we've been shutdown and no packets are in transit then we
+			// can close the basePipe and exit
+			if shutdown && intransit.Len() == 0 {
 				lp.basePipe.Close()
 				return
 			}
 
 			select {
 			// We got a new packet to queue
-			case input, ok := <-lp.inputChan:
-				// We've been shutdown so make sure the other channel is also
-				// closed then exit
+			case input, ok := <-inputChan:
+				// We've been shutdown, but we need to wait for packets that are
+				// in transit to arrive, so just set a flag for now.
 				if !ok {
 					shutdown = true
+					inputChan = nil
 					continue
 				}
 
-				// If this is the first packet then start the timer
-				if nil == intransit_head {
-					intransit_head = input
-					restartTimer(input)
-				} else { // Push this packet on the end of the intransit list
-					intransit.PushBack(input)
+				lp.mutex.Lock()
+				delay := lp.latency
+				lp.mutex.Unlock()
+				if lp.jitter != nil {
+					delay += lp.jitter.Sample(random)
+				}
+				if delay < 0 {
+					delay = 0
 				}
+				input.arrivalTime = input.arrivalTime.Add(delay)
+				if !lp.reorder && input.arrivalTime.Before(lastArrival) {
+					input.arrivalTime = lastArrival
+				}
+				if input.arrivalTime.After(lastArrival) {
+					lastArrival = input.arrivalTime
+				}
+				input.sequence = sequence
+				sequence++
 
-			// The head packet is ready to deliver
+				heap.Push(intransit, input)
+				restartTimer()
+
+			// The first packet in transit has arrived
 			case <-timer:
-				// Push this packet to the base pipe
-				lp.basePipe.Send(intransit_head.packet)
-
-				// Since we no longer have any packets in transit disable the
-				// timer
-				if intransit.Len() == 0 {
-					timer = nil
-					intransit_head = nil
-				} else {
-					elm := intransit.Front()
-					intransit.Remove(elm)
-					intransit_head = elm.Value.(*latentPacket)
-					restartTimer(intransit_head)
+				// Push all the arrived packets to the base pipe
+				now := time.Now()
+				for intransit.Len() != 0 && !(*intransit)[0].arrivalTime.After(now) {
+					lp.basePipe.Send(heap.Pop(intransit).(*latentPacket).packet)
 				}
-
+				restartTimer()
 			}
 		}
 	}()
@@ -31,6 +31,12 @@ func TestLatentPipeDelaysPackets(t *testing.T) {
 	}
 }
 
+func TestClosedLatentPipeWaitsForPacketsInTransitWithoutSpinning(t *testing.T) {
+	testClosedPipeWaitsWithoutSpinning(func() Pipe {
+		return NewJitteryLatentPipe(NewBasicPipe(), time.Millisecond*300, UniformJitter(time.Millisecond*10), false, 1)
+	}, t)
+}
+
 func TestLatentPipeWontDelayIfNoDelay(t *testing.T) {
 	pkt := packet.Packet{}
 	pipe := NewLatentPipe(NewBasicPipe(), time.Millisecond*0)
@@ -47,3 +53,63 @@ func TestLatentPipeWontDelayIfNoDelay(t *testing.T) {
 		t.Fatalf("Didn't get expected packet from latent pipe. Got %v expected %v", rcvd, pkt)
 	}
 }
+
+func TestPipeBehaviorForJitteryLatentPipe(t *testing.T) {
+	PerformPipeTests(func() Pipe {
+		return NewJitteryLatentPipe(NewBasicPipe(), 0, UniformJitter(time.Millisecond), false, 1)
+	}, t)
+}
+
+/*
+ * Sends count packets over the pipe and returns how many were received before
+ * a packet that was sent earlier
+ */
+func countReordered(pipe Pipe, count int, t *testing.T) int {
+	pkts := map[*packet.Packet]int{}
+	for i := 0; i != count; i++ {
+		pkt := &packet.Packet{}
+		pkts[pkt] = i
+		err := pipe.Send(pkt)
+		testing_utils.UnexpectedError(err, "sending", t)
+	}
+	reordered := 0
+	last := -1
+	for i := 0; i != count; i++ {
+		pkt, err := pipe.Recv()
+		testing_utils.UnexpectedError(err, "recving", t)
+		if pkts[pkt] < last {
+			reordered++
+		} else {
+			last = pkts[pkt]
+		}
+	}
+	return reordered
+}
+
+func TestJitteryLatentPipeKeepsOrderIfReorderingIsDisabled(t *testing.T) {
+	pipe := NewJitteryLatentPipe(NewBasicPipe(), time.Millisecond*20,
+		UniformJitter(time.Millisecond*20), false, 1)
+	defer pipe.Close()
+	if reordered := countReordered(pipe, 50, t); reordered != 0 {
+		t.Fatalf("Expected no reordered packets got %v", reordered)
+	}
+}
+
+func TestJitteryLatentPipeReordersIfReorderingIsEnabled(t *testing.T) {
+	pipe := NewJitteryLatentPipe(NewBasicPipe(), time.Millisecond*20,
+		UniformJitter(time.Millisecond*20), true, 1)
+	defer pipe.Close()
+	if reordered := countReordered(pipe, 50, t); reordered == 0 {
+		t.Fatalf("Expected some reordered packets")
+	}
+}
+
+func TestLatentPipeLatencyCanBeTuned(t *testing.T) {
+	const delay = 100 * time.Millisecond
+	pipe := NewLatentPipe(NewBasicPipe(), 0)
+	defer pipe.Close()
+	pipe.(LatencyTuner).SetLatency(delay)
+	if elapsed := timeSend(pipe, t); elapsed < delay {
+		t.Fatalf("Expected tuned latency of %v got %v", delay, elapsed)
+	}
+}
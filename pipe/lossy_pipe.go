@@ -0,0 +1,148 @@
+package pipe
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+
+	"github.com/efarrer/evilproxy/packet"
+)
+
+/*
+ * A 'LossyPipe' is a 'Pipe' that drops some of the packets sent over it.
+ */
+type LossyPipe interface {
+	Pipe
+
+	/*
+	 * Returns the number of packets that have been dropped
+	 */
+	Dropped() int64
+}
+
+/*
+ * The parameters of a Gilbert-Elliott burst loss model. The model is a two
+ * state Markov chain. Before each packet the model moves from the good state
+ * to the bad state with probability P, or from the bad state to the good state
+ * with probability R. The packet is then lost with probability GoodLoss or
+ * BadLoss depending on the state.
+ */
+type GilbertElliott struct {
+	P        float64
+	R        float64
+	GoodLoss float64
+	BadLoss  float64
+}
+
+/*
+ * A lossyPipe is a pipe that simulates packet loss
+ */
+type lossyPipe struct {
+	mutex    sync.Mutex
+	basePipe Pipe
+	model    GilbertElliott
+	rand     *rand.Rand
+	bad      bool
+	dropped  int64
+	closed   bool
+}
+
+/*
+ * Returns true if the next packet should be lost. Must be called with the
+ * mutex held.
+ */
+func (lp *lossyPipe) lose() bool {
+	if lp.bad {
+		lp.bad = lp.rand.Float64() >= lp.model.R
+	} else {
+		lp.bad = lp.rand.Float64() < lp.model.P
+	}
+	loss := lp.model.GoodLoss
+	if lp.bad {
+		loss = lp.model.BadLoss
+	}
+	return lp.rand.Float64() < loss
+}
+
+/*
+ * Send a packet over a lossy pipe
+ */
+func (lp *lossyPipe) Send(p *packet.Packet) error {
+	lp.mutex.Lock()
+	if lp.closed {
+		lp.mutex.Unlock()
+		return errors.New("Sending on a closed lossy pipe.\n")
+	}
+	lost := lp.lose()
+	if lost {
+		lp.dropped++
+	}
+	lp.mutex.Unlock()
+
+	if lost {
+		return nil
+	}
+	return lp.basePipe.Send(p)
+}
+
+/*
+ * Receive a packet from the lossy pipe
+ */
+func (lp *lossyPipe) Recv() (*packet.Packet, error) {
+	return lp.basePipe.Recv()
+}
+
+/*
+ * Close the lossy pipe
+ */
+func (lp *lossyPipe) Close() error {
+	lp.mutex.Lock()
+	defer lp.mutex.Unlock()
+	if lp.closed {
+		return errors.New("Closing a closed lossy pipe.\n")
+	}
+	lp.closed = true
+	return lp.basePipe.Close()
+}
+
+/*
+ * Sets the probability that each packet is dropped. This replaces a burst
+ * loss model with independent loss.
+ */
+func (lp *lossyPipe) SetLossProbability(probability float64) {
+	lp.mutex.Lock()
+	defer lp.mutex.Unlock()
+	lp.model = GilbertElliott{GoodLoss: probability}
+	lp.bad = false
+}
+
+/*
+ * Returns the number of packets that have been dropped
+ */
+func (lp *lossyPipe) Dropped() int64 {
+	lp.mutex.Lock()
+	defer lp.mutex.Unlock()
+	return lp.dropped
+}
+
+/*
+ * Constructs a new lossy pipe that independently drops each packet with the
+ * given probability. Pipes constructed with the same seed drop the same
+ * packets.
+ */
+func NewLossyPipe(p Pipe, probability float64, seed int64) LossyPipe {
+	return NewGilbertElliottPipe(p, GilbertElliott{GoodLoss: probability}, seed)
+}
+
+/*
+ * Constructs a new lossy pipe that drops packets in bursts according to the
+ * Gilbert-Elliott model. The model starts in the good state. Pipes constructed
+ * with the same seed drop the same packets.
+ */
+func NewGilbertElliottPipe(p Pipe, model GilbertElliott, seed int64) LossyPipe {
+	return &lossyPipe{
+		basePipe: p,
+		model:    model,
+		rand:     rand.New(rand.NewSource(seed)),
+	}
+}
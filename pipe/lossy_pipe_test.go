@@ -0,0 +1,105 @@
+package pipe
+
+import (
+	"testing"
+
+	"github.com/efarrer/evilproxy/packet"
+	"github.com/efarrer/evilproxy/testing_utils"
+)
+
+func TestPipeBehaviorForLossyPipe(t *testing.T) {
+	PerformPipeTests(func() Pipe { return NewLossyPipe(NewBasicPipe(), 0, 1) }, t)
+}
+
+func TestPipeBehaviorForGilbertElliottPipe(t *testing.T) {
+	PerformPipeTests(func() Pipe {
+		return NewGilbertElliottPipe(NewBasicPipe(), GilbertElliott{P: 0, R: 1, BadLoss: 1}, 1)
+	}, t)
+}
+
+/*
+ * Sends count packets over the pipe and returns the indexes of the packets that
+ * were delivered
+ */
+func deliveredIndexes(pipe LossyPipe, count int, t *testing.T) []int {
+	pkts := map[*packet.Packet]int{}
+	for i := 0; i != count; i++ {
+		pkt := &packet.Packet{}
+		pkts[pkt] = i
+		err := pipe.Send(pkt)
+		testing_utils.UnexpectedError(err, "sending", t)
+	}
+	defer pipe.Close()
+
+	delivered := []int{}
+	for i := int64(0); i != int64(count)-pipe.Dropped(); i++ {
+		pkt, err := pipe.Recv()
+		testing_utils.UnexpectedError(err, "recving", t)
+		delivered = append(delivered, pkts[pkt])
+	}
+	return delivered
+}
+
+func TestLossyPipeDropsAllPacketsWithCertainLoss(t *testing.T) {
+	const count = 10
+	pipe := NewLossyPipe(NewBasicPipe(), 1, 1)
+	delivered := deliveredIndexes(pipe, count, t)
+	if len(delivered) != 0 {
+		t.Fatalf("Expected all packets to be dropped but %v were delivered", len(delivered))
+	}
+	if pipe.Dropped() != count {
+		t.Fatalf("Expected %v dropped packets got %v", count, pipe.Dropped())
+	}
+}
+
+func TestLossyPipeCountsDroppedPackets(t *testing.T) {
+	const count = 1000
+	pipe := NewLossyPipe(NewBasicPipe(), 0.25, 1)
+	delivered := deliveredIndexes(pipe, count, t)
+	if len(delivered) < 700 || len(delivered) > 800 {
+		t.Fatalf("Expected about 750 delivered packets got %v", len(delivered))
+	}
+	if pipe.Dropped() < 200 || pipe.Dropped() > 300 {
+		t.Fatalf("Expected about 250 dropped packets got %v", pipe.Dropped())
+	}
+}
+
+func TestLossyPipesWithTheSameSeedDropTheSamePackets(t *testing.T) {
+	const count = 100
+	model := GilbertElliott{P: 0.1, R: 0.3, GoodLoss: 0.05, BadLoss: 0.8}
+	delivered0 := deliveredIndexes(NewGilbertElliottPipe(NewBasicPipe(), model, 42), count, t)
+	delivered1 := deliveredIndexes(NewGilbertElliottPipe(NewBasicPipe(), model, 42), count, t)
+	if len(delivered0) != len(delivered1) {
+		t.Fatalf("Expected the same packets to be delivered. Got %v and %v", delivered0, delivered1)
+	}
+	for i := range delivered0 {
+		if delivered0[i] != delivered1[i] {
+			t.Fatalf("Expected the same packets to be delivered. Got %v and %v", delivered0, delivered1)
+		}
+	}
+}
+
+func TestGilbertElliottPipeDropsInBursts(t *testing.T) {
+	const count = 1000
+	// Alternate between the good state and the bad state on every packet
+	model := GilbertElliott{P: 1, R: 1, GoodLoss: 0, BadLoss: 1}
+	pipe := NewGilbertElliottPipe(NewBasicPipe(), model, 1)
+	delivered := deliveredIndexes(pipe, count, t)
+	for i, index := range delivered {
+		if index != i*2+1 {
+			t.Fatalf("Expected every other packet to be delivered. Got %v", delivered)
+		}
+	}
+	if pipe.Dropped() != count/2 {
+		t.Fatalf("Expected %v dropped packets got %v", count/2, pipe.Dropped())
+	}
+}
+
+func TestLossyPipeLossCanBeTuned(t *testing.T) {
+	const count = 10
+	pipe := NewGilbertElliottPipe(NewBasicPipe(), GilbertElliott{P: 0, R: 1, BadLoss: 1}, 1)
+	pipe.(LossTuner).SetLossProbability(1)
+	if delivered := deliveredIndexes(pipe, count, t); len(delivered) != 0 {
+		t.Fatalf("Expected all packets to be dropped but %v were delivered", len(delivered))
+	}
+}
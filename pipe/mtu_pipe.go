@@ -0,0 +1,161 @@
+package pipe
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/efarrer/evilproxy/packet"
+)
+
+/*
+ * An mtuPipe is a pipe that limits the payload of the packets it forwards to a
+ * maximum transmission unit. Larger packets are split into fragments. It can
+ * also coalesce small packets, waiting up to a delay for more data before
+ * forwarding them, much like Nagle's algorithm.
+ */
+type mtuPipe struct {
+	inputChan chan *packet.Packet
+	basePipe  Pipe
+	// Held while sending to or closing inputChan
+	sendMutex sync.Mutex
+	closed    bool
+}
+
+/*
+ * Send a packet over an mtu pipe
+ */
+func (mp *mtuPipe) Send(p *packet.Packet) error {
+	mp.sendMutex.Lock()
+	defer mp.sendMutex.Unlock()
+	if mp.closed {
+		return errors.New("Sending on a closed mtu pipe.\n")
+	}
+	mp.inputChan <- p
+	return nil
+}
+
+/*
+ * Receive a packet from the mtu pipe
+ */
+func (mp *mtuPipe) Recv() (*packet.Packet, error) {
+	return mp.basePipe.Recv()
+}
+
+/*
+ * Close the mtu pipe
+ */
+func (mp *mtuPipe) Close() error {
+	mp.sendMutex.Lock()
+	defer mp.sendMutex.Unlock()
+	if mp.closed {
+		return errors.New("Closing a closed mtu pipe.\n")
+	}
+	close(mp.inputChan)
+	mp.closed = true
+	return nil
+}
+
+/*
+ * Splits the packet into fragments with at most mtu bytes of payload
+ */
+func fragment(p *packet.Packet, mtu int) []*packet.Packet {
+	if len(p.Payload) <= mtu {
+		return []*packet.Packet{p}
+	}
+	fragments := []*packet.Packet{}
+	for offset := 0; offset < len(p.Payload); offset += mtu {
+		end := offset + mtu
+		if end > len(p.Payload) {
+			end = len(p.Payload)
+		}
+		fragments = append(fragments, p.Fragment(offset, end))
+	}
+	return fragments
+}
+
+/*
+ * Constructs a new mtu pipe that fragments packets larger than mtu
+ */
+func NewMTUPipe(p Pipe, mtu int) Pipe {
+	return NewCoalescingMTUPipe(p, mtu, 0)
+}
+
+/*
+ * Constructs a new mtu pipe that fragments packets larger than mtu, and
+ * coalesces packets smaller than mtu. A packet waits up to delay for later
+ * packets to fill it. Only packets that can be joined are coalesced, and a
+ * packet is only coalesced into the pending packet if it continues it, see
+ * packet.Continues. A delay of zero disables coalescing.
+ */
+func NewCoalescingMTUPipe(p Pipe, mtu int, delay time.Duration) Pipe {
+	mp := &mtuPipe{inputChan: make(chan *packet.Packet), basePipe: p}
+
+	go func() {
+		// The packet that later packets are being coalesced into
+		var pending *packet.Packet = nil
+		// True if pending is a copy that can be appended to
+		var pendingCopied = false
+
+		// Fires when the pending packet has waited long enough
+		var timer <-chan time.Time = nil
+
+		flush := func() {
+			if pending != nil {
+				mp.basePipe.Send(pending)
+			}
+			pending = nil
+			timer = nil
+		}
+
+		for {
+			select {
+			// We got a new packet to forward
+			case input, ok := <-mp.inputChan:
+				// We've been shutdown so forward the pending packet, close the
+				// basePipe and exit
+				if !ok {
+					flush()
+					mp.basePipe.Close()
+					return
+				}
+
+				coalescable := delay > 0 && input.Joinable()
+				if pending != nil {
+					if coalescable && pending.Continues(input) &&
+						len(pending.Payload)+len(input.Payload) <= mtu {
+						if !pendingCopied {
+							pending = pending.Clone()
+							pendingCopied = true
+						}
+						pending.Join(input)
+						if len(pending.Payload) == mtu {
+							flush()
+						}
+						continue
+					}
+					flush()
+				}
+
+				fragments := fragment(input, mtu)
+				for _, frag := range fragments[:len(fragments)-1] {
+					mp.basePipe.Send(frag)
+				}
+				last := fragments[len(fragments)-1]
+				if coalescable && len(last.Payload) < mtu {
+					pending = last
+					pendingCopied = false
+					timer = time.After(delay)
+				} else {
+					mp.basePipe.Send(last)
+				}
+
+			// The pending packet has waited long enough
+			case <-timer:
+				flush()
+			}
+		}
+	}()
+
+	return mp
+}
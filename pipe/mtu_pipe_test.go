@@ -0,0 +1,182 @@
+package pipe
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/efarrer/evilproxy/packet"
+	"github.com/efarrer/evilproxy/testing_utils"
+)
+
+func TestPipeBehaviorForMTUPipe(t *testing.T) {
+	PerformPipeTests(func() Pipe { return NewMTUPipe(NewBasicPipe(), 10) }, t)
+}
+
+/*
+ * Receives count packets from the pipe
+ */
+func recvPackets(pipe Pipe, count int, t *testing.T) []*packet.Packet {
+	pkts := []*packet.Packet{}
+	for i := 0; i != count; i++ {
+		pkt, err := pipe.Recv()
+		testing_utils.UnexpectedError(err, "recving", t)
+		pkts = append(pkts, pkt)
+	}
+	return pkts
+}
+
+func TestMTUPipeFragmentsLargePackets(t *testing.T) {
+	payload := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+	pipe := NewMTUPipe(NewBasicPipe(), 10)
+	defer pipe.Close()
+
+	err := pipe.Send(&packet.Packet{Flags: packet.Syn | packet.Fin, Seq: 100, Payload: payload,
+		Handshake: packet.Header{Flags: packet.Ack, Seq: 500}, Reliable: packet.Header{Seq: 900}})
+	testing_utils.UnexpectedError(err, "sending", t)
+	frags := recvPackets(pipe, 4, t)
+
+	reassembled := []byte{}
+	for i, frag := range frags {
+		if len(frag.Payload) > 10 {
+			t.Fatalf("Fragment %v has %v bytes which exceeds the mtu", i, len(frag.Payload))
+		}
+		if frag.Seq != int64(100+len(reassembled)) {
+			t.Fatalf("Fragment %v has Seq %v expected %v", i, frag.Seq, 100+len(reassembled))
+		}
+		if frag.Handshake.Seq != int64(500+len(reassembled)) {
+			t.Fatalf("Fragment %v has handshake Seq %v expected %v", i, frag.Handshake.Seq, 500+len(reassembled))
+		}
+		if frag.Reliable.Seq != int64(900+len(reassembled)) || frag.FlowControl.Seq != 0 {
+			t.Fatalf("Fragment %v has reliable Seq %v and flow control Seq %v expected %v and 0",
+				i, frag.Reliable.Seq, frag.FlowControl.Seq, 900+len(reassembled))
+		}
+		if (frag.Flags&packet.Syn != 0) != (i == 0) {
+			t.Fatalf("Expected only the first fragment to have Syn")
+		}
+		if (frag.Flags&packet.Fin != 0) != (i == len(frags)-1) {
+			t.Fatalf("Expected only the last fragment to have Fin")
+		}
+		reassembled = append(reassembled, frag.Payload...)
+	}
+	if !bytes.Equal(reassembled, payload) {
+		t.Fatalf("Fragments reassembled to %q expected %q", reassembled, payload)
+	}
+}
+
+func TestCoalescingMTUPipeCoalescesSmallPackets(t *testing.T) {
+	pipe := NewCoalescingMTUPipe(NewBasicPipe(), 10, time.Second)
+	defer pipe.Close()
+
+	for _, payload := range []string{"abc", "def", "ghij", "klm"} {
+		err := pipe.Send(&packet.Packet{Ack: int64(len(payload)), Payload: []byte(payload)})
+		testing_utils.UnexpectedError(err, "sending", t)
+	}
+	// The first three packets fill the mtu so they're forwarded without delay
+	start := time.Now()
+	pkts := recvPackets(pipe, 1, t)
+	if string(pkts[0].Payload) != "abcdefghij" || pkts[0].Ack != 4 {
+		t.Fatalf("Expected coalesced packet \"abcdefghij\" with Ack 4 got %q with Ack %v",
+			pkts[0].Payload, pkts[0].Ack)
+	}
+	if elapsed := time.Since(start); elapsed > time.Millisecond*500 {
+		t.Fatalf("Expected a full packet to be forwarded immediately, took %v", elapsed)
+	}
+}
+
+func TestCoalescingMTUPipeForwardsPartialPacketAfterDelay(t *testing.T) {
+	const delay = time.Millisecond * 50
+	pipe := NewCoalescingMTUPipe(NewBasicPipe(), 10, delay)
+	defer pipe.Close()
+
+	start := time.Now()
+	for _, payload := range []string{"abc", "def"} {
+		err := pipe.Send(&packet.Packet{Payload: []byte(payload)})
+		testing_utils.UnexpectedError(err, "sending", t)
+	}
+	pkts := recvPackets(pipe, 1, t)
+	if string(pkts[0].Payload) != "abcdef" {
+		t.Fatalf("Expected coalesced packet \"abcdef\" got %q", pkts[0].Payload)
+	}
+	if elapsed := time.Since(start); elapsed < delay {
+		t.Fatalf("Expected partial packet after %v got it after %v", delay, elapsed)
+	}
+}
+
+func TestCoalescingMTUPipeDoesntCoalesceFin(t *testing.T) {
+	pipe := NewCoalescingMTUPipe(NewBasicPipe(), 10, time.Second)
+	fin := &packet.Packet{Flags: packet.Fin}
+	for _, pkt := range []*packet.Packet{{Payload: []byte("abc")}, fin} {
+		err := pipe.Send(pkt)
+		testing_utils.UnexpectedError(err, "sending", t)
+	}
+	err := pipe.Close()
+	testing_utils.UnexpectedError(err, "closing", t)
+
+	pkts := recvPackets(pipe, 2, t)
+	if string(pkts[0].Payload) != "abc" || pkts[1] != fin {
+		t.Fatalf("Expected \"abc\" followed by the Fin packet got %v", pkts)
+	}
+}
+
+func TestCoalescingMTUPipeDoesntCoalesceAFinInAnyHeader(t *testing.T) {
+	pipe := NewCoalescingMTUPipe(NewBasicPipe(), 10, time.Second)
+	fin := &packet.Packet{Reliable: packet.Header{Flags: packet.Fin, Seq: 4}, Payload: []byte("d")}
+	for _, pkt := range []*packet.Packet{{Reliable: packet.Header{Seq: 1}, Payload: []byte("abc")}, fin} {
+		err := pipe.Send(pkt)
+		testing_utils.UnexpectedError(err, "sending", t)
+	}
+	err := pipe.Close()
+	testing_utils.UnexpectedError(err, "closing", t)
+
+	pkts := recvPackets(pipe, 2, t)
+	if string(pkts[0].Payload) != "abc" || pkts[1] != fin {
+		t.Fatalf("Expected \"abc\" followed by the reliable Fin got %v", pkts)
+	}
+}
+
+func TestCoalescingMTUPipeDoesntCoalesceAcks(t *testing.T) {
+	pipe := NewCoalescingMTUPipe(NewBasicPipe(), 10, time.Second)
+	// Duplicate acks must all arrive for the sender to spot a loss
+	for i := 0; i != 3; i++ {
+		err := pipe.Send(&packet.Packet{Reliable: packet.Header{Flags: packet.Ack, Ack: 5}})
+		testing_utils.UnexpectedError(err, "sending", t)
+	}
+	err := pipe.Close()
+	testing_utils.UnexpectedError(err, "closing", t)
+
+	pkts := recvPackets(pipe, 3, t)
+	for _, pkt := range pkts {
+		if pkt.Reliable.Flags != packet.Ack || pkt.Reliable.Ack != 5 {
+			t.Fatalf("Expected each ack on its own got %v", pkts)
+		}
+	}
+}
+
+func TestCoalescingMTUPipeOnlyCoalescesContinuingPackets(t *testing.T) {
+	pipe := NewCoalescingMTUPipe(NewBasicPipe(), 10, time.Second)
+	for _, pkt := range []*packet.Packet{
+		{Seq: 1, Payload: []byte("ab")},
+		{Seq: 3, Payload: []byte("cd")},
+		// An ack doesn't continue the data before it
+		{Flags: packet.Ack, Ack: 5},
+		// A retransmission doesn't continue the data before it
+		{Seq: 1, Payload: []byte("ab")},
+	} {
+		err := pipe.Send(pkt)
+		testing_utils.UnexpectedError(err, "sending", t)
+	}
+	err := pipe.Close()
+	testing_utils.UnexpectedError(err, "closing", t)
+
+	pkts := recvPackets(pipe, 3, t)
+	if string(pkts[0].Payload) != "abcd" || pkts[0].Seq != 1 {
+		t.Fatalf("Expected \"abcd\" with Seq 1 got %q with Seq %v", pkts[0].Payload, pkts[0].Seq)
+	}
+	if pkts[1].Flags != packet.Ack || len(pkts[1].Payload) != 0 {
+		t.Fatalf("Expected the ack on its own got %v", pkts[1])
+	}
+	if string(pkts[2].Payload) != "ab" || pkts[2].Seq != 1 {
+		t.Fatalf("Expected the retransmission on its own got %v", pkts[2])
+	}
+}
@@ -0,0 +1,144 @@
+package pipe
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/efarrer/evilproxy/packet"
+)
+
+/*
+ * How a partition pipe treats the packets sent over it
+ */
+type PartitionMode int
+
+const (
+	// Packets are delivered normally
+	PartitionNone PartitionMode = iota
+	// Packets are silently discarded
+	PartitionBlackhole
+	// Packets are queued and delivered once the partition ends
+	PartitionStall
+	// Sending a packet returns an error
+	PartitionReject
+)
+
+func (mode PartitionMode) String() string {
+	switch mode {
+	case PartitionNone:
+		return "none"
+	case PartitionBlackhole:
+		return "blackhole"
+	case PartitionStall:
+		return "stall"
+	case PartitionReject:
+		return "reject"
+	}
+	return fmt.Sprintf("PartitionMode(%d)", int(mode))
+}
+
+/*
+ * A 'PartitionPipe' is a 'Pipe' that can be cut off from the network and
+ * reconnected while it is in use.
+ */
+type PartitionPipe interface {
+	Pipe
+
+	/*
+	 * Changes how packets sent from now on are treated. Packets queued while
+	 * stalled are delivered when the mode changes to PartitionNone and are
+	 * discarded when it changes to PartitionBlackhole or PartitionReject.
+	 */
+	SetMode(mode PartitionMode)
+
+	/*
+	 * Returns the current mode
+	 */
+	Mode() PartitionMode
+}
+
+/*
+ * A partitionPipe is a pipe that simulates a network partition
+ */
+type partitionPipe struct {
+	mutex    sync.Mutex
+	basePipe Pipe
+	mode     PartitionMode
+	stalled  []*packet.Packet
+	closed   bool
+}
+
+/*
+ * Send a packet over a partition pipe
+ */
+func (pp *partitionPipe) Send(p *packet.Packet) error {
+	pp.mutex.Lock()
+	defer pp.mutex.Unlock()
+	if pp.closed {
+		return errors.New("Sending on a closed partition pipe.\n")
+	}
+	switch pp.mode {
+	case PartitionBlackhole:
+		return nil
+	case PartitionStall:
+		pp.stalled = append(pp.stalled, p)
+		return nil
+	case PartitionReject:
+		return errors.New("Sending on a rejecting partition pipe.\n")
+	}
+	return pp.basePipe.Send(p)
+}
+
+/*
+ * Receive a packet from the partition pipe
+ */
+func (pp *partitionPipe) Recv() (*packet.Packet, error) {
+	return pp.basePipe.Recv()
+}
+
+/*
+ * Close the partition pipe. Packets that are stalled are never delivered.
+ */
+func (pp *partitionPipe) Close() error {
+	pp.mutex.Lock()
+	defer pp.mutex.Unlock()
+	if pp.closed {
+		return errors.New("Closing a closed partition pipe.\n")
+	}
+	pp.closed = true
+	pp.stalled = nil
+	return pp.basePipe.Close()
+}
+
+func (pp *partitionPipe) SetMode(mode PartitionMode) {
+	pp.mutex.Lock()
+	defer pp.mutex.Unlock()
+	pp.mode = mode
+	switch mode {
+	case PartitionNone:
+		// The mutex is held so the stalled packets are delivered before any
+		// packet sent after the partition ends
+		if !pp.closed {
+			for _, p := range pp.stalled {
+				pp.basePipe.Send(p)
+			}
+		}
+		pp.stalled = nil
+	case PartitionBlackhole, PartitionReject:
+		pp.stalled = nil
+	}
+}
+
+func (pp *partitionPipe) Mode() PartitionMode {
+	pp.mutex.Lock()
+	defer pp.mutex.Unlock()
+	return pp.mode
+}
+
+/*
+ * Constructs a new partition pipe in the given mode
+ */
+func NewPartitionPipe(p Pipe, mode PartitionMode) PartitionPipe {
+	return &partitionPipe{basePipe: p, mode: mode}
+}
@@ -0,0 +1,126 @@
+package pipe
+
+import (
+	"testing"
+	"time"
+
+	"github.com/efarrer/evilproxy/packet"
+	"github.com/efarrer/evilproxy/testing_utils"
+)
+
+func TestPipeBehaviorForPartitionPipe(t *testing.T) {
+	PerformPipeTests(func() Pipe { return NewPartitionPipe(NewBasicPipe(), PartitionNone) }, t)
+}
+
+/*
+ * Fails the test if a packet can be received from the pipe within the timeout
+ */
+func expectNothingDelivered(pipe Pipe, timeout time.Duration, t *testing.T) {
+	rcvd := make(chan *packet.Packet, 1)
+	go func() {
+		pkt, err := pipe.Recv()
+		if err == nil {
+			rcvd <- pkt
+		}
+	}()
+	select {
+	case pkt := <-rcvd:
+		t.Fatalf("Expected no packet to be delivered got %v", pkt)
+	case <-time.After(timeout):
+	}
+}
+
+func TestPartitionPipeBlackholeDiscardsPackets(t *testing.T) {
+	pipe := NewPartitionPipe(NewBasicPipe(), PartitionBlackhole)
+	defer pipe.Close()
+	err := pipe.Send(&packet.Packet{})
+	testing_utils.UnexpectedError(err, "sending", t)
+
+	pipe.SetMode(PartitionNone)
+	pkt := &packet.Packet{}
+	err = pipe.Send(pkt)
+	testing_utils.UnexpectedError(err, "sending", t)
+	rcvd, err := pipe.Recv()
+	testing_utils.UnexpectedError(err, "recving", t)
+	if rcvd != pkt {
+		t.Fatalf("Expected the packet sent after the partition got %v", rcvd)
+	}
+}
+
+func TestPartitionPipeStallDeliversQueuedPacketsWhenHealed(t *testing.T) {
+	pipe := NewPartitionPipe(NewBasicPipe(), PartitionStall)
+	defer pipe.Close()
+	pkts := []*packet.Packet{{}, {}, {}}
+	for _, pkt := range pkts[:2] {
+		err := pipe.Send(pkt)
+		testing_utils.UnexpectedError(err, "sending", t)
+	}
+
+	rcvd := make(chan *packet.Packet, len(pkts))
+	go func() {
+		for range pkts {
+			pkt, err := pipe.Recv()
+			if err != nil {
+				return
+			}
+			rcvd <- pkt
+		}
+	}()
+	select {
+	case pkt := <-rcvd:
+		t.Fatalf("Expected no packet to be delivered while stalled got %v", pkt)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	pipe.SetMode(PartitionNone)
+	err := pipe.Send(pkts[2])
+	testing_utils.UnexpectedError(err, "sending", t)
+	for i, pkt := range pkts {
+		if r := <-rcvd; r != pkt {
+			t.Fatalf("Expected packet %v got %v", i, r)
+		}
+	}
+}
+
+func TestPartitionPipeBlackholeDiscardsStalledPackets(t *testing.T) {
+	pipe := NewPartitionPipe(NewBasicPipe(), PartitionStall)
+	defer pipe.Close()
+	err := pipe.Send(&packet.Packet{})
+	testing_utils.UnexpectedError(err, "sending", t)
+	pipe.SetMode(PartitionBlackhole)
+	pipe.SetMode(PartitionNone)
+	expectNothingDelivered(pipe, 50*time.Millisecond, t)
+}
+
+func TestPartitionPipeRejectReturnsAnError(t *testing.T) {
+	pipe := NewPartitionPipe(NewBasicPipe(), PartitionNone)
+	defer pipe.Close()
+	pipe.SetMode(PartitionReject)
+	if pipe.Mode() != PartitionReject {
+		t.Fatalf("Expected mode %v got %v", PartitionReject, pipe.Mode())
+	}
+	if err := pipe.Send(&packet.Packet{}); err == nil {
+		t.Fatalf("Expected an error sending on a rejecting pipe")
+	}
+
+	pipe.SetMode(PartitionNone)
+	pkt := &packet.Packet{}
+	err := pipe.Send(pkt)
+	testing_utils.UnexpectedError(err, "sending", t)
+	rcvd, err := pipe.Recv()
+	testing_utils.UnexpectedError(err, "recving", t)
+	if rcvd != pkt {
+		t.Fatalf("Expected the packet sent after the partition got %v", rcvd)
+	}
+}
+
+func TestPartitionPipeCloseDiscardsStalledPackets(t *testing.T) {
+	pipe := NewPartitionPipe(NewBasicPipe(), PartitionStall)
+	err := pipe.Send(&packet.Packet{})
+	testing_utils.UnexpectedError(err, "sending", t)
+	err = pipe.Close()
+	testing_utils.UnexpectedError(err, "closing", t)
+	if _, err := pipe.Recv(); err == nil {
+		t.Fatalf("Expected an error recving from a closed pipe")
+	}
+}
@@ -1,6 +1,9 @@
 package pipe
 
 import (
+	"math/rand"
+	"runtime"
+	"strings"
 	"testing"
 	"time"
 
@@ -106,6 +109,123 @@ func testClosingAClosedPipeFails(pipeGenerator func() Pipe, t *testing.T) {
 	}
 }
 
+/*
+ * Returns the state, e.g. "select" or "running", of each goroutine started by
+ * the calling goroutine, or by those it started, keyed by id
+ */
+func startedGoroutines() map[string]string {
+	buffer := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buffer, true)
+		if n < len(buffer) {
+			buffer = buffer[:n]
+			break
+		}
+		buffer = make([]byte, 2*len(buffer))
+	}
+
+	// Each stack starts with e.g. "goroutine 12 [select, 2 minutes]:" and
+	// ends with e.g. "created by ...NewBasicPipe in goroutine 6"
+	states := map[string]string{}
+	creators := map[string]string{}
+	stacks := strings.Split(string(buffer), "\n\n")
+	for _, stack := range stacks {
+		header := strings.SplitN(stack, "\n", 2)[0]
+		fields := strings.SplitN(strings.TrimPrefix(header, "goroutine "), " [", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		states[fields[0]] = strings.SplitN(strings.TrimSuffix(fields[1], "]:"), ",", 2)[0]
+		if i := strings.LastIndex(stack, " in goroutine "); i != -1 {
+			creators[fields[0]] = strings.Fields(stack[i+len(" in goroutine "):])[0]
+		} else if strings.Contains(stack, "\ncreated by ") {
+			// Older runtimes don't name the creator, so every goroutine is
+			// taken to be started by the caller
+			creators[fields[0]] = "caller"
+		}
+	}
+
+	// The calling goroutine's stack is listed first
+	started := map[string]string{}
+	self := strings.Fields(stacks[0])[1]
+	for changed := true; changed; {
+		changed = false
+		for id, creator := range creators {
+			if _, ok := started[id]; !ok && (creator == self || creator == "caller" || started[creator] != "") {
+				started[id] = states[id]
+				changed = true
+			}
+		}
+	}
+	return started
+}
+
+/*
+ * Sends a packet over the pipe and closes it, then fails the test if any of
+ * the pipe's goroutines keeps running while the packet waits to be forwarded
+ * or received, rather than blocking. The goroutines' states are sampled from
+ * their stacks so every pipe is checked without help from the pipe. Only the
+ * goroutines started by the test are checked.
+ */
+func testClosedPipeWaitsWithoutSpinning(pipeGenerator func() Pipe, t *testing.T) {
+	before := startedGoroutines()
+	pipe := pipeGenerator()
+	err := pipe.Send(&packet.Packet{Payload: make([]byte, 100)})
+	testing_utils.UnexpectedError(err, "sending", t)
+	err = pipe.Close()
+	testing_utils.UnexpectedError(err, "closing", t)
+
+	// A goroutine that's running or runnable in every sample is spinning. The
+	// samples are taken at irregular intervals so they don't keep landing just
+	// as a timer wakes a goroutine.
+	spinning := startedGoroutines()
+	for id := range before {
+		delete(spinning, id)
+	}
+	for i := 0; i < 10 && len(spinning) != 0; i++ {
+		time.Sleep(time.Duration(5+rand.Intn(10)) * time.Millisecond)
+		states := startedGoroutines()
+		for id := range spinning {
+			if state := states[id]; state != "running" && state != "runnable" {
+				delete(spinning, id)
+			}
+		}
+	}
+	if len(spinning) != 0 {
+		t.Fatalf("Expected the closed pipe to wait, its goroutines kept running %v", spinning)
+	}
+	for {
+		if _, err := pipe.Recv(); err != nil {
+			break
+		}
+	}
+}
+
+func testClosingWhileSendingFailsTheSends(pipeGenerator func() Pipe, t *testing.T) {
+	pipe := pipeGenerator()
+	go func() {
+		for {
+			if _, err := pipe.Recv(); err != nil {
+				return
+			}
+		}
+	}()
+	stopped := make(chan bool)
+	go func() {
+		defer close(stopped)
+		for pipe.Send(&packet.Packet{Payload: []byte{1}}) == nil {
+		}
+	}()
+	time.Sleep(10 * time.Millisecond)
+	err := pipe.Close()
+	testing_utils.UnexpectedError(err, "closing", t)
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected sends to fail once the pipe is closed")
+	}
+}
+
 func PerformPipeTests(pipeGenerator func() Pipe, t *testing.T) {
 
 	testClosingAfterSendingStillDeliversPacket(pipeGenerator, t)
@@ -114,4 +234,6 @@ func PerformPipeTests(pipeGenerator func() Pipe, t *testing.T) {
 	testRecvHangsIfNoPacket(pipeGenerator, t)
 	testRecvFromClosedPipeResultsInNilPacketAndError(pipeGenerator, t)
 	testClosingAClosedPipeFails(pipeGenerator, t)
+	testClosedPipeWaitsWithoutSpinning(pipeGenerator, t)
+	testClosingWhileSendingFailsTheSends(pipeGenerator, t)
 }
@@ -0,0 +1,187 @@
+package pipe
+
+import (
+	"container/list"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/efarrer/evilproxy/packet"
+)
+
+/*
+ * A reorderPipe is a pipe that deliberately reorders packets by holding some
+ * packets back until a number of later packets have been forwarded. Since
+ * traffic may stop at any time a held packet is never held longer than maxHold.
+ */
+type reorderPipe struct {
+	inputChan chan *packet.Packet
+	basePipe  Pipe
+	// Held while sending to or closing inputChan
+	sendMutex sync.Mutex
+	closed    bool
+}
+
+/*
+ * A packet that is being held back
+ */
+type heldPacket struct {
+	packet *packet.Packet
+	// The number of later packets that must be forwarded before this one
+	remaining int
+	deadline  time.Time
+}
+
+/*
+ * Send a packet over a reorder pipe
+ */
+func (rp *reorderPipe) Send(p *packet.Packet) error {
+	rp.sendMutex.Lock()
+	defer rp.sendMutex.Unlock()
+	if rp.closed {
+		return errors.New("Sending on a closed reorder pipe.\n")
+	}
+	rp.inputChan <- p
+	return nil
+}
+
+/*
+ * Receive a packet from the reorder pipe
+ */
+func (rp *reorderPipe) Recv() (*packet.Packet, error) {
+	return rp.basePipe.Recv()
+}
+
+/*
+ * Close the reorder pipe
+ */
+func (rp *reorderPipe) Close() error {
+	rp.sendMutex.Lock()
+	defer rp.sendMutex.Unlock()
+	if rp.closed {
+		return errors.New("Closing a closed reorder pipe.\n")
+	}
+	close(rp.inputChan)
+	rp.closed = true
+	return nil
+}
+
+/*
+ * Constructs a new reorder pipe that holds every nth packet back until distance
+ * later packets have been forwarded.
+ */
+func NewNthReorderPipe(p Pipe, n int, distance int, maxHold time.Duration) Pipe {
+	count := 0
+	return newReorderPipe(p, maxHold, func() int {
+		count++
+		if count == n {
+			count = 0
+			return distance
+		}
+		return 0
+	})
+}
+
+/*
+ * Constructs a new reorder pipe that swaps a packet with the following packet
+ * with the given probability. Pipes constructed with the same seed swap the
+ * same packets.
+ */
+func NewSwapReorderPipe(p Pipe, probability float64, seed int64, maxHold time.Duration) Pipe {
+	random := rand.New(rand.NewSource(seed))
+	// True if the previous packet is being held to swap it with this one
+	swapping := false
+	return newReorderPipe(p, maxHold, func() int {
+		if swapping {
+			swapping = false
+			return 0
+		}
+		if random.Float64() < probability {
+			swapping = true
+			return 1
+		}
+		return 0
+	})
+}
+
+/*
+ * Constructs a new reorder pipe. The hold function is called for each packet
+ * and returns the number of later packets that must be forwarded before it.
+ */
+func newReorderPipe(p Pipe, maxHold time.Duration, hold func() int) Pipe {
+	rp := &reorderPipe{inputChan: make(chan *packet.Packet), basePipe: p}
+
+	go func() {
+		var shutdown = false
+
+		// The packets being held back, oldest first
+		held := list.New()
+
+		// Fires when the oldest held packet must be forwarded
+		var timer <-chan time.Time = nil
+		restartTimer := func() {
+			if held.Len() == 0 {
+				timer = nil
+			} else {
+				deadline := held.Front().Value.(*heldPacket).deadline
+				timer = time.After(deadline.Sub(time.Now()))
+			}
+		}
+
+		// Forwards the held packets that are due, either because enough later
+		// packets have been forwarded or their deadline has passed
+		release := func() {
+			now := time.Now()
+			for elm := held.Front(); elm != nil; {
+				next := elm.Next()
+				hp := elm.Value.(*heldPacket)
+				if hp.remaining <= 0 || !hp.deadline.After(now) {
+					held.Remove(elm)
+					rp.basePipe.Send(hp.packet)
+				}
+				elm = next
+			}
+			restartTimer()
+		}
+
+		for {
+			// If we've been shutdown then forward any held packets, close the
+			// basePipe and exit
+			if shutdown {
+				for held.Len() != 0 {
+					rp.basePipe.Send(held.Remove(held.Front()).(*heldPacket).packet)
+				}
+				rp.basePipe.Close()
+				return
+			}
+
+			select {
+			// We got a new packet to forward or hold
+			case input, ok := <-rp.inputChan:
+				if !ok {
+					shutdown = true
+					continue
+				}
+
+				if distance := hold(); distance > 0 {
+					held.PushBack(&heldPacket{input, distance, time.Now().Add(maxHold)})
+					restartTimer()
+					continue
+				}
+
+				rp.basePipe.Send(input)
+				for elm := held.Front(); elm != nil; elm = elm.Next() {
+					elm.Value.(*heldPacket).remaining--
+				}
+				release()
+
+			// The oldest held packet has been held long enough
+			case <-timer:
+				release()
+			}
+		}
+	}()
+
+	return rp
+}
@@ -0,0 +1,81 @@
+package pipe
+
+import (
+	"testing"
+	"time"
+
+	"github.com/efarrer/evilproxy/packet"
+	"github.com/efarrer/evilproxy/testing_utils"
+)
+
+func TestPipeBehaviorForNthReorderPipe(t *testing.T) {
+	PerformPipeTests(func() Pipe { return NewNthReorderPipe(NewBasicPipe(), 3, 1, time.Second) }, t)
+}
+
+func TestPipeBehaviorForSwapReorderPipe(t *testing.T) {
+	PerformPipeTests(func() Pipe { return NewSwapReorderPipe(NewBasicPipe(), 0, 1, time.Second) }, t)
+}
+
+/*
+ * Sends count packets over the pipe and returns the order they were received in
+ */
+func receivedOrder(pipe Pipe, count int, t *testing.T) []int {
+	pkts := map[*packet.Packet]int{}
+	for i := 0; i != count; i++ {
+		pkt := &packet.Packet{}
+		pkts[pkt] = i
+		err := pipe.Send(pkt)
+		testing_utils.UnexpectedError(err, "sending", t)
+	}
+	order := []int{}
+	for i := 0; i != count; i++ {
+		pkt, err := pipe.Recv()
+		testing_utils.UnexpectedError(err, "recving", t)
+		order = append(order, pkts[pkt])
+	}
+	return order
+}
+
+func expectOrder(expected, order []int, t *testing.T) {
+	if len(expected) != len(order) {
+		t.Fatalf("Expected packets in order %v got %v", expected, order)
+	}
+	for i := range expected {
+		if expected[i] != order[i] {
+			t.Fatalf("Expected packets in order %v got %v", expected, order)
+		}
+	}
+}
+
+func TestNthReorderPipeHoldsBackEveryNthPacket(t *testing.T) {
+	pipe := NewNthReorderPipe(NewBasicPipe(), 3, 2, time.Millisecond*50)
+	defer pipe.Close()
+	start := time.Now()
+	order := receivedOrder(pipe, 9, t)
+	// The last held packet is released after maxHold
+	elapsed := time.Since(start)
+	expectOrder([]int{0, 1, 3, 4, 2, 6, 7, 5, 8}, order, t)
+	if elapsed < time.Millisecond*50 {
+		t.Fatalf("Expected the last held packet to be released after 50ms not %v", elapsed)
+	}
+}
+
+func TestSwapReorderPipeSwapsAdjacentPackets(t *testing.T) {
+	pipe := NewSwapReorderPipe(NewBasicPipe(), 1, 1, time.Second)
+	defer pipe.Close()
+	expectOrder([]int{1, 0, 3, 2, 5, 4}, receivedOrder(pipe, 6, t), t)
+}
+
+func TestClosingReorderPipeReleasesHeldPackets(t *testing.T) {
+	pkt := &packet.Packet{}
+	pipe := NewNthReorderPipe(NewBasicPipe(), 1, 1, time.Hour)
+	err := pipe.Send(pkt)
+	testing_utils.UnexpectedError(err, "sending", t)
+	err = pipe.Close()
+	testing_utils.UnexpectedError(err, "closing", t)
+	rcvd, err := pipe.Recv()
+	testing_utils.UnexpectedError(err, "recving", t)
+	if rcvd != pkt {
+		t.Fatalf("Didn't get expected packet from pipe. Got %v expected %v", rcvd, pkt)
+	}
+}
@@ -0,0 +1,137 @@
+package pipe
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/efarrer/evilproxy/packet"
+)
+
+/*
+ * A phase of a schedule. Build wraps a base pipe with the pipes that simulate
+ * the network during the phase.
+ */
+type Phase struct {
+	Duration time.Duration
+	Build    func(base Pipe) Pipe
+}
+
+/*
+ * A sharedPipe lets several pipes forward to the same base pipe. The base pipe
+ * is closed once all of the pipes sharing it have closed it.
+ */
+type sharedPipe struct {
+	mutex    sync.Mutex
+	basePipe Pipe
+	users    int
+}
+
+func (sp *sharedPipe) Send(p *packet.Packet) error {
+	return sp.basePipe.Send(p)
+}
+
+func (sp *sharedPipe) Recv() (*packet.Packet, error) {
+	return sp.basePipe.Recv()
+}
+
+func (sp *sharedPipe) Close() error {
+	sp.mutex.Lock()
+	defer sp.mutex.Unlock()
+	if sp.users == 0 {
+		return errors.New("Closing a closed shared pipe.\n")
+	}
+	sp.users--
+	if sp.users == 0 {
+		return sp.basePipe.Close()
+	}
+	return nil
+}
+
+/*
+ * A schedulePipe is a pipe that changes the simulated network over time. Each
+ * phase has its own pipes, all of which forward to the same base pipe. Packets
+ * are sent through the pipes of the current phase. When the phase changes the
+ * packets queued in the previous phase's pipes are still delivered.
+ */
+type schedulePipe struct {
+	mutex    sync.Mutex
+	basePipe Pipe
+	phases   []Pipe
+	current  int
+	done     chan bool
+	closed   bool
+}
+
+/*
+ * Send a packet over a schedule pipe
+ */
+func (sp *schedulePipe) Send(p *packet.Packet) error {
+	sp.mutex.Lock()
+	if sp.closed {
+		sp.mutex.Unlock()
+		return errors.New("Sending on a closed schedule pipe.\n")
+	}
+	phase := sp.phases[sp.current]
+	sp.mutex.Unlock()
+
+	return phase.Send(p)
+}
+
+/*
+ * Receive a packet from the schedule pipe
+ */
+func (sp *schedulePipe) Recv() (*packet.Packet, error) {
+	return sp.basePipe.Recv()
+}
+
+/*
+ * Close the schedule pipe
+ */
+func (sp *schedulePipe) Close() error {
+	sp.mutex.Lock()
+	defer sp.mutex.Unlock()
+	if sp.closed {
+		return errors.New("Closing a closed schedule pipe.\n")
+	}
+	sp.closed = true
+	close(sp.done)
+	for _, phase := range sp.phases {
+		phase.Close()
+	}
+	return nil
+}
+
+/*
+ * Constructs a new schedule pipe that moves through the phases in order. If
+ * repeat is true the schedule starts over after the last phase, otherwise the
+ * last phase lasts forever.
+ */
+func NewSchedulePipe(p Pipe, phases []Phase, repeat bool) Pipe {
+	shared := &sharedPipe{basePipe: p, users: len(phases)}
+	sp := &schedulePipe{basePipe: p, done: make(chan bool)}
+	for _, phase := range phases {
+		sp.phases = append(sp.phases, phase.Build(shared))
+	}
+
+	go func() {
+		current := 0
+		for {
+			if current == len(phases)-1 && !repeat {
+				return
+			}
+
+			select {
+			case <-sp.done:
+				return
+			case <-time.After(phases[current].Duration):
+				current = (current + 1) % len(phases)
+				sp.mutex.Lock()
+				sp.current = current
+				sp.mutex.Unlock()
+			}
+		}
+	}()
+
+	return sp
+}
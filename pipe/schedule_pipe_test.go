@@ -0,0 +1,118 @@
+package pipe
+
+import (
+	"testing"
+	"time"
+
+	"github.com/efarrer/evilproxy/packet"
+	"github.com/efarrer/evilproxy/testing_utils"
+)
+
+func passthrough(base Pipe) Pipe {
+	return base
+}
+
+func latency(latency time.Duration) func(Pipe) Pipe {
+	return func(base Pipe) Pipe {
+		return NewLatentPipe(base, latency)
+	}
+}
+
+func TestPipeBehaviorForSchedulePipe(t *testing.T) {
+	PerformPipeTests(func() Pipe {
+		return NewSchedulePipe(NewBasicPipe(), []Phase{{time.Hour, passthrough}}, false)
+	}, t)
+}
+
+func TestPipeBehaviorForRepeatingSchedulePipe(t *testing.T) {
+	PerformPipeTests(func() Pipe {
+		return NewSchedulePipe(NewBasicPipe(), []Phase{
+			{time.Millisecond, passthrough},
+			{time.Millisecond, latency(0)},
+		}, true)
+	}, t)
+}
+
+/*
+ * Returns how long it took for a packet to be delivered over the pipe
+ */
+func timeSend(pipe Pipe, t *testing.T) time.Duration {
+	start := time.Now()
+	err := pipe.Send(&packet.Packet{})
+	testing_utils.UnexpectedError(err, "sending", t)
+	_, err = pipe.Recv()
+	testing_utils.UnexpectedError(err, "recving", t)
+	return time.Since(start)
+}
+
+func TestSchedulePipeChangesPhases(t *testing.T) {
+	const delay = time.Millisecond * 100
+	pipe := NewSchedulePipe(NewBasicPipe(), []Phase{
+		{time.Millisecond * 50, passthrough},
+		{time.Millisecond * 50, latency(delay)},
+	}, false)
+	defer pipe.Close()
+
+	if elapsed := timeSend(pipe, t); elapsed >= delay {
+		t.Fatalf("Expected no latency in the first phase got %v", elapsed)
+	}
+	time.Sleep(time.Millisecond * 100)
+	// The last phase lasts forever
+	for i := 0; i != 2; i++ {
+		if elapsed := timeSend(pipe, t); elapsed < delay {
+			t.Fatalf("Expected latency of %v in the second phase got %v", delay, elapsed)
+		}
+	}
+}
+
+func TestRepeatingSchedulePipeStartsOver(t *testing.T) {
+	const delay = time.Millisecond * 50
+	pipe := NewSchedulePipe(NewBasicPipe(), []Phase{
+		{time.Millisecond * 100, latency(delay)},
+		{time.Millisecond * 100, passthrough},
+	}, true)
+	defer pipe.Close()
+
+	// Probe until a packet is delayed again after one that wasn't, which only
+	// happens once the schedule starts over
+	deadline := time.Now().Add(time.Second * 5)
+	sawPassthrough := false
+	for time.Now().Before(deadline) {
+		elapsed := timeSend(pipe, t)
+		if elapsed < delay {
+			sawPassthrough = true
+		} else if sawPassthrough {
+			return
+		}
+	}
+	t.Fatalf("Expected latency of %v after starting over (passthrough seen %v)", delay, sawPassthrough)
+}
+
+func TestSchedulePipeDeliversPacketsQueuedInPreviousPhase(t *testing.T) {
+	pkt0 := &packet.Packet{}
+	pkt1 := &packet.Packet{}
+	pipe := NewSchedulePipe(NewBasicPipe(), []Phase{
+		{time.Millisecond * 10, latency(time.Millisecond * 200)},
+		{time.Hour, passthrough},
+	}, false)
+
+	err := pipe.Send(pkt0)
+	testing_utils.UnexpectedError(err, "sending", t)
+	time.Sleep(time.Millisecond * 50)
+	err = pipe.Send(pkt1)
+	testing_utils.UnexpectedError(err, "sending", t)
+	err = pipe.Close()
+	testing_utils.UnexpectedError(err, "closing", t)
+
+	// The packet sent in the second phase overtakes the one queued in the first
+	for _, expected := range []*packet.Packet{pkt1, pkt0} {
+		rcvd, err := pipe.Recv()
+		testing_utils.UnexpectedError(err, "recving", t)
+		if rcvd != expected {
+			t.Fatalf("Didn't get expected packet from pipe. Got %v expected %v", rcvd, expected)
+		}
+	}
+	if _, err := pipe.Recv(); err == nil {
+		t.Fatalf("Expected an error after receiving all packets from a closed pipe")
+	}
+}
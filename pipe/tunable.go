@@ -0,0 +1,40 @@
+package pipe
+
+import (
+	"time"
+)
+
+/*
+ * Pipes that simulate latency implement 'LatencyTuner' so their latency can be
+ * changed while they are in use.
+ */
+type LatencyTuner interface {
+	/*
+	 * Sets the latency of packets sent from now on. Packets that are already
+	 * in transit keep their latency.
+	 */
+	SetLatency(latency time.Duration)
+}
+
+/*
+ * Pipes that simulate packet loss implement 'LossTuner' so their loss can be
+ * changed while they are in use.
+ */
+type LossTuner interface {
+	/*
+	 * Sets the probability that each packet sent from now on is dropped.
+	 */
+	SetLossProbability(probability float64)
+}
+
+/*
+ * Pipes that simulate limited bandwidth implement 'BandwidthTuner' so their
+ * bandwidth can be changed while they are in use.
+ */
+type BandwidthTuner interface {
+	/*
+	 * Sets the rate that packets are forwarded at. Packets that are waiting to
+	 * be forwarded are not dropped.
+	 */
+	SetBandwidth(bytesPerSecond int64)
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/efarrer/evilproxy/connection"
+)
+
+/*
+ * A proxiedConnection forwards the data of a socket accepted from a client to
+ * a socket dialed to the server, and back, through the simulated network.
+ *
+ * Each direction finishes when the side sending it shuts down its socket for
+ * writing, which is passed on through the network as a half close. Once both
+ * directions have finished, or as soon as reading or writing a socket or the
+ * network fails, the sockets and the network's connections, and so their
+ * pipes, are closed. Each of them is closed exactly once. The network's
+ * connections are only closed once nothing is writing to them and everything
+ * in them has been read.
+ *
+ * Shutting down the connection stops reading the sockets and closes the
+ * network's connections for writing, so the data already in the network is
+ * delivered before the sockets are closed for writing.
+ */
+type proxiedConnection struct {
+	accepted net.Conn
+	dialed   net.Conn
+	// The network's ends that carry the client's and the server's data
+	client connection.Connection
+	server connection.Connection
+	// The writers that data is forwarded to the sockets through
+	toClient io.Writer
+	toServer io.Writer
+
+	// Closed once the connection has failed
+	failed      chan bool
+	failOnce    sync.Once
+	socketsOnce sync.Once
+	closeOnce   sync.Once
+
+	// Closed once the connection is shutting down
+	stopping     chan bool
+	shutdownOnce sync.Once
+}
+
+/*
+ * Constructs a proxied connection from the accepted and dialed sockets and the
+ * network's ends that carry the client's and the server's data
+ */
+func newProxiedConnection(accepted, dialed net.Conn,
+	client, server connection.Connection) *proxiedConnection {
+	return &proxiedConnection{
+		accepted: accepted,
+		dialed:   dialed,
+		client:   client,
+		server:   server,
+		toClient: accepted,
+		toServer: dialed,
+		failed:   make(chan bool),
+		stopping: make(chan bool),
+	}
+}
+
+/*
+ * Dials the server at address and constructs a proxied connection. If the
+ * server can't be dialed the accepted socket and the network's connections
+ * are closed.
+ */
+func dialProxiedConnection(accepted net.Conn, address string, timeout time.Duration,
+	client, server connection.Connection) (*proxiedConnection, error) {
+	dialed, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		accepted.Close()
+		client.Close()
+		server.Close()
+		return nil, errors.New(fmt.Sprintf("Unable to connect to \"%s\". %v", address, err))
+	}
+	return newProxiedConnection(accepted, dialed, client, server), nil
+}
+
+/*
+ * Wraps the writers that data is forwarded to the sockets through
+ */
+func (pc *proxiedConnection) wrapWriters(wrap func(io.Writer) io.Writer) {
+	pc.toClient = wrap(pc.toClient)
+	pc.toServer = wrap(pc.toServer)
+}
+
+/*
+ * Closes the sockets unless they're already closed
+ */
+func (pc *proxiedConnection) closeSockets() {
+	pc.socketsOnce.Do(func() {
+		pc.accepted.Close()
+		pc.dialed.Close()
+	})
+}
+
+/*
+ * Closes the sockets and the network's connections unless they're already
+ * closed. Must only be called once nothing is writing to the connections.
+ */
+func (pc *proxiedConnection) close() {
+	pc.closeOnce.Do(func() {
+		pc.closeSockets()
+		pc.client.Close()
+		pc.server.Close()
+	})
+}
+
+/*
+ * Abandons the connection by closing the sockets, which stops forwarding in
+ * both directions. The network's connections are closed by run once the
+ * forwarders have stopped writing to them.
+ */
+func (pc *proxiedConnection) fail() {
+	pc.failOnce.Do(func() {
+		close(pc.failed)
+	})
+	pc.closeSockets()
+}
+
+/*
+ * Returns true if the connection has failed
+ */
+func (pc *proxiedConnection) failing() bool {
+	select {
+	case <-pc.failed:
+		return true
+	default:
+		return false
+	}
+}
+
+/*
+ * Stops reading the sockets, so each direction finishes once the data already
+ * in the network has been delivered
+ */
+func (pc *proxiedConnection) shutdown() {
+	pc.shutdownOnce.Do(func() {
+		close(pc.stopping)
+		// Wake up the blocked reads
+		pc.accepted.SetReadDeadline(time.Now())
+		pc.dialed.SetReadDeadline(time.Now())
+	})
+}
+
+/*
+ * Returns true if the connection is shutting down
+ */
+func (pc *proxiedConnection) shuttingDown() bool {
+	select {
+	case <-pc.stopping:
+		return true
+	default:
+		return false
+	}
+}
+
+/*
+ * Closes the socket for writing so its peer reads EOF but can still send. If
+ * the socket can't be half closed the connection fails.
+ */
+func (pc *proxiedConnection) closeWrite(sock net.Conn) {
+	if pc.failing() {
+		return
+	}
+	halfCloser, ok := sock.(interface{ CloseWrite() error })
+	if !ok || halfCloser.CloseWrite() != nil {
+		pc.fail()
+	}
+}
+
+/*
+ * Forwards the data read from the socket to the connection. Once the socket's
+ * peer has finished sending, or the connection is shutting down, the
+ * connection is closed for writing.
+ */
+func (pc *proxiedConnection) forwardToConnection(conn connection.Connection, sock net.Conn) {
+	_, err := io.Copy(connection.ConnectionWriterAdaptor(conn), sock)
+	if err != nil && !pc.shuttingDown() {
+		pc.fail()
+		return
+	}
+	if !pc.failing() && conn.CloseWrite() != nil {
+		pc.fail()
+	}
+}
+
+/*
+ * Forwards the data read from the connection to the socket through w. Once the
+ * connection's peer has finished writing the socket is closed for writing.
+ * Returns the number of bytes written.
+ *
+ * If writing the socket fails the rest of the connection's data is read and
+ * discarded, so the packets still in the network don't leave its pipes
+ * blocked.
+ */
+func (pc *proxiedConnection) forwardToSocket(w io.Writer, sock net.Conn,
+	conn connection.Connection) int64 {
+	reader := connection.ConnectionReaderAdaptor(conn)
+	buffer := make([]byte, 32*1024)
+	var written int64
+	for {
+		n, err := reader.Read(buffer)
+		if err != nil {
+			pc.closeWrite(sock)
+			return written
+		}
+		n, err = w.Write(buffer[:n])
+		written += int64(n)
+		if err != nil {
+			pc.fail()
+			io.Copy(ioutil.Discard, reader)
+			return written
+		}
+	}
+}
+
+/*
+ * Forwards data in both directions until the connection is finished and
+ * everything has been closed. Returns the number of bytes forwarded to the
+ * server and to the client.
+ */
+func (pc *proxiedConnection) run() (int64, int64) {
+	var toSockets, toConnections sync.WaitGroup
+	var toServer, toClient int64
+	toSockets.Add(2)
+	toConnections.Add(2)
+	go func() {
+		defer toSockets.Done()
+		toServer = pc.forwardToSocket(pc.toServer, pc.dialed, pc.server)
+	}()
+	go func() {
+		defer toSockets.Done()
+		toClient = pc.forwardToSocket(pc.toClient, pc.accepted, pc.client)
+	}()
+	go func() {
+		defer toConnections.Done()
+		pc.forwardToConnection(pc.server, pc.dialed)
+	}()
+	go func() {
+		defer toConnections.Done()
+		pc.forwardToConnection(pc.client, pc.accepted)
+	}()
+
+	delivered := make(chan bool)
+	go func() {
+		toSockets.Wait()
+		close(delivered)
+	}()
+
+	// Both directions have been passed on once the sockets have been closed
+	// for writing, unless the connection fails first
+	select {
+	case <-delivered:
+	case <-pc.failed:
+	}
+	// Stop reading the sockets and wait for the data read to be written to
+	// the network, which must not be closed while it's being written to
+	pc.shutdown()
+	toConnections.Wait()
+	// The network can't be read once it's closed, so it's closed for writing,
+	// unless the forwarders already have, and read until it's empty first
+	pc.client.CloseWrite()
+	pc.server.CloseWrite()
+	<-delivered
+	pc.close()
+	return toServer, toClient
+}
+
+/*
+ * A connectionSet holds the proxied connections being served so they can all
+ * be shut down. Connections added once the set has been shut down are shut
+ * down straight away.
+ */
+type connectionSet struct {
+	mutex       sync.Mutex
+	connections map[*proxiedConnection]bool
+	stopping    bool
+}
+
+func newConnectionSet() *connectionSet {
+	return &connectionSet{connections: map[*proxiedConnection]bool{}}
+}
+
+func (cs *connectionSet) add(pc *proxiedConnection) {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	cs.connections[pc] = true
+	if cs.stopping {
+		pc.shutdown()
+	}
+}
+
+func (cs *connectionSet) remove(pc *proxiedConnection) {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	delete(cs.connections, pc)
+}
+
+/*
+ * Shuts down the connections in the set, and those added later
+ */
+func (cs *connectionSet) shutdown() {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	cs.stopping = true
+	for pc := range cs.connections {
+		pc.shutdown()
+	}
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/efarrer/evilproxy/connection"
+	"github.com/efarrer/evilproxy/packet"
+	"github.com/efarrer/evilproxy/pipe"
+	"github.com/efarrer/evilproxy/testing_utils"
+)
+
+/*
+ * A countingSocket counts how often it's closed. It can still be half closed.
+ */
+type countingSocket struct {
+	*net.TCPConn
+	closes int32
+}
+
+func (cs *countingSocket) Close() error {
+	atomic.AddInt32(&cs.closes, 1)
+	return cs.TCPConn.Close()
+}
+
+/*
+ * A countingConnection counts how often it's closed and fails writes if
+ * failWrites is set
+ */
+type countingConnection struct {
+	connection.Connection
+	failWrites bool
+	closes     int32
+}
+
+func (cc *countingConnection) Write(p *packet.Packet) error {
+	if cc.failWrites {
+		return errors.New("Failed writing.")
+	}
+	return cc.Connection.Write(p)
+}
+
+func (cc *countingConnection) Close() error {
+	atomic.AddInt32(&cc.closes, 1)
+	return cc.Connection.Close()
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("Failed writing.")
+}
+
+/*
+ * A proxyTest is a proxied connection between the test's client and server
+ * sockets over a perfect network
+ */
+type proxyTest struct {
+	client     *net.TCPConn
+	server     *net.TCPConn
+	accepted   *countingSocket
+	dialed     *countingSocket
+	clientConn *countingConnection
+	serverConn *countingConnection
+	pc         *proxiedConnection
+}
+
+func newProxyTest(t *testing.T) *proxyTest {
+	return newProxyTestOver(pipe.NewBasicPipe(), pipe.NewBasicPipe(), t)
+}
+
+/*
+ * Constructs a proxy test whose network is made of the pipes
+ */
+func newProxyTestOver(p0, p1 pipe.Pipe, t *testing.T) *proxyTest {
+	client, accepted := tcpPair(t)
+	dialed, server := tcpPair(t)
+	clientEnd, serverEnd := connection.NewBasicConnections(p0, p1)
+	pt := &proxyTest{
+		client:     client.(*net.TCPConn),
+		server:     server.(*net.TCPConn),
+		accepted:   &countingSocket{TCPConn: accepted.(*net.TCPConn)},
+		dialed:     &countingSocket{TCPConn: dialed.(*net.TCPConn)},
+		clientConn: &countingConnection{Connection: clientEnd},
+		serverConn: &countingConnection{Connection: serverEnd},
+	}
+	pt.pc = newProxiedConnection(pt.accepted, pt.dialed, pt.clientConn, pt.serverConn)
+	return pt
+}
+
+/*
+ * Runs the proxied connection in the background. The returned channel receives
+ * the bytes forwarded to the server and to the client once it's finished.
+ */
+func (pt *proxyTest) run() chan [2]int64 {
+	result := make(chan [2]int64, 1)
+	go func() {
+		toServer, toClient := pt.pc.run()
+		result <- [2]int64{toServer, toClient}
+	}()
+	return result
+}
+
+/*
+ * Waits for the proxied connection to finish and fails the test unless the
+ * sockets and connections were each closed exactly once
+ */
+func (pt *proxyTest) expectClosedOnce(result chan [2]int64, t *testing.T) [2]int64 {
+	var forwarded [2]int64
+	select {
+	case forwarded = <-result:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the proxied connection to finish")
+	}
+	for name, closes := range map[string]int32{
+		"accepted socket":   atomic.LoadInt32(&pt.accepted.closes),
+		"dialed socket":     atomic.LoadInt32(&pt.dialed.closes),
+		"client connection": atomic.LoadInt32(&pt.clientConn.closes),
+		"server connection": atomic.LoadInt32(&pt.serverConn.closes),
+	} {
+		if closes != 1 {
+			t.Fatalf("Expected the %v to be closed once got %v", name, closes)
+		}
+	}
+	return forwarded
+}
+
+/*
+ * Fails the test unless the number of goroutines drops back to before, which
+ * it may take a moment to do once the pipes have been closed
+ */
+func expectNoLeakedGoroutines(before int, t *testing.T) {
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %v goroutines got %v", before, runtime.NumGoroutine())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+/*
+ * Fails the test unless the peer's socket is closed
+ */
+func expectClosed(peer net.Conn, t *testing.T) {
+	peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err := ioutil.ReadAll(peer)
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		t.Fatalf("Expected the socket to be closed")
+	}
+}
+
+func TestProxiedConnectionPassesOnHalfClosesInBothDirections(t *testing.T) {
+	pt := newProxyTest(t)
+	defer pt.client.Close()
+	defer pt.server.Close()
+	result := pt.run()
+
+	_, err := pt.client.Write([]byte("request"))
+	testing_utils.UnexpectedError(err, "writing", t)
+	testing_utils.UnexpectedError(pt.client.CloseWrite(), "closing for writing", t)
+
+	// The server reads EOF but can still reply
+	request, err := ioutil.ReadAll(pt.server)
+	testing_utils.UnexpectedError(err, "reading", t)
+	if string(request) != "request" {
+		t.Fatalf("Expected \"request\" got %q", request)
+	}
+	_, err = pt.server.Write([]byte("response"))
+	testing_utils.UnexpectedError(err, "writing", t)
+	testing_utils.UnexpectedError(pt.server.CloseWrite(), "closing for writing", t)
+
+	response, err := ioutil.ReadAll(pt.client)
+	testing_utils.UnexpectedError(err, "reading", t)
+	if string(response) != "response" {
+		t.Fatalf("Expected \"response\" got %q", response)
+	}
+
+	forwarded := pt.expectClosedOnce(result, t)
+	if forwarded != [2]int64{7, 8} {
+		t.Fatalf("Expected 7 bytes forwarded to the server and 8 to the client got %v", forwarded)
+	}
+}
+
+func TestProxiedConnectionClosesEverythingWhenTheClientResets(t *testing.T) {
+	before := runtime.NumGoroutine()
+	pt := newProxyTest(t)
+	defer pt.server.Close()
+	result := pt.run()
+
+	pt.client.SetLinger(0)
+	pt.client.Close()
+
+	expectClosed(pt.server, t)
+	pt.expectClosedOnce(result, t)
+	expectNoLeakedGoroutines(before, t)
+}
+
+func TestProxiedConnectionClosesEverythingWhenTheServerResets(t *testing.T) {
+	before := runtime.NumGoroutine()
+	pt := newProxyTest(t)
+	defer pt.client.Close()
+	result := pt.run()
+
+	pt.server.SetLinger(0)
+	pt.server.Close()
+
+	expectClosed(pt.client, t)
+	pt.expectClosedOnce(result, t)
+	expectNoLeakedGoroutines(before, t)
+}
+
+func TestProxiedConnectionClosesEverythingWhenTheNetworkFails(t *testing.T) {
+	before := runtime.NumGoroutine()
+	pt := newProxyTest(t)
+	defer pt.client.Close()
+	defer pt.server.Close()
+	pt.clientConn.failWrites = true
+	result := pt.run()
+
+	_, err := pt.client.Write([]byte("request"))
+	testing_utils.UnexpectedError(err, "writing", t)
+
+	expectClosed(pt.client, t)
+	expectClosed(pt.server, t)
+	pt.expectClosedOnce(result, t)
+	expectNoLeakedGoroutines(before, t)
+}
+
+func TestProxiedConnectionClosesEverythingWhenWritingASocketFails(t *testing.T) {
+	before := runtime.NumGoroutine()
+	pt := newProxyTest(t)
+	defer pt.client.Close()
+	defer pt.server.Close()
+	pt.pc.wrapWriters(func(w io.Writer) io.Writer {
+		return failingWriter{}
+	})
+
+	// Queue several packets in the network before the first write fails, the
+	// rest must still be read from the network
+	for i := 0; i != 5; i++ {
+		testing_utils.UnexpectedError(pt.serverConn.Write(&packet.Packet{Payload: []byte("response")}),
+			"writing", t)
+	}
+	result := pt.run()
+
+	expectClosed(pt.client, t)
+	expectClosed(pt.server, t)
+	pt.expectClosedOnce(result, t)
+	expectNoLeakedGoroutines(before, t)
+}
+
+func TestProxiedConnectionShutdownDeliversTheDataInTheNetwork(t *testing.T) {
+	const latency = 50 * time.Millisecond
+	pt := newProxyTestOver(pipe.NewLatentPipe(pipe.NewBasicPipe(), latency),
+		pipe.NewLatentPipe(pipe.NewBasicPipe(), latency), t)
+	defer pt.client.Close()
+	defer pt.server.Close()
+	connections := newConnectionSet()
+	connections.add(pt.pc)
+	result := pt.run()
+
+	// Shut down while the response is in the network. The idle client and
+	// server are closed for writing rather than waited for.
+	_, err := pt.server.Write([]byte("response"))
+	testing_utils.UnexpectedError(err, "writing", t)
+	time.Sleep(latency / 5)
+	connections.shutdown()
+
+	response, err := ioutil.ReadAll(pt.client)
+	testing_utils.UnexpectedError(err, "reading", t)
+	if string(response) != "response" {
+		t.Fatalf("Expected \"response\" got %q", response)
+	}
+	request, err := ioutil.ReadAll(pt.server)
+	testing_utils.UnexpectedError(err, "reading", t)
+	if len(request) != 0 {
+		t.Fatalf("Expected no request got %q", request)
+	}
+	pt.expectClosedOnce(result, t)
+}
+
+func TestProxiedConnectionFailingWhileDataFlowsClosesEverythingOnce(t *testing.T) {
+	before := runtime.NumGoroutine()
+	pt := newProxyTestOver(pipe.NewLatentPipe(pipe.NewBasicPipe(), time.Millisecond),
+		pipe.NewLatentPipe(pipe.NewBasicPipe(), time.Millisecond), t)
+	defer pt.client.Close()
+	result := pt.run()
+
+	go io.Copy(ioutil.Discard, pt.server)
+	go func() {
+		for {
+			if _, err := pt.client.Write(make([]byte, 1024)); err != nil {
+				return
+			}
+		}
+	}()
+	time.Sleep(20 * time.Millisecond)
+	pt.server.SetLinger(0)
+	pt.server.Close()
+
+	expectClosed(pt.client, t)
+	pt.expectClosedOnce(result, t)
+	expectNoLeakedGoroutines(before, t)
+}
+
+func TestConnectionSetShutsDownConnectionsAddedLater(t *testing.T) {
+	pt := newProxyTest(t)
+	defer pt.client.Close()
+	defer pt.server.Close()
+	connections := newConnectionSet()
+	connections.shutdown()
+	connections.add(pt.pc)
+
+	result := pt.run()
+	expectClosed(pt.client, t)
+	expectClosed(pt.server, t)
+	pt.expectClosedOnce(result, t)
+}
+
+func TestDialProxiedConnectionClosesEverythingWhenDialingFails(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	testing_utils.UnexpectedError(err, "listening", t)
+	address := listener.Addr().String()
+	listener.Close()
+
+	client, accepted := tcpPair(t)
+	defer client.Close()
+	counting := &countingSocket{TCPConn: accepted.(*net.TCPConn)}
+	clientEnd, serverEnd := connection.NewBasicConnections(pipe.NewBasicPipe(), pipe.NewBasicPipe())
+	clientConn := &countingConnection{Connection: clientEnd}
+	serverConn := &countingConnection{Connection: serverEnd}
+
+	pc, err := dialProxiedConnection(counting, address, time.Second, clientConn, serverConn)
+	if err == nil || pc != nil {
+		t.Fatalf("Expected an error dialing a closed address")
+	}
+	expectClosed(client, t)
+	if counting.closes != 1 || clientConn.closes != 1 || serverConn.closes != 1 {
+		t.Fatalf("Expected the socket and connections to be closed once got %v %v %v",
+			counting.closes, clientConn.closes, serverConn.closes)
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+/*
+ * A resetFault abruptly resets the sockets of a connection once afterBytes
+ * bytes have been forwarded, or once afterTime has passed, whichever comes
+ * first. A zero value disables that trigger.
+ *
+ * The sockets reset are the one accepted from the client ("accepted"), the one
+ * dialed to the upstream server ("dialed") or "both". The connection's sockets
+ * are closed with SO_LINGER 0 set on those sockets so their peers see a RST, and
+ * ECONNRESET, rather than a FIN.
+ *
+ * If midWrite is true the reset happens part way through forwarding a chunk of
+ * data, so the peer receives a truncated message. The byte trigger writes
+ * exactly afterBytes bytes and the time trigger writes half of the next chunk.
+ * If no chunk is forwarded within midWriteGrace of the time trigger the
+ * connection is idle and is reset without one.
+ */
+type resetFault struct {
+	afterBytes int64
+	afterTime  time.Duration
+	sockets    string
+	midWrite   bool
+}
+
+/*
+ * Returns an error if the fault is misconfigured
+ */
+func (f resetFault) validate() error {
+	if f.afterBytes < 0 || f.afterTime < 0 {
+		return errors.New("Reset triggers can't be negative.")
+	}
+	switch f.sockets {
+	case "accepted", "dialed", "both":
+		return nil
+	}
+	return errors.New(fmt.Sprintf("Unknown reset socket \"%v\", expected one of accepted, dialed, both.", f.sockets))
+}
+
+/*
+ * Returns true if the fault has a trigger
+ */
+func (f resetFault) enabled() bool {
+	return f.afterBytes > 0 || f.afterTime > 0
+}
+
+var errReset = errors.New("Connection reset by evilproxy.")
+
+// How long the time trigger waits for a chunk to truncate
+const midWriteGrace = 100 * time.Millisecond
+
+/*
+ * A resetter injects a reset fault into one proxied connection
+ */
+type resetter struct {
+	fault   resetFault
+	mutex   sync.Mutex
+	targets []net.Conn
+	// Closes the connection's sockets, leaving the connection to tear down the
+	// rest once it stops forwarding
+	fail    func()
+	written int64
+	due     bool
+	reset   bool
+	timer   *time.Timer
+}
+
+/*
+ * Starts injecting the fault into the connection made of the accepted and
+ * dialed sockets, whose sockets are closed with fail. The time trigger starts
+ * now.
+ */
+func (f resetFault) start(accepted, dialed net.Conn, fail func()) *resetter {
+	r := &resetter{fault: f, fail: fail}
+	if f.sockets != "dialed" && accepted != nil {
+		r.targets = append(r.targets, accepted)
+	}
+	if f.sockets != "accepted" && dialed != nil {
+		r.targets = append(r.targets, dialed)
+	}
+	if f.afterTime > 0 {
+		// The timer may fire before it's recorded
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+		r.timer = time.AfterFunc(f.afterTime, func() {
+			if !f.midWrite {
+				r.resetSockets()
+				return
+			}
+			r.mutex.Lock()
+			defer r.mutex.Unlock()
+			r.due = true
+			r.timer = time.AfterFunc(midWriteGrace, r.resetSockets)
+		})
+	}
+	return r
+}
+
+/*
+ * Stops the time trigger
+ */
+func (r *resetter) stop() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.timer != nil {
+		r.timer.Stop()
+	}
+}
+
+/*
+ * Resets the target sockets by failing the connection. Only the first call
+ * has any effect.
+ */
+func (r *resetter) resetSockets() {
+	r.mutex.Lock()
+	if r.reset {
+		r.mutex.Unlock()
+		return
+	}
+	r.reset = true
+	if r.timer != nil {
+		r.timer.Stop()
+	}
+	for _, target := range r.targets {
+		if lingerer, ok := target.(interface{ SetLinger(int) error }); ok {
+			lingerer.SetLinger(0)
+		}
+		log.Printf("Reset connection to \"%v\" after %v bytes.\n", target.RemoteAddr(), r.written)
+	}
+	r.mutex.Unlock()
+	r.fail()
+}
+
+/*
+ * Returns a writer that forwards to w and counts the bytes written towards the
+ * byte trigger. All of the writers of a connection share the count.
+ */
+func (r *resetter) writer(w io.Writer) io.Writer {
+	return &resetWriter{r, w}
+}
+
+type resetWriter struct {
+	resetter *resetter
+	writer   io.Writer
+}
+
+func (rw *resetWriter) Write(p []byte) (int, error) {
+	r := rw.resetter
+	r.mutex.Lock()
+	if r.reset {
+		r.mutex.Unlock()
+		return 0, errReset
+	}
+	n := int64(len(p))
+	trigger := false
+	if r.fault.afterBytes > 0 && r.written+n >= r.fault.afterBytes {
+		trigger = true
+		if r.fault.midWrite {
+			n = r.fault.afterBytes - r.written
+		}
+	} else if r.due {
+		// The byte trigger takes precedence so exactly afterBytes are written
+		trigger = true
+		n = n / 2
+	}
+	r.written += n
+	r.mutex.Unlock()
+
+	written, err := rw.writer.Write(p[:n])
+	if trigger {
+		r.resetSockets()
+		return written, errReset
+	}
+	return written, err
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/efarrer/evilproxy/testing_utils"
+)
+
+/*
+ * Returns both ends of a local TCP connection
+ */
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	testing_utils.UnexpectedError(err, "listening", t)
+	defer listener.Close()
+	local, err := net.Dial("tcp", listener.Addr().String())
+	testing_utils.UnexpectedError(err, "dialing", t)
+	remote, err := listener.Accept()
+	testing_utils.UnexpectedError(err, "accepting", t)
+	return local, remote
+}
+
+/*
+ * Returns a function that closes the sockets, like a connection's fail
+ */
+func closer(sockets ...net.Conn) func() {
+	return func() {
+		for _, socket := range sockets {
+			socket.Close()
+		}
+	}
+}
+
+/*
+ * Reads from the peer until an error and fails the test unless it is a reset
+ */
+func expectReset(peer net.Conn, t *testing.T) []byte {
+	peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	received := []byte{}
+	buffer := make([]byte, 1024)
+	for {
+		n, err := peer.Read(buffer)
+		received = append(received, buffer[:n]...)
+		if err != nil {
+			if !errors.Is(err, syscall.ECONNRESET) {
+				t.Fatalf("Expected a connection reset got %v", err)
+			}
+			return received
+		}
+	}
+}
+
+func TestResetFaultValidation(t *testing.T) {
+	for _, fault := range []resetFault{
+		{sockets: "both"},
+		{afterBytes: 10, sockets: "accepted"},
+		{afterTime: time.Second, sockets: "dialed", midWrite: true},
+	} {
+		testing_utils.UnexpectedError(fault.validate(), "validating", t)
+	}
+	for _, fault := range []resetFault{
+		{sockets: "neither"},
+		{afterBytes: -1, sockets: "both"},
+		{afterTime: -time.Second, sockets: "both"},
+	} {
+		if fault.validate() == nil {
+			t.Fatalf("Expected an error validating %v", fault)
+		}
+	}
+}
+
+func TestResetAfterBytesResetsThePeer(t *testing.T) {
+	socket, peer := tcpPair(t)
+	defer peer.Close()
+	resetter := resetFault{afterBytes: 10, sockets: "both"}.start(socket, nil, closer(socket))
+	defer resetter.stop()
+	writer := resetter.writer(socket)
+
+	_, err := writer.Write(make([]byte, 6))
+	testing_utils.UnexpectedError(err, "writing", t)
+	if _, err = writer.Write(make([]byte, 6)); err != errReset {
+		t.Fatalf("Expected the write that reaches the limit to reset got %v", err)
+	}
+	if _, err = writer.Write(make([]byte, 6)); err != errReset {
+		t.Fatalf("Expected writes after the reset to fail got %v", err)
+	}
+	expectReset(peer, t)
+}
+
+func TestResetMidWriteTruncatesTheWrite(t *testing.T) {
+	socket, peer := tcpPair(t)
+	defer peer.Close()
+	resetter := resetFault{afterBytes: 10, sockets: "accepted", midWrite: true}.start(socket, nil, closer(socket))
+	defer resetter.stop()
+
+	if n, err := resetter.writer(socket).Write(make([]byte, 20)); n != 10 || err != errReset {
+		t.Fatalf("Expected 10 bytes to be written before the reset got %v %v", n, err)
+	}
+	expectReset(peer, t)
+}
+
+func TestResetAfterTimeResetsThePeer(t *testing.T) {
+	socket, peer := tcpPair(t)
+	defer peer.Close()
+	start := time.Now()
+	resetter := resetFault{afterTime: 50 * time.Millisecond, sockets: "both"}.start(nil, socket, closer(socket))
+	defer resetter.stop()
+
+	expectReset(peer, t)
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Fatalf("Expected the reset after 50ms got %v", elapsed)
+	}
+}
+
+func TestResetAfterTimeMidWriteTruncatesTheNextWrite(t *testing.T) {
+	socket, peer := tcpPair(t)
+	defer peer.Close()
+	resetter := resetFault{afterTime: 10 * time.Millisecond, sockets: "both", midWrite: true}.start(socket, nil, closer(socket))
+	defer resetter.stop()
+	writer := resetter.writer(socket)
+
+	_, err := writer.Write(make([]byte, 20))
+	testing_utils.UnexpectedError(err, "writing", t)
+	time.Sleep(50 * time.Millisecond)
+	if n, err := writer.Write(make([]byte, 20)); n != 10 || err != errReset {
+		t.Fatalf("Expected half of the write before the reset got %v %v", n, err)
+	}
+	expectReset(peer, t)
+}
+
+func TestResetMidWriteWritesExactlyAfterBytesOnceTheTimeTriggerIsDue(t *testing.T) {
+	socket, peer := tcpPair(t)
+	defer peer.Close()
+	resetter := resetFault{afterBytes: 30, afterTime: 10 * time.Millisecond, sockets: "both", midWrite: true}.start(socket, nil, closer(socket))
+	defer resetter.stop()
+	writer := resetter.writer(socket)
+
+	_, err := writer.Write(make([]byte, 16))
+	testing_utils.UnexpectedError(err, "writing", t)
+	time.Sleep(50 * time.Millisecond)
+	if n, err := writer.Write(make([]byte, 20)); n != 14 || err != errReset {
+		t.Fatalf("Expected 14 bytes to be written before the reset got %v %v", n, err)
+	}
+	if received := expectReset(peer, t); len(received) != 30 {
+		t.Fatalf("Expected the peer to receive 30 bytes got %v", len(received))
+	}
+}
+
+func TestResetAfterTimeMidWriteResetsAnIdleConnection(t *testing.T) {
+	socket, peer := tcpPair(t)
+	defer peer.Close()
+	start := time.Now()
+	resetter := resetFault{afterTime: 10 * time.Millisecond, sockets: "both", midWrite: true}.start(socket, nil, closer(socket))
+	defer resetter.stop()
+
+	expectReset(peer, t)
+	if elapsed := time.Since(start); elapsed < 10*time.Millisecond+midWriteGrace {
+		t.Fatalf("Expected the reset to wait for a write to truncate got %v", elapsed)
+	}
+}
+
+func TestResetOnlyResetsTheSelectedSocket(t *testing.T) {
+	accepted, acceptedPeer := tcpPair(t)
+	defer acceptedPeer.Close()
+	dialed, dialedPeer := tcpPair(t)
+	defer dialedPeer.Close()
+	resetter := resetFault{afterBytes: 1, sockets: "dialed"}.start(accepted, dialed, closer(accepted, dialed))
+	defer resetter.stop()
+
+	_, err := accepted.Write([]byte("closed not reset"))
+	testing_utils.UnexpectedError(err, "writing", t)
+	resetter.writer(dialed).Write([]byte{1})
+	expectReset(dialedPeer, t)
+
+	received, err := ioutil.ReadAll(acceptedPeer)
+	testing_utils.UnexpectedError(err, "reading", t)
+	if string(received) != "closed not reset" {
+		t.Fatalf("Expected the accepted socket to be closed normally got %q", received)
+	}
+}
+
+func TestResetClosesTheProxiedConnectionOnce(t *testing.T) {
+	pt := newProxyTest(t)
+	defer pt.client.Close()
+	defer pt.server.Close()
+	resetter := resetFault{afterBytes: 5, sockets: "accepted"}.start(pt.pc.accepted, pt.pc.dialed, pt.pc.fail)
+	defer resetter.stop()
+	pt.pc.wrapWriters(resetter.writer)
+	result := pt.run()
+
+	_, err := pt.server.Write(make([]byte, 10))
+	testing_utils.UnexpectedError(err, "writing", t)
+	expectReset(pt.client, t)
+	pt.expectClosedOnce(result, t)
+}
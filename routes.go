@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/efarrer/evilproxy/parser"
+)
+
+/*
+ * A route forwards the connections accepted on its listen address to its
+ * upstream address through a network that simulates its rule
+ */
+type route struct {
+	listen   string
+	upstream string
+	rule     *parser.Rule
+}
+
+/*
+ * Reads a routing table from the reader. Each route is a line with the
+ * address to listen on, the upstream address to forward to and the rule of
+ * the network to simulate. A route without a rule simulates a perfect network.
+ *
+ *     # listen  upstream          rule
+ *     :8080     localhost:80      profile(3g)
+ *     :8443     localhost:443     up: latency(20ms); down: latency(300ms) | loss(1%)
+ *
+ * Blank lines and lines starting with '#' are ignored. The source is used to
+ * describe the location of errors.
+ */
+func readRoutes(reader io.Reader, source string) ([]route, error) {
+	routes := []route{}
+	listening := map[string]int{}
+	scanner := bufio.NewScanner(reader)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) < 2 {
+			return nil, errors.New(fmt.Sprintf(
+				"%v:%v: expected a listen address and an upstream address.", source, line))
+		}
+		listen, upstream := fields[0], fields[1]
+		if previous, ok := listening[listen]; ok {
+			return nil, errors.New(fmt.Sprintf(
+				"%v:%v: \"%v\" is already routed on line %v.", source, line, listen, previous))
+		}
+		listening[listen] = line
+
+		// The rule is the rest of the line after the addresses
+		rest := strings.TrimSpace(text[len(listen):])
+		rule, err := parser.Parse(strings.TrimSpace(rest[len(upstream):]))
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("%v:%v: route \"%v\". %v", source, line, listen, err))
+		}
+		routes = append(routes, route{listen, upstream, rule})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(routes) == 0 {
+		return nil, errors.New(fmt.Sprintf("%v: no routes.", source))
+	}
+	return routes, nil
+}
+
+/*
+ * Reads the routing table in the file. See readRoutes for the format.
+ */
+func loadRoutes(path string) ([]route, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return readRoutes(file, path)
+}
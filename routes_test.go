@@ -0,0 +1,53 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/efarrer/evilproxy/testing_utils"
+)
+
+func TestReadRoutes(t *testing.T) {
+	table := `
+		# listen  upstream        rule
+		:8080     localhost:80
+		:8443     localhost:443   up: latency(20ms); down: latency(300ms) | loss(1%)  # slow
+		a:8080    a:80            latency(5ms)
+	`
+	routes, err := readRoutes(strings.NewReader(table), "routes")
+	testing_utils.UnexpectedError(err, "reading routes", t)
+	if len(routes) != 3 {
+		t.Fatalf("Expected 3 routes got %v", len(routes))
+	}
+	for i, expected := range []route{{listen: ":8080", upstream: "localhost:80"},
+		{listen: ":8443", upstream: "localhost:443"}, {listen: "a:8080", upstream: "a:80"}} {
+		if routes[i].listen != expected.listen || routes[i].upstream != expected.upstream {
+			t.Fatalf("Expected route %v to be %v -> %v got %v -> %v", i,
+				expected.listen, expected.upstream, routes[i].listen, routes[i].upstream)
+		}
+		if routes[i].rule == nil {
+			t.Fatalf("Expected route %v to have a rule", i)
+		}
+	}
+	if stages := len(routes[1].rule.Network().Downstream); stages != 2 {
+		t.Fatalf("Expected the second route's rule to have 2 downstream stages got %v", stages)
+	}
+}
+
+func TestReadRoutesReportsTheOffendingLine(t *testing.T) {
+	for table, expected := range map[string]string{
+		":8080 localhost:80\n:8081\n":                         "routes:2: expected a listen address and an upstream address.",
+		":8080 localhost:80\n\n:8080 localhost:81\n":          "routes:3: \":8080\" is already routed on line 1.",
+		"# comment\n:8080 localhost:80 latency(abc)\n":        "routes:2: route \":8080\". Unable to parse rule",
+		"# nothing but a comment\n":                           "routes: no routes.",
+		":8080 localhost:80 up: latency(1ms); up: loss(1%)\n": "routes:1: route \":8080\".",
+	} {
+		_, err := readRoutes(strings.NewReader(table), "routes")
+		if err == nil {
+			t.Fatalf("Expected an error reading %q", table)
+		}
+		if !strings.HasPrefix(err.Error(), expected) {
+			t.Fatalf("Expected an error starting with %q got %q", expected, err)
+		}
+	}
+}
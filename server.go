@@ -0,0 +1,232 @@
+package main
+
+import (
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * How long the connections must have been idle before checking for leaked
+ * goroutines, so those of the last connection have had time to finish
+ */
+const leakCheckDelay = 1 * time.Second
+
+/*
+ * A proxyServer accepts connections on its listeners and proxies each of them
+ * concurrently until the connection limit is reached or it's shut down. If
+ * maxConcurrent isn't 0 no more than that many connections are served at once
+ * and accepting waits for one to finish. Connections accepted at the same time
+ * as the last one allowed are closed.
+ *
+ * Once it stops accepting it waits for the connections being served to
+ * finish, for no longer than the drain timeout once it's been shut down.
+ */
+type proxyServer struct {
+	listeners []net.Listener
+	// Proxies a connection accepted on the listener with the index
+	proxy func(sock net.Conn, index int)
+	// The number of connections to accept, or -1 for no limit
+	connections   int
+	maxConcurrent int
+	drainTimeout  time.Duration
+	// If set it's called with the goroutines left over, each time the last
+	// connection being served finishes, if there are any
+	leaked func(count int, description string)
+
+	// Holds a value for each connection being served when the number of
+	// concurrent connections is limited
+	slots    chan bool
+	accepted int64
+	// The connections being proxied
+	proxying int32
+	// The connections being served, which includes checking for leaked
+	// goroutines once they've been proxied
+	active int32
+	// Receives a value when the last active connection finishes
+	idle chan bool
+	// Set while checking for leaked goroutines
+	checking int32
+	// The goroutines, apart from the accept loops, that should still be
+	// running once every connection has finished
+	baseline int
+	// The accept loops still running
+	accepting int32
+
+	// Closed once the listeners have been closed
+	acceptingStopped  chan bool
+	stopAcceptingOnce sync.Once
+	// Closed once the server is shutting down
+	stopping     chan bool
+	shutdownOnce sync.Once
+}
+
+/*
+ * Constructs a server that accepts connections on the listeners and passes
+ * them to proxy with the index of the listener they were accepted on
+ */
+func newProxyServer(listeners []net.Listener, proxy func(net.Conn, int),
+	connections, maxConcurrent int, drainTimeout time.Duration) *proxyServer {
+	ps := &proxyServer{
+		listeners:        listeners,
+		proxy:            proxy,
+		connections:      connections,
+		maxConcurrent:    maxConcurrent,
+		drainTimeout:     drainTimeout,
+		idle:             make(chan bool, 1),
+		acceptingStopped: make(chan bool),
+		stopping:         make(chan bool),
+	}
+	if maxConcurrent > 0 {
+		ps.slots = make(chan bool, maxConcurrent)
+	}
+	return ps
+}
+
+/*
+ * Closes the listeners unless they're already closed
+ */
+func (ps *proxyServer) stopAccepting() {
+	ps.stopAcceptingOnce.Do(func() {
+		close(ps.acceptingStopped)
+		for _, listener := range ps.listeners {
+			listener.Close()
+		}
+	})
+}
+
+/*
+ * Stops accepting connections and starts the drain timeout
+ */
+func (ps *proxyServer) shutdown() {
+	ps.shutdownOnce.Do(func() {
+		close(ps.stopping)
+		ps.stopAccepting()
+	})
+}
+
+func (ps *proxyServer) releaseSlot() {
+	if ps.slots != nil {
+		<-ps.slots
+	}
+}
+
+/*
+ * Proxies the connection then, if it was the last one being proxied, checks
+ * for leaked goroutines. Reports that the server is idle once it was the last
+ * connection being served.
+ */
+func (ps *proxyServer) serveConnection(sock net.Conn, index int) {
+	ps.proxy(sock, index)
+	ps.releaseSlot()
+
+	if atomic.AddInt32(&ps.proxying, -1) == 0 && ps.leaked != nil &&
+		atomic.CompareAndSwapInt32(&ps.checking, 0, 1) {
+		// Only this goroutine and the accept loops still running should
+		// have been added, unless another connection was accepted in the
+		// meantime
+		time.Sleep(leakCheckDelay)
+		cnt, value := outstandingGoRoutines()
+		expected := ps.baseline + int(atomic.LoadInt32(&ps.accepting)) + 1
+		if cnt > expected && atomic.LoadInt32(&ps.proxying) == 0 {
+			ps.leaked(cnt-ps.baseline, value)
+		}
+		atomic.StoreInt32(&ps.checking, 0)
+	}
+
+	if atomic.AddInt32(&ps.active, -1) != 0 {
+		return
+	}
+	select {
+	case ps.idle <- true:
+	default:
+	}
+}
+
+/*
+ * Accepts connections on the listener until the connection limit is reached
+ * or the server stops accepting
+ */
+func (ps *proxyServer) accept(listener net.Listener, index int) {
+	for {
+		if ps.slots != nil {
+			select {
+			case ps.slots <- true:
+			case <-ps.acceptingStopped:
+				return
+			}
+		}
+
+		sock, err := listener.Accept()
+		if err != nil {
+			select {
+			case <-ps.acceptingStopped:
+				ps.releaseSlot()
+				return
+			default:
+			}
+			log.Fatalf("Unable accept client connection. %v\n", err)
+		}
+
+		if ps.connections > 0 {
+			n := atomic.AddInt64(&ps.accepted, 1)
+			if n >= int64(ps.connections) {
+				ps.stopAccepting()
+			}
+			if n > int64(ps.connections) {
+				sock.Close()
+				ps.releaseSlot()
+				return
+			}
+		}
+
+		atomic.AddInt32(&ps.proxying, 1)
+		atomic.AddInt32(&ps.active, 1)
+		go ps.serveConnection(sock, index)
+	}
+}
+
+/*
+ * Accepts and proxies connections until the connection limit is reached or
+ * the server is shut down, then waits for the connections being served to
+ * finish
+ */
+func (ps *proxyServer) serve() {
+	if ps.leaked != nil {
+		ps.baseline, _ = outstandingGoRoutines()
+	}
+	if ps.connections == 0 {
+		ps.stopAccepting()
+		return
+	}
+	var accepting sync.WaitGroup
+	for i, listener := range ps.listeners {
+		accepting.Add(1)
+		atomic.AddInt32(&ps.accepting, 1)
+		go func(listener net.Listener, index int) {
+			defer accepting.Done()
+			defer atomic.AddInt32(&ps.accepting, -1)
+			ps.accept(listener, index)
+		}(listener, i)
+	}
+	accepting.Wait()
+
+	// Wait for the connections to finish, for no longer than the drain
+	// timeout once shutting down
+	var deadline <-chan time.Time
+	stopping := ps.stopping
+	for atomic.LoadInt32(&ps.active) != 0 {
+		select {
+		case <-ps.idle:
+		case <-stopping:
+			stopping = nil
+			log.Printf("Waiting up to %v for %v connections to finish.\n",
+				ps.drainTimeout, atomic.LoadInt32(&ps.active))
+			deadline = time.After(ps.drainTimeout)
+		case <-deadline:
+			return
+		}
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+/*
+ * A queuedListener accepts the connections queued on it. Queued connections
+ * are still accepted once it's closed, as they would be by a listener that
+ * accepted them just before it was closed.
+ */
+type queuedListener struct {
+	conns     chan net.Conn
+	closed    chan bool
+	closeOnce sync.Once
+}
+
+func newQueuedListener() *queuedListener {
+	return &queuedListener{conns: make(chan net.Conn, 10), closed: make(chan bool)}
+}
+
+func (ql *queuedListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-ql.conns:
+		return conn, nil
+	default:
+	}
+	select {
+	case conn := <-ql.conns:
+		return conn, nil
+	case <-ql.closed:
+		return nil, errors.New("Accepting on a closed listener.")
+	}
+}
+
+func (ql *queuedListener) Close() error {
+	ql.closeOnce.Do(func() {
+		close(ql.closed)
+	})
+	return nil
+}
+
+func (ql *queuedListener) Addr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+/*
+ * Queues a connection to be accepted and returns it
+ */
+func (ql *queuedListener) queue() *closeCountingConn {
+	_, accepted := net.Pipe()
+	conn := &closeCountingConn{Conn: accepted}
+	ql.conns <- conn
+	return conn
+}
+
+/*
+ * A closeCountingConn counts how often it's closed
+ */
+type closeCountingConn struct {
+	net.Conn
+	closes int32
+}
+
+func (cc *closeCountingConn) Close() error {
+	atomic.AddInt32(&cc.closes, 1)
+	return cc.Conn.Close()
+}
+
+/*
+ * A blockingProxy proxies connections by waiting until it's released. It
+ * records the connections proxied and the most it was proxying at once.
+ */
+type blockingProxy struct {
+	mutex   sync.Mutex
+	proxied []net.Conn
+	running int
+	most    int
+	started chan bool
+	release chan bool
+}
+
+func newBlockingProxy() *blockingProxy {
+	return &blockingProxy{started: make(chan bool, 10), release: make(chan bool)}
+}
+
+func (bp *blockingProxy) proxy(conn net.Conn, index int) {
+	bp.mutex.Lock()
+	bp.proxied = append(bp.proxied, conn)
+	bp.running++
+	if bp.running > bp.most {
+		bp.most = bp.running
+	}
+	bp.mutex.Unlock()
+	bp.started <- true
+
+	<-bp.release
+
+	bp.mutex.Lock()
+	bp.running--
+	bp.mutex.Unlock()
+}
+
+/*
+ * Waits for a connection to start being proxied
+ */
+func (bp *blockingProxy) expectStarted(t *testing.T) {
+	select {
+	case <-bp.started:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected a connection to be proxied")
+	}
+}
+
+/*
+ * Fails the test if a connection starts being proxied within a moment
+ */
+func (bp *blockingProxy) expectNotStarted(t *testing.T) {
+	select {
+	case <-bp.started:
+		t.Fatalf("Expected no more connections to be proxied")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+/*
+ * Serves in the background and returns a channel that's closed once serving
+ * returns
+ */
+func serveInBackground(ps *proxyServer) chan bool {
+	done := make(chan bool)
+	go func() {
+		ps.serve()
+		close(done)
+	}()
+	return done
+}
+
+func expectServed(done chan bool, t *testing.T) {
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the server to finish serving")
+	}
+}
+
+func TestProxyServerServesConnectionsConcurrently(t *testing.T) {
+	listener := newQueuedListener()
+	bp := newBlockingProxy()
+	ps := newProxyServer([]net.Listener{listener}, bp.proxy, 3, 0, time.Second)
+	for i := 0; i != 3; i++ {
+		listener.queue()
+	}
+	done := serveInBackground(ps)
+
+	// Every connection is proxied before any of them finish
+	for i := 0; i != 3; i++ {
+		bp.expectStarted(t)
+	}
+	close(bp.release)
+	expectServed(done, t)
+	if bp.most != 3 {
+		t.Fatalf("Expected 3 connections to be proxied at once got %v", bp.most)
+	}
+}
+
+func TestProxyServerLimitsTheConnectionsServedAtOnce(t *testing.T) {
+	listener := newQueuedListener()
+	bp := newBlockingProxy()
+	ps := newProxyServer([]net.Listener{listener}, bp.proxy, 3, 2, time.Second)
+	for i := 0; i != 3; i++ {
+		listener.queue()
+	}
+	done := serveInBackground(ps)
+
+	bp.expectStarted(t)
+	bp.expectStarted(t)
+	bp.expectNotStarted(t)
+	// Finishing a connection frees a slot for the next
+	bp.release <- true
+	bp.expectStarted(t)
+	close(bp.release)
+	expectServed(done, t)
+	if bp.most != 2 || len(bp.proxied) != 3 {
+		t.Fatalf("Expected 3 connections to be proxied no more than 2 at once got %v at most %v",
+			len(bp.proxied), bp.most)
+	}
+}
+
+func TestProxyServerClosesConnectionsAcceptedPastTheLimit(t *testing.T) {
+	listeners := []*queuedListener{newQueuedListener(), newQueuedListener()}
+	conns := []*closeCountingConn{listeners[0].queue(), listeners[1].queue()}
+	bp := newBlockingProxy()
+	close(bp.release)
+	ps := newProxyServer([]net.Listener{listeners[0], listeners[1]}, bp.proxy, 1, 0, time.Second)
+	expectServed(serveInBackground(ps), t)
+
+	if len(bp.proxied) != 1 {
+		t.Fatalf("Expected 1 connection to be proxied got %v", len(bp.proxied))
+	}
+	for i, conn := range conns {
+		closes := atomic.LoadInt32(&conn.closes)
+		if conn == bp.proxied[0] && closes != 0 {
+			t.Fatalf("Expected the proxied connection to be left open got %v closes", closes)
+		}
+		if conn != bp.proxied[0] && closes != 1 {
+			t.Fatalf("Expected connection %v, accepted past the limit, to be closed once got %v", i, closes)
+		}
+	}
+	for i, listener := range listeners {
+		select {
+		case <-listener.closed:
+		default:
+			t.Fatalf("Expected listener %v to be closed", i)
+		}
+	}
+}
+
+func TestProxyServerWithoutConnectionsToAcceptServesNone(t *testing.T) {
+	listener := newQueuedListener()
+	listener.queue()
+	bp := newBlockingProxy()
+	ps := newProxyServer([]net.Listener{listener}, bp.proxy, 0, 0, time.Second)
+	expectServed(serveInBackground(ps), t)
+	if len(bp.proxied) != 0 {
+		t.Fatalf("Expected no connections to be proxied got %v", len(bp.proxied))
+	}
+}
+
+func TestProxyServerWaitsNoLongerThanTheDrainTimeoutOnceShutDown(t *testing.T) {
+	const drainTimeout = 100 * time.Millisecond
+	listener := newQueuedListener()
+	listener.queue()
+	bp := newBlockingProxy()
+	defer close(bp.release)
+	ps := newProxyServer([]net.Listener{listener}, bp.proxy, -1, 0, drainTimeout)
+	done := serveInBackground(ps)
+	bp.expectStarted(t)
+
+	// The connection never finishes
+	start := time.Now()
+	ps.shutdown()
+	expectServed(done, t)
+	if elapsed := time.Since(start); elapsed < drainTimeout {
+		t.Fatalf("Expected to wait %v for the connection got %v", drainTimeout, elapsed)
+	}
+}
+
+func TestProxyServerStopsWaitingOnceTheConnectionsFinish(t *testing.T) {
+	listener := newQueuedListener()
+	listener.queue()
+	bp := newBlockingProxy()
+	ps := newProxyServer([]net.Listener{listener}, bp.proxy, -1, 0, time.Minute)
+	done := serveInBackground(ps)
+	bp.expectStarted(t)
+
+	ps.shutdown()
+	close(bp.release)
+	expectServed(done, t)
+}
+
+func TestProxyServerReportsLeakedGoroutines(t *testing.T) {
+	leak := make(chan bool)
+	defer close(leak)
+	for _, leaking := range []bool{false, true} {
+		listener := newQueuedListener()
+		listener.queue()
+		ps := newProxyServer([]net.Listener{listener}, func(conn net.Conn, index int) {
+			if leaking {
+				go func() { <-leak }()
+			}
+		}, 1, 0, time.Second)
+		var leaked int
+		ps.leaked = func(count int, description string) {
+			leaked = count
+		}
+		ps.serve()
+		if leaking && leaked == 0 {
+			t.Fatalf("Expected the leaked goroutine to be reported")
+		}
+		if !leaking && leaked != 0 {
+			t.Fatalf("Expected no goroutines to be reported got %v", leaked)
+		}
+	}
+}
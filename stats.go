@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+/*
+ * A proxyStats counts the connections served and the bytes forwarded so a
+ * summary can be reported on shutdown. The counts are updated atomically.
+ */
+type proxyStats struct {
+	accepted int64
+	finished int64
+	toServer int64
+	toClient int64
+}
+
+/*
+ * Records a connection accepted from a client
+ */
+func (s *proxyStats) accept() {
+	atomic.AddInt64(&s.accepted, 1)
+}
+
+/*
+ * Records a finished connection and the bytes forwarded in each direction
+ */
+func (s *proxyStats) finish(toServer, toClient int64) {
+	atomic.AddInt64(&s.finished, 1)
+	atomic.AddInt64(&s.toServer, toServer)
+	atomic.AddInt64(&s.toClient, toClient)
+}
+
+func (s *proxyStats) String() string {
+	accepted := atomic.LoadInt64(&s.accepted)
+	finished := atomic.LoadInt64(&s.finished)
+	return fmt.Sprintf("Accepted %v connections, %v finished and %v were abandoned. "+
+		"Forwarded %v bytes to the server and %v bytes to the client.",
+		accepted, finished, accepted-finished,
+		atomic.LoadInt64(&s.toServer), atomic.LoadInt64(&s.toClient))
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestProxyStatsSummarizesConnections(t *testing.T) {
+	stats := &proxyStats{}
+	stats.accept()
+	stats.accept()
+	stats.accept()
+	stats.finish(10, 200)
+	stats.finish(5, 0)
+
+	expected := "Accepted 3 connections, 2 finished and 1 were abandoned. " +
+		"Forwarded 15 bytes to the server and 200 bytes to the client."
+	if summary := stats.String(); summary != expected {
+		t.Fatalf("Expected %q got %q", expected, summary)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/efarrer/evilproxy/connection"
+)
+
+/*
+ * A transport adds protocol layers to the simulated network so the proxied
+ * connections behave like TCP over it rather than seeing its faults directly.
+ *
+ * Its name lists the layers separated by commas. It may start with one of
+ * none, reliable, reno or cubic, then handshake adds a three way handshake
+ * and flow adds flow control with a receive window of window bytes. However
+ * they're listed the reliable layer runs over the network, the handshake over
+ * that and flow control on top. The handshake and flow control layers expect
+ * a reliable network, or a reliable layer under them.
+ */
+type transport struct {
+	name   string
+	rto    time.Duration
+	window int64
+}
+
+/*
+ * Returns the transport's reliable layer, or none, and whether it has the
+ * handshake and flow control layers
+ */
+func (tr transport) layers() (string, bool, bool, error) {
+	reliable := ""
+	handshake, flowControl := false, false
+	for _, layer := range strings.Split(tr.name, ",") {
+		switch layer = strings.TrimSpace(layer); layer {
+		case "none", "reliable", "reno", "cubic":
+			if reliable != "" {
+				return "", false, false, errors.New(fmt.Sprintf(
+					"Transport \"%v\" has both %v and %v, expected only one of none, reliable, reno, cubic.",
+					tr.name, reliable, layer))
+			}
+			reliable = layer
+		case "handshake":
+			handshake = true
+		case "flow":
+			flowControl = true
+		default:
+			return "", false, false, errors.New(fmt.Sprintf(
+				"Unknown transport layer \"%v\", expected one of none, reliable, reno, cubic, handshake, flow.",
+				layer))
+		}
+	}
+	if reliable == "" {
+		reliable = "none"
+	}
+	return reliable, handshake, flowControl, nil
+}
+
+/*
+ * Returns an error if the transport is misconfigured
+ */
+func (tr transport) validate() error {
+	reliable, _, flowControl, err := tr.layers()
+	if err != nil {
+		return err
+	}
+	if reliable != "none" && tr.rto <= 0 {
+		return errors.New("The retransmission timeout must be greater than zero.")
+	}
+	if flowControl && tr.window <= 0 {
+		return errors.New("The flow control window must be greater than zero.")
+	}
+	return nil
+}
+
+/*
+ * Wraps one end of the simulated network with the transport's layers. The
+ * active end starts the handshake.
+ */
+func (tr transport) wrap(conn connection.Connection, active bool) connection.Connection {
+	reliable, handshake, flowControl, _ := tr.layers()
+	switch reliable {
+	case "reliable":
+		conn = connection.NewReliableConnection(conn, tr.rto)
+	case "reno":
+		conn = connection.NewCongestionControlledConnection(conn, tr.rto, connection.NewReno())
+	case "cubic":
+		conn = connection.NewCongestionControlledConnection(conn, tr.rto, connection.NewCubic())
+	}
+	if handshake {
+		conn = connection.NewHandshakeConnection(conn, active, rand.Int63n(1<<32))
+	}
+	if flowControl {
+		conn = connection.NewFlowControlConnection(conn, tr.window)
+	}
+	return conn
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/efarrer/evilproxy/packet"
+	"github.com/efarrer/evilproxy/testing_utils"
+)
+
+func TestTransportValidation(t *testing.T) {
+	for _, tr := range []transport{
+		{"none", 0, 0}, {"reliable", time.Second, 0}, {"reno", time.Second, 0}, {"cubic", time.Second, 0},
+		{"handshake", 0, 0}, {"flow", 0, 1}, {"cubic, handshake, flow", time.Second, 1},
+	} {
+		testing_utils.UnexpectedError(tr.validate(), "validating", t)
+	}
+	for _, tr := range []transport{
+		{"bogus", time.Second, 1}, {"reliable", 0, 1}, {"cubic", 0, 1}, {"reno,cubic", time.Second, 1},
+		{"flow", 0, 0}, {"reliable,", time.Second, 1},
+	} {
+		if tr.validate() == nil {
+			t.Fatalf("Expected an error validating %v", tr)
+		}
+	}
+}
+
+func TestReliableTransportsHideLoss(t *testing.T) {
+	const count = 50
+	for _, name := range []string{"reliable", "reno", "cubic", "reno,handshake,flow"} {
+		network := newControlledNetwork("loss(20%, seed=1)", t)
+		tr := transport{name, 5 * time.Millisecond, 1024}
+		server, client := tr.wrap(network.Server, false), tr.wrap(network.Client, true)
+
+		go func() {
+			for i := 0; i != count; i++ {
+				client.Write(&packet.Packet{Payload: []byte{byte(i)}})
+			}
+		}()
+		for i := 0; i != count; i++ {
+			rcvd, err := server.Read()
+			testing_utils.UnexpectedError(err, "reading", t)
+			if rcvd.Payload[0] != byte(i) {
+				t.Fatalf("Expected packet %v over %v got %v", i, name, rcvd.Payload[0])
+			}
+		}
+		server.Close()
+		client.Close()
+	}
+}
+
+func TestTransportsDeliverStreamsOverFragmentingNetworks(t *testing.T) {
+	const size = 14000
+	request := bytes.Repeat([]byte("0123456789"), size/10)
+	for _, name := range []string{"none", "reliable", "reno", "cubic", "cubic,handshake,flow"} {
+		for _, rule := range []string{"mtu(100)", "mtu(100, coalesce=1ms) | loss(5%, seed=1)"} {
+			if name == "none" && rule != "mtu(100)" {
+				continue
+			}
+			network := newControlledNetwork(rule, t)
+			tr := transport{name, 5 * time.Millisecond, 1024}
+			client, accepted := tcpPair(t)
+			dialed, server := tcpPair(t)
+			pc := newProxiedConnection(accepted, dialed, tr.wrap(network.Client, true), tr.wrap(network.Server, false))
+			go pc.run()
+
+			go func() {
+				client.Write(request)
+				client.(*net.TCPConn).CloseWrite()
+			}()
+			received, err := ioutil.ReadAll(server)
+			testing_utils.UnexpectedError(err, "reading", t)
+			if !bytes.Equal(received, request) {
+				t.Fatalf("Expected %v bytes over %v with %q got %v", size, name, rule, len(received))
+			}
+
+			server.Write(received[:size/2])
+			server.(*net.TCPConn).CloseWrite()
+			response, err := ioutil.ReadAll(client)
+			testing_utils.UnexpectedError(err, "reading", t)
+			if !bytes.Equal(response, request[:size/2]) {
+				t.Fatalf("Expected %v bytes back over %v with %q got %v", size/2, name, rule, len(response))
+			}
+			client.Close()
+			server.Close()
+		}
+	}
+}
+
+func TestFlowTransportStallsAWriterWhoseDataIsntRead(t *testing.T) {
+	network := newControlledNetwork("", t)
+	tr := transport{"handshake,flow", 0, 10}
+	server, client := tr.wrap(network.Server, false), tr.wrap(network.Client, true)
+	defer server.Close()
+	defer client.Close()
+
+	err := client.Write(&packet.Packet{Payload: make([]byte, 10)})
+	testing_utils.UnexpectedError(err, "writing", t)
+	written := make(chan error, 1)
+	go func() { written <- client.Write(&packet.Packet{Payload: make([]byte, 1)}) }()
+	select {
+	case err := <-written:
+		t.Fatalf("Expected the write to stall with a zero window got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	_, err = server.Read()
+	testing_utils.UnexpectedError(err, "reading", t)
+	testing_utils.UnexpectedError(<-written, "writing", t)
+}